@@ -0,0 +1,68 @@
+package api
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"github.com/labstack/gommon/log"
+	"smotri.me/model"
+	"smotri.me/pkg/utils"
+	"smotri.me/pkg/websocket"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Applies the chat filters to the content of the new or edited message: the max length applies to everyone,
+// the link policy, the slow mode and the duplicate check to the regular members only.
+// New messages are checked against the slow mode and the last message of the member as well
+func (api *API) filterMessage(u *model.User, method, content string, now time.Time) error {
+	if max := api.config.MaxMessageLength; max > 0 && utf8.RuneCountInString(content) > max {
+		return websocket.NewError(websocket.ErrCodeInvalidParams, "invalid '%s' request, param 'content' must be at most %d characters long", method, max)
+	}
+	// the role may have changed since the last check
+	role, err := api.storage.GetMemberRole(u.RoomID, u.ID)
+	if err != nil {
+		return err
+	}
+	if u.Role = role; model.Privileged(role) {
+		return nil
+	}
+	settings, err := api.storage.GetChatSettings(u.RoomID)
+	if err != nil {
+		return err
+	}
+	if settings.LinkPolicy == model.PolicyHost && utils.ContainsLink(content) {
+		return websocket.NewError(websocket.ErrCodeForbidden, "links are allowed to the host and co-hosts only")
+	}
+	if method != "new_message" {
+		return nil
+	}
+
+	last, err := api.storage.GetLastMessage(u.RoomID, u.ID)
+	if err != nil || last == nil {
+		return err
+	}
+	elapsed := time.Duration(utils.UnixMilli(now)-last.CreatedAt) * time.Millisecond
+	if slowMode := time.Duration(settings.SlowMode) * time.Second; elapsed < slowMode {
+		wait := (slowMode - elapsed + time.Second - 1) / time.Second
+		return websocket.NewError(websocket.ErrCodeRateLimited, "slow mode is on, wait %d seconds before the next message", wait)
+	}
+	if elapsed < api.config.DuplicateMessageWindow && last.Digest == messageDigest(content) {
+		return websocket.NewError(websocket.ErrCodeDuplicateMessage, "the message repeats the previous one")
+	}
+	return nil
+}
+
+// Remembers the new message of the member for the filters
+func (api *API) rememberMessage(u *model.User, m *model.ChatMessage) {
+	last := &model.LastMessage{Digest: messageDigest(m.Content), CreatedAt: m.CreatedAt}
+	if err := api.storage.SaveLastMessage(u.RoomID, u.ID, last); err != nil {
+		log.Error(err)
+	}
+}
+
+// Returns the digest of the message content, messages differing in case and whitespace only are the same
+func messageDigest(content string) string {
+	sum := sha1.Sum([]byte(strings.ToLower(strings.Join(strings.Fields(content), " "))))
+	return hex.EncodeToString(sum[:])
+}
@@ -1,75 +1,182 @@
 package api
 
 import (
+	"bytes"
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"github.com/gammazero/workerpool"
 	"github.com/gobwas/ws"
-	"github.com/gobwas/ws/wsutil"
+	"github.com/gobwas/ws/wsflate"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/labstack/gommon/log"
+	"net"
 	"net/http"
 	"net/url"
 	"smotri.me/config"
 	"smotri.me/model"
+	"smotri.me/pkg/jsonschema"
 	"smotri.me/pkg/msgbroker"
+	"smotri.me/pkg/netpoll"
+	"smotri.me/pkg/shardpool"
 	"smotri.me/pkg/utils"
 	"smotri.me/pkg/websocket"
+	"smotri.me/pkg/wsconn"
 	"smotri.me/storage"
 	"strconv"
+	"sync"
 	"time"
 )
 
+const (
+	// Default and max number of chat messages returned per history page
+	historyPageSize    = 50
+	maxHistoryPageSize = 100
+	// Max number of room messages waiting for a broadcast worker
+	broadcastQueueSize = 1024
+)
+
 type API struct {
 	echo       *echo.Echo
 	config     *config.Config
 	storage    storage.Storage
 	msgBroker  msgbroker.MessageBroker
 	workerPool *workerpool.WorkerPool
-	channels   websocket.Channels
+	// broadcastPool delivers room messages, messages of a room are delivered one by one in the publishing order
+	broadcastPool *shardpool.Pool
+	channels      websocket.Channels
+	// connMetrics is shared by all websocket connections
+	connMetrics *wsconn.Metrics
+	// methodStats holds stats by method name, the map is never modified after creation
+	methodStats map[string]*methodStats
+	// schema is the JSON Schema of the websocket protocol, generated once from the method declarations
+	schema *jsonschema.Schema
+	pinger *wsconn.Pinger
+	// poller is set in netpoll mode, connections are read by the worker pool when readable
+	// instead of a goroutine per connection
+	poller netpoll.Poller
+	// kicked holds the users disconnected by the host, they are removed from the room
+	// without waiting for the session to be resumed
+	kicked sync.Map
+	// live holds the connected users by the room and the resume token, so the session is resumed
+	// by taking over the connection which is still open, before its disconnect is noticed
+	live struct {
+		sync.Mutex
+		users map[string]*model.User
+	}
+	// rateLimits by method class and limiters of the user connections
+	rateLimits map[string]rateLimits
+	limiters   sync.Map
+	// nodeID identifies the API instance, members it serves are removed by other instances
+	// when it stops heartbeating
+	nodeID string
+	done   chan struct{}
 }
 
 func New(c *config.Config, s storage.Storage, mb msgbroker.MessageBroker) *API {
 	api := &API{
-		echo:       echo.New(),
-		config:     c,
-		storage:    s,
-		msgBroker:  mb,
-		workerPool: workerpool.New(c.MaxWorkers),
-		channels:   websocket.NewChannels(),
+		echo:          echo.New(),
+		config:        c,
+		storage:       s,
+		msgBroker:     mb,
+		workerPool:    workerpool.New(c.MaxWorkers),
+		broadcastPool: shardpool.New(c.BroadcastWorkers, broadcastQueueSize),
+		channels:      websocket.NewChannels(),
+		connMetrics:   &wsconn.Metrics{},
+		methodStats:   newMethodStats(),
+		schema:        protocolSchema(),
+		rateLimits: map[string]rateLimits{
+			rateChat:    {user: c.ChatRateLimit, room: c.RoomChatRateLimit},
+			rateControl: {user: c.ControlRateLimit, room: c.RoomControlRateLimit},
+			rateQuery:   {user: c.QueryRateLimit, room: c.RoomQueryRateLimit},
+		},
+		pinger: wsconn.NewPinger(c.PingInterval, c.PongTimeout, c.MaxIdleTime),
+		nodeID: utils.RandString(16),
+		done:   make(chan struct{}),
 	}
+	api.live.users = make(map[string]*model.User)
 
 	api.echo.HideBanner = true
 	api.echo.HidePort = true
+	api.echo.IPExtractor = ipExtractor(c.TrustedProxies)
 	api.echo.Use(middleware.CORS())
 	api.echo.Use(middleware.Recover())
 
 	api.echo.GET("/", api.ping)
 	api.echo.GET("/visits", api.getVisits)
+	api.echo.GET("/stats", api.getStats)
+	api.echo.GET("/stats/methods", api.getMethodStats)
+	api.echo.GET("/schema", api.getSchema)
 	api.echo.POST("/room", api.createRoom)
 	api.echo.GET("/room/:roomID", api.getRoom)
+	api.echo.GET("/room/:roomID/messages", api.getRoomMessages)
+	api.echo.POST("/room/:roomID/kick", api.moderationEndpoint("kick_member"))
+	api.echo.GET("/room/:roomID/bans", api.getRoomBans)
+	api.echo.POST("/room/:roomID/bans", api.moderationEndpoint("ban_member"))
+	api.echo.DELETE("/room/:roomID/bans/:userID", api.moderationEndpoint("unban_member"))
+	api.echo.POST("/room/:roomID/mutes", api.moderationEndpoint("mute_member"))
+	api.echo.DELETE("/room/:roomID/mutes/:userID", api.moderationEndpoint("unmute_member"))
 	api.echo.Any("/ws", api.websocketHandler)
 
 	return api
 }
 
+// Returns the extractor of the client IP, the forwarding headers are trusted only if the request
+// comes through the trusted proxies, so clients can not spoof the IP
+func ipExtractor(trustedProxies []string) echo.IPExtractor {
+	if len(trustedProxies) == 0 {
+		return echo.ExtractIPDirect()
+	}
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, proxy := range trustedProxies {
+		if _, ipRange, err := net.ParseCIDR(proxy); err == nil {
+			options = append(options, echo.TrustIPRange(ipRange))
+		}
+	}
+	return echo.ExtractIPFromXFFHeader(options...)
+}
+
 // Starts server
 func (api *API) Start() error {
-	err := api.msgBroker.Subscribe("messages:*", api.handleMessages)
+	err := api.subscribe()
 	if err != nil {
 		return err
 	}
+	if api.config.Netpoll {
+		if api.poller, err = netpoll.New(); err != nil {
+			return err
+		}
+	}
+	go api.heartbeat()
 	log.Infof("server started at port %d", api.config.HttpPort)
 	return api.echo.Start(":" + strconv.Itoa(api.config.HttpPort))
 }
 
 // Closes server
 func (api *API) Close(ctx context.Context) error {
+	close(api.done)
+	api.pinger.Close()
+	// message sources go first, so nothing is submitted to the stopped worker pool
+	if api.poller != nil {
+		_ = api.poller.Close()
+	}
+	if err := api.msgBroker.Unsubscribe("messages:*", "moderation:*"); err != nil {
+		log.Warn(err)
+	}
 	api.workerPool.StopWait()
+	api.broadcastPool.StopWait()
 	return api.echo.Shutdown(ctx)
 }
 
+// Subscribes to the room broadcasts and the moderation control messages of all rooms
+func (api *API) subscribe() error {
+	if err := api.msgBroker.Subscribe("messages:*", api.handleMessages); err != nil {
+		return err
+	}
+	return api.msgBroker.Subscribe("moderation:*", api.handleModeration)
+}
+
 // Ping handler
 func (api *API) ping(c echo.Context) error {
 	_, err := api.storage.IncrVisits()
@@ -97,10 +204,47 @@ func (api *API) getVisits(c echo.Context) error {
 	return c.JSON(http.StatusOK, map[string]int64{"visits": visits})
 }
 
+// Returns websocket connections stats
+func (api *API) getStats(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]uint64{
+		"dropped_messages":            api.connMetrics.Dropped(),
+		"disconnected_slow_consumers": api.connMetrics.Disconnected(),
+		"pong_timeouts":               api.connMetrics.PongTimeouts(),
+		"idle_timeouts":               api.connMetrics.IdleTimeouts(),
+	})
+}
+
+// Returns the number of calls and failed calls of every websocket method
+func (api *API) getMethodStats(c echo.Context) error {
+	stats := make(map[string]map[string]uint64, len(api.methodStats))
+	for name, s := range api.methodStats {
+		stats[name] = map[string]uint64{
+			"calls":  s.Calls(),
+			"errors": s.Errors(),
+		}
+	}
+	return c.JSON(http.StatusOK, stats)
+}
+
+// Returns the JSON Schema of the websocket protocol: the requests, the responses, the broadcasts
+// and the messages initiated by the server
+func (api *API) getSchema(c echo.Context) error {
+	return c.JSON(http.StatusOK, api.schema)
+}
+
+// createRoomRequest is the body of the room creation request, it holds the only fields set by the creator,
+// the members, playback and chat settings are controlled by the server
+type createRoomRequest struct {
+	Title         string `json:"title"`
+	VideoURL      string `json:"video_url"`
+	ControlPolicy string `json:"control_policy"`
+}
+
 // Room creation endpoint
 func (api *API) createRoom(c echo.Context) error {
-	var room model.Room
-	err := c.Bind(&room)
+	var req createRoomRequest
+	err := c.Bind(&req)
+	room := &model.Room{Title: req.Title, VideoURL: req.VideoURL, ControlPolicy: req.ControlPolicy}
 	if err != nil || !room.Valid() {
 		if err != nil {
 			log.Warn(err)
@@ -108,13 +252,18 @@ func (api *API) createRoom(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusUnprocessableEntity)
 	}
 
-	room.ID, err = api.storage.CreateTempRoom(&room, time.Hour*24)
+	room.HostToken = utils.RandString(32)
+	roomID, err := api.storage.CreateTempRoom(room, time.Hour*24)
+	if err == nil {
+		// the creator gets the room as it is stored, the host token included
+		room, err = api.storage.GetTempRoom(roomID)
+	}
 	if err != nil {
 		log.Error(err)
 		return echo.NewHTTPError(http.StatusConflict)
 	}
 
-	return c.JSON(http.StatusOK, &room)
+	return c.JSON(http.StatusOK, room)
 }
 
 // Returns room data by roomID
@@ -125,9 +274,39 @@ func (api *API) getRoom(c echo.Context) error {
 		log.Info(err)
 		return echo.NewHTTPError(http.StatusNotFound)
 	}
+	room.Playback = room.Playback.At(time.Now())
+	room.HostToken = ""
 	return c.JSON(http.StatusOK, room)
 }
 
+// Returns room chat history page, messages older than 'before' cursor
+func (api *API) getRoomMessages(c echo.Context) error {
+	before, _ := strconv.ParseInt(c.QueryParam("before"), 10, 64)
+	limit := utils.ParseInt(c.QueryParam("limit"), historyPageSize, 1, maxHistoryPageSize)
+	history, err := api.getHistory(c.Param("roomID"), before, limit)
+	if err != nil {
+		log.Info(err)
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+	return c.JSON(http.StatusOK, history)
+}
+
+// Returns chat history page with the cursor of the next (older) page, which is 0 on the last page
+func (api *API) getHistory(roomID string, before int64, limit int) (*websocket.HistoryPage, error) {
+	messages, err := api.storage.GetRoomMessages(roomID, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	var nextCursor int64
+	if len(messages) == limit && messages[0].Seq > 1 {
+		nextCursor = messages[0].Seq
+	}
+	if messages == nil {
+		messages = []*model.ChatMessage{}
+	}
+	return &websocket.HistoryPage{Messages: messages, NextCursor: nextCursor}, nil
+}
+
 // Endpoint to establish websocketHandler connection
 func (api *API) websocketHandler(c echo.Context) error {
 	username := c.QueryParam("username")
@@ -140,192 +319,620 @@ func (api *API) websocketHandler(c echo.Context) error {
 		return c.NoContent(http.StatusUnprocessableEntity)
 	}
 
-	conn, _, _, err := ws.UpgradeHTTP(c.Request(), c.Response())
+	role := model.RoleMember
+	if hostToken := c.QueryParam("host_token"); hostToken != "" {
+		room, err := api.storage.GetTempRoom(roomID)
+		if err != nil || subtle.ConstantTimeCompare([]byte(room.HostToken), []byte(hostToken)) != 1 {
+			return c.NoContent(http.StatusForbidden)
+		}
+		role = model.RoleHost
+	}
+
+	// the host is never banned, the others are recognized by the resumed user ID, the resume token or the IP
+	if role != model.RoleHost {
+		banned, err := api.isBanned(roomID, api.resumedUserID(c, roomID), c.QueryParam("resume_token"), c.RealIP())
+		if err != nil {
+			log.Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		if banned {
+			return c.NoContent(http.StatusForbidden)
+		}
+	}
+
+	// the first supported subprotocol offered by the client is accepted,
+	// compression is negotiated without context takeover, so compressed broadcast frames can be shared
+	upgrader := ws.HTTPUpgrader{Protocol: websocket.IsProtocolSupported}
+	deflate := wsflate.Extension{Parameters: wsflate.DefaultParameters}
+	if api.config.Compression {
+		upgrader.Negotiate = deflate.Negotiate
+	}
+	conn, _, hs, err := upgrader.Upgrade(c.Request(), c.Response())
 	if err != nil {
 		log.Warn(err)
 		return c.NoContent(http.StatusBadRequest)
 	}
+	// the session is taken once the connection is upgraded, the member of a rejected connection
+	// stays suspended and is removed when the resume window ends
+	session := api.takeSession(c, roomID)
 
 	user := &model.User{
-		ID:     roomID + utils.RandString(5),
-		Name:   username,
-		RoomID: roomID,
-		Color:  utils.GetRandomColor(),
-		Conn:   conn,
-		Time:   0,
+		ID:          roomID + utils.RandString(5),
+		Name:        username,
+		RoomID:      roomID,
+		Color:       utils.GetRandomColor(),
+		Role:        role,
+		Time:        0,
+		NodeID:      api.nodeID,
+		ResumeToken: utils.RandString(32),
+		Protocol:    hs.Protocol,
+		IP:          c.RealIP(),
+	}
+	if user.Protocol == "" {
+		user.Protocol = websocket.ProtocolJSON
+	}
+	if session != nil {
+		user.ID = session.User.ID
+		user.Name = session.User.Name
+		user.Color = session.User.Color
+		user.Time = session.User.Time
+	}
+	opts := wsconn.Options{
+		QueueSize:      api.config.WriteQueueSize,
+		Policy:         api.config.SlowConsumerPolicy,
+		WriteTimeout:   api.config.WriteTimeout,
+		Pinger:         api.pinger,
+		Metrics:        api.connMetrics,
+		Binary:         websocket.CodecOf(user.Protocol).Binary(),
+		MaxMessageSize: api.config.MaxMessageSize,
+	}
+	_, opts.Compression = deflate.Accepted()
+	if api.poller == nil {
+		user.Conn = wsconn.New(conn, opts)
+		api.handleUserConnect(user, session)
+		api.serveUser(user)
+		api.handleUserDisconnect(user)
+		return nil
 	}
 
-	api.handleUserConnect(user)
-	api.serveUser(user)
-	api.handleUserDisconnect(user)
+	// netpoll mode, the connection is read by the worker pool when readable,
+	// the user is disconnected once the connection is closed for any reason
+	connected := make(chan struct{})
+	opts.OnClose = func() {
+		_ = api.poller.Stop(conn)
+		go func() {
+			<-connected
+			api.handleUserDisconnect(user)
+		}()
+	}
+	user.Conn = wsconn.New(conn, opts)
+	api.handleUserConnect(user, session)
+	close(connected)
+	err = api.poller.Start(conn, func() {
+		api.workerPool.Submit(func() {
+			api.readUser(user)
+		})
+	})
+	if err != nil {
+		log.Error(err)
+		_ = user.Conn.Close()
+	}
 	return nil
 }
 
-// Serves user websocket connection
-func (api *API) serveUser(u *model.User) {
-	done := make(chan bool, 1)
-
-	go func() {
-		ticker := time.NewTicker(time.Second * 30)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-done:
-				return
-			case <-ticker.C:
-				err := wsutil.WriteServerMessage(u.Conn, ws.OpPing, []byte("ping"))
-				if err != nil {
-					log.Warn(err)
-					return
-				}
-			}
-		}
-	}()
+// Returns the ID of the room member resumed with the 'resume_token' query param without taking the session,
+// empty if there is none
+func (api *API) resumedUserID(c echo.Context, roomID string) string {
+	token := c.QueryParam("resume_token")
+	if token == "" || api.config.ResumeWindow <= 0 {
+		return ""
+	}
+	api.live.Lock()
+	u := api.live.users[liveKey(roomID, token)]
+	api.live.Unlock()
+	if u != nil {
+		return u.ID
+	}
+	session, err := api.storage.GetSession(roomID, token)
+	if err != nil {
+		log.Debug(err)
+		return ""
+	}
+	return session.User.ID
+}
 
-	for {
-		b, err := wsutil.ReadClientText(u.Conn)
-		if err != nil {
-			done <- true
-			break
+// Returns the session of the room member resumed with the 'resume_token' query param, nil if there is none.
+// The connection of the member still open is taken over, the session keeps it to be closed.
+// Broadcasts following the 'since' query param are replayed, the ones following the disconnect by default
+func (api *API) takeSession(c echo.Context, roomID string) *model.Session {
+	token := c.QueryParam("resume_token")
+	if token == "" || api.config.ResumeWindow <= 0 {
+		return nil
+	}
+	session, err := api.takeLiveSession(roomID, token)
+	if session == nil && err == nil {
+		session, err = api.storage.TakeSession(roomID, token)
+	}
+	if err != nil {
+		log.Debug(err)
+		return nil
+	}
+	if since, err := strconv.ParseInt(c.QueryParam("since"), 10, 64); err == nil && since >= 0 {
+		session.Seq = since
+	}
+	return session
+}
+
+func liveKey(roomID, token string) string {
+	return roomID + ":" + token
+}
+
+// Takes the session of the connected member with the resume token, nil if there is none
+// or the member is being kicked. Broadcasts following the current seq are replayed
+func (api *API) takeLiveSession(roomID, token string) (*model.Session, error) {
+	key := liveKey(roomID, token)
+	api.live.Lock()
+	u, ok := api.live.users[key]
+	if ok {
+		if _, kicked := api.kicked.Load(u); kicked {
+			ok = false
+		} else {
+			delete(api.live.users, key)
 		}
+	}
+	api.live.Unlock()
+	if !ok {
+		return nil, nil
+	}
+
+	seq, err := api.storage.GetRoomSeq(roomID)
+	if err != nil {
+		return nil, err
+	}
+	return &model.Session{User: u, Seq: seq}, nil
+}
+
+// Forgets the connected member, reports whether it was there. It is not if its session was taken over
+func (api *API) releaseLive(u *model.User) bool {
+	key := liveKey(u.RoomID, u.ResumeToken)
+	api.live.Lock()
+	defer api.live.Unlock()
+	if api.live.users[key] != u {
+		return false
+	}
+	delete(api.live.users, key)
+	return true
+}
 
-		msg := websocket.NewMessage()
-		err = json.Unmarshal(b, msg)
+// Serves user websocket connection
+func (api *API) serveUser(u *model.User) {
+	for {
+		b, err := u.Conn.ReadText()
 		if err != nil {
-			log.Warn(err)
-			continue
+			// closed by the client, missed pong, idle timeout or slow consumer policy
+			log.Debugf("user %s disconnected: %s", u.ID, err)
+			return
 		}
+		api.handleUserMessage(u, b)
+	}
+}
 
-		if err = msg.Validate(); err != nil {
-			log.Warn(err)
-			continue
-		}
+// Reads the next frame of the readable user connection in netpoll mode,
+// the connection is closed on failure, which leads to handleUserDisconnect
+func (api *API) readUser(u *model.User) {
+	// the connection is readable, but the client may stall in the middle of the frame
+	if api.config.NetpollReadTimeout > 0 {
+		_ = u.Conn.SetReadDeadline(time.Now().Add(api.config.NetpollReadTimeout))
+	}
+	b, ok, err := u.Conn.ReadFrame()
+	if err != nil {
+		log.Debugf("user %s disconnected: %s", u.ID, err)
+		_ = u.Conn.Close()
+		return
+	}
+	if ok {
+		api.handleUserMessage(u, b)
+	}
+	if err = api.poller.Resume(u.Conn.Conn); err != nil {
+		_ = u.Conn.Close()
+	}
+}
 
-		switch msg.Method {
-		case "new_message":
-			msg.ID = utils.RandString(5)
-		case "rename_member":
-			u.Name, _ = msg.Params["name"].(string)
-			err = api.storage.UpdateRoomUser(u.RoomID, u)
-			if err != nil {
-				log.Error(err)
-				continue
-			}
-		case "update_room":
-			title, _ := msg.Params["title"].(string)
-			videoURL, _ := msg.Params["video_url"].(string)
-			err = api.storage.UpdateTempRoom(&model.Room{
-				ID:       u.RoomID,
-				Title:    title,
-				VideoURL: videoURL,
-			})
-			if err != nil {
-				log.Error(err)
-				continue
-			}
-		case "get_me":
-			msg.Params["id"] = u.ID
-			msg.Params["name"] = u.Name
-			msg.Params["color"] = u.Color
-			msg.Params["time"] = u.Time
-			msg.Response = true
-		case "get_members":
-			room, err := api.storage.GetTempRoom(u.RoomID)
-			if err != nil {
-				log.Error(err)
-				continue
+// Returns the room broadcasts following the since seq, or the room snapshot
+// if they are not kept anymore. The seq of the last broadcast is returned in both cases
+func (api *API) resync(roomID string, since int64) (*websocket.ResyncResult, error) {
+	events, last, err := api.storage.GetRoomEvents(roomID, since)
+	if err == nil {
+		// the request IDs of the replayed broadcasts were only for their senders
+		raw := make([]json.RawMessage, len(events))
+		for i, e := range events {
+			if raw[i], _, err = withoutRequestID(e); err != nil {
+				return nil, err
 			}
-			msg.Params["members"] = room.Members
-			msg.Response = true
 		}
+		return &websocket.ResyncResult{Seq: last, Events: raw}, nil
+	}
+	if err != storage.ErrEventsExpired {
+		return nil, err
+	}
 
-		msg.UserID = u.ID
-		b, err = json.Marshal(&msg)
-		if err != nil {
-			log.Error(err)
-			continue
-		}
+	room, err := api.storage.GetTempRoom(roomID)
+	if err != nil {
+		return nil, err
+	}
+	room.Playback = room.Playback.At(time.Now())
+	room.HostToken = ""
+	return &websocket.ResyncResult{Seq: last, Snapshot: room}, nil
+}
 
-		if msg.Response {
-			err = wsutil.WriteServerText(u.Conn, b)
-		} else {
-			err = api.msgBroker.Publish(b, "messages:"+u.RoomID)
-		}
-		if err != nil {
-			log.Warn(err)
-		}
+// Applies playback control message to the room playback state
+// in one storage operation, so concurrent updates are not lost
+func (api *API) updatePlayback(roomID, method string, p *websocket.SyncParams) (*model.Playback, error) {
+	update := &model.PlaybackUpdate{Position: p.Position, Rate: p.Rate, UpdatedAt: utils.UnixMilli(time.Now())}
+	playing := method == "video_play"
+	switch method {
+	case "video_play", "video_pause":
+		update.Playing = &playing
+	case "video_sync":
+		update.Playing = p.Playing
+	}
+	return api.storage.UpdatePlayback(roomID, update)
+}
+
+// Replies to the user that the request was rejected,
+// errors other than websocket.Error are logged and reported as internal ones
+func (api *API) sendError(u *model.User, req *websocket.Message, err error) {
+	wsErr, ok := err.(*websocket.Error)
+	if !ok {
+		log.Error(err)
+		wsErr = websocket.NewError(websocket.ErrCodeInternal, "internal error")
 	}
+	msg := websocket.NewErrorMessage(req, wsErr)
+	msg.UserID = u.ID
+	api.sendToUser(u, msg)
 }
 
-// Websocket connect handler
-func (api *API) handleUserConnect(u *model.User) {
-	api.channels.Subscribe(u, u.RoomID)
+// Sends message directly to the user
+func (api *API) sendToUser(u *model.User, msg *websocket.Message) {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	frame, err := api.compileFrame(u, b)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if err = u.Conn.SendFrame(frame); err != nil {
+		log.Warn(err)
+	}
+}
 
-	err := api.storage.AddUserToRoom(u.RoomID, u)
+// Returns the frame of the JSON encoded message in the encoding of the user subprotocol,
+// messages not smaller than the threshold are compressed if the user negotiated compression
+func (api *API) compileFrame(u *model.User, data []byte) ([]byte, error) {
+	codec := websocket.CodecOf(u.Protocol)
+	p, err := codec.Encode(data)
 	if err != nil {
+		return nil, err
+	}
+	op := ws.OpText
+	if codec.Binary() {
+		op = ws.OpBinary
+	}
+	switch {
+	case u.Conn.Compression() && len(p) >= api.config.CompressionThreshold:
+		return wsconn.CompileCompressed(op, p)
+	case codec.Binary():
+		return wsconn.CompileBinary(p), nil
+	}
+	return wsconn.CompileText(p), nil
+}
+
+// frameKey identifies the encoding of the frame and whether it keeps the request ID for the sender
+type frameKey struct {
+	protocol   string
+	compressed bool
+	sender     bool
+}
+
+// requestEvent is the room broadcast with the params kept encoded
+type requestEvent struct {
+	ID        string          `json:"id,omitempty"`
+	RequestID string          `json:"request_id,omitempty"`
+	Seq       int64           `json:"seq,omitempty"`
+	UserID    string          `json:"user_id"`
+	Method    string          `json:"method"`
+	Params    json.RawMessage `json:"params,omitempty"`
+}
+
+// Returns the broadcast without the request ID, which is echoed to the member who sent the request only,
+// and the ID of the sender. Broadcasts not caused by a request are returned as is
+func withoutRequestID(data []byte) ([]byte, string, error) {
+	if !bytes.Contains(data, []byte(`"request_id":`)) {
+		return data, "", nil
+	}
+	var e requestEvent
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, "", err
+	}
+	if e.RequestID == "" {
+		return data, "", nil
+	}
+	e.RequestID = ""
+	b, err := json.Marshal(&e)
+	return b, e.UserID, err
+}
+
+// Websocket connect handler, the resumed member is not announced to the room again
+// and receives the broadcasts missed since the session seq
+func (api *API) handleUserConnect(u *model.User, session *model.Session) {
+	api.live.Lock()
+	api.live.users[liveKey(u.RoomID, u.ResumeToken)] = u
+	api.live.Unlock()
+
+	if session != nil {
+		api.resumeMember(u)
+	} else if err := api.storage.AddUserToRoom(u.RoomID, u); err != nil {
 		log.Error(err)
 	}
 
-	msg := &websocket.Message{
-		UserID: u.ID,
-		Method: "new_member",
-		Params: map[string]interface{}{
-			"id":    u.ID,
-			"name":  u.Name,
-			"color": u.Color,
-			"time":  u.Time,
-		},
+	// the room broadcast worker sends the welcome and subscribes the connection right after it,
+	// so the broadcasts delivered before are reflected by the welcome and the following ones come after it
+	done := make(chan struct{})
+	welcome := func() {
+		defer close(done)
+		if session != nil && session.User.Conn != nil {
+			// the connection taken over gets no more broadcasts, the following ones go to this one
+			api.channels.Unsubscribe(session.User, u.RoomID)
+			if err := session.User.Conn.Shutdown(ws.StatusNormalClosure, "resumed by another connection"); err != nil {
+				log.Debug(err)
+			}
+		}
+		api.welcomeUser(u, session)
+		api.channels.Subscribe(u, u.RoomID)
+	}
+	if !api.broadcastPool.Submit(u.RoomID, welcome) {
+		welcome()
 	}
+	<-done
 
-	b, err := json.Marshal(msg)
+	if session == nil {
+		api.announceMember(u)
+	}
+}
 
+// Sends the welcome to the user, the resumed member receives the broadcasts missed since the session seq after it
+func (api *API) welcomeUser(u *model.User, session *model.Session) {
+	if err := api.sendWelcome(u, session != nil); err != nil {
+		log.Error(err)
+		return
+	}
+	if session == nil {
+		return
+	}
+	// live broadcasts may repeat the replayed ones, clients skip the seq they have seen
+	params, err := api.resync(u.RoomID, session.Seq)
 	if err != nil {
 		log.Error(err)
 		return
 	}
+	api.sendToUser(u, &websocket.Message{
+		UserID: u.ID,
+		Method: "resync",
+		Params: params,
+	})
+}
+
+// Sends everything the client needs to render the room in a single 'welcome' message.
+// The state reflects at least the broadcasts up to its seq, the following ones are received live
+func (api *API) sendWelcome(u *model.User, resumed bool) error {
+	seq, err := api.storage.GetRoomSeq(u.RoomID)
+	if err != nil {
+		return err
+	}
+	room, err := api.storage.GetTempRoom(u.RoomID)
+	if err != nil {
+		return err
+	}
+	history, err := api.getHistory(u.RoomID, 0, historyPageSize)
+	if err != nil {
+		return err
+	}
+	api.sendToUser(u, &websocket.Message{
+		UserID: u.ID,
+		Method: "welcome",
+		Params: &websocket.WelcomeParams{
+			Me:          *websocket.NewMemberInfo(u),
+			ResumeToken: u.ResumeToken,
+			Resumed:     resumed,
+			Room: websocket.WelcomeRoom{
+				ID:            room.ID,
+				Title:         room.Title,
+				VideoURL:      room.VideoURL,
+				ControlPolicy: room.ControlPolicy,
+				Chat:          *room.Chat,
+			},
+			Members:  room.Members,
+			Playback: *room.Playback.At(time.Now()),
+			History:  *history,
+			Seq:      seq,
+		},
+	})
+	return nil
+}
 
-	if err = api.msgBroker.Publish(b, "messages:"+u.RoomID); err != nil {
+// Tells the room about the newcomer
+func (api *API) announceMember(u *model.User) {
+	err := api.publish(u.RoomID, &websocket.Message{
+		UserID: u.ID,
+		Method: "new_member",
+		Params: websocket.NewMemberInfo(u),
+	})
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// Moves the member kept in the room during the resume window to this node, the role is kept
+func (api *API) resumeMember(u *model.User) {
+	role, err := api.storage.GetMemberRole(u.RoomID, u.ID)
+	if err != nil {
+		log.Error(err)
+	} else {
+		u.Role = role
+	}
+	if err = api.storage.RemoveUserFromRoom(u.RoomID, u.ID); err != nil {
+		log.Error(err)
+	}
+	if err = api.storage.AddUserToRoom(u.RoomID, u); err != nil {
 		log.Error(err)
-		return
 	}
 }
 
-// Websocket disconnect handler
+// Websocket disconnect handler, the member is kept in the room during the resume window
+// unless it was kicked by the host
 func (api *API) handleUserDisconnect(u *model.User) {
 	_ = u.Conn.Close()
 	api.channels.Unsubscribe(u, u.RoomID)
+	api.limiters.Delete(u)
+	_, kicked := api.kicked.Load(u)
+	api.kicked.Delete(u)
+	if !api.releaseLive(u) {
+		// the member has moved to the connection resuming the session
+		return
+	}
+	if !kicked && api.config.ResumeWindow > 0 && api.suspendMember(u) {
+		return
+	}
+	api.removeMember(u)
+}
 
+// Saves the session of the disconnected member, the member is removed from the room
+// unless the session is resumed within the resume window. Reports whether the session was saved
+func (api *API) suspendMember(u *model.User) bool {
+	seq, err := api.storage.GetRoomSeq(u.RoomID)
+	if err == nil {
+		// the session outlives the window, so the timer below finds it unless it was resumed
+		session := &model.Session{User: u, Seq: seq, IP: u.IP}
+		err = api.storage.SaveSession(u.RoomID, u.ResumeToken, session, 2*api.config.ResumeWindow)
+	}
+	if err != nil {
+		log.Warn(err)
+		return false
+	}
+	time.AfterFunc(api.config.ResumeWindow, func() {
+		if _, err := api.storage.TakeSession(u.RoomID, u.ResumeToken); err == nil {
+			api.removeMember(u)
+		}
+	})
+	return true
+}
+
+// Removes the user from the room and tells the room about it
+func (api *API) removeMember(u *model.User) {
 	err := api.storage.RemoveUserFromRoom(u.RoomID, u.ID)
 	if err != nil {
 		log.Error(err)
 	}
+	api.publishLogout(u)
+}
 
-	b, err := json.Marshal(&websocket.Message{
+// Tells the room the member has left
+func (api *API) publishLogout(u *model.User) {
+	err := api.publish(u.RoomID, &websocket.Message{
 		UserID: u.ID,
 		Method: "logout_member",
 	})
 	if err != nil {
 		log.Error(err)
-	} else {
-		err = api.msgBroker.Publish(b, "messages:"+u.RoomID)
-		if err != nil {
-			log.Error(err)
+	}
+}
+
+// Broadcasts the message to the room, the message is stamped with the next room seq,
+// kept for resync and published in one step, so the room receives broadcasts in the seq order
+func (api *API) publish(roomID string, msg *websocket.Message) error {
+	msg.Seq = 0
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	msg.Seq, err = api.storage.PublishRoomEvent(roomID, "messages:"+roomID, b)
+	return err
+}
+
+// Extends the node lease and removes members of dead nodes until the API is closed
+func (api *API) heartbeat() {
+	ticker := time.NewTicker(api.config.NodeHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		api.beat()
+		select {
+		case <-api.done:
+			return
+		case <-ticker.C:
 		}
 	}
 }
 
-// Message broker messages handler
+func (api *API) beat() {
+	if err := api.storage.HeartbeatNode(api.nodeID, api.config.NodeLease); err != nil {
+		log.Error(err)
+	}
+	users, err := api.storage.ReapDeadNodes()
+	if err != nil {
+		log.Error(err)
+	}
+	for _, u := range users {
+		log.Infof("member %s of dead node %s removed from room %s", u.ID, u.NodeID, u.RoomID)
+		api.publishLogout(u)
+	}
+}
+
+// Message broker messages handler, messages are only queued to the subscribers
+// so slow clients do not hold the others. Messages of a room are broadcast by the same worker,
+// so clients receive them in the publishing order
 func (api *API) handleMessages(msg *msgbroker.Message) {
-	api.workerPool.Submit(func() {
-		if len(msg.Channel) > len("messages:") {
-			roomID := msg.Channel[len("messages:"):]
-			users := api.channels.GetSubscribers(roomID)
-			for _, u := range users {
-				err := wsutil.WriteServerText(u.Conn, msg.Data)
-				if err != nil {
-					log.Warn(err)
-				}
+	if len(msg.Channel) <= len("messages:") {
+		return
+	}
+	roomID := msg.Channel[len("messages:"):]
+	api.broadcastPool.Submit(roomID, func() {
+		api.broadcast(roomID, msg.Data)
+	})
+}
+
+// Sends the message to the room subscribers of this node,
+// the frame is built once per subprotocol and compression and shared by the subscribers sharing them.
+// The sender of the request causing the broadcast gets its own frame keeping the request ID
+func (api *API) broadcast(roomID string, data []byte) {
+	users := api.channels.GetSubscribers(roomID)
+	if len(users) == 0 {
+		return
+	}
+	others, sender, err := withoutRequestID(data)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	frames := make(map[frameKey][]byte, 1)
+	for _, u := range users {
+		key := frameKey{protocol: u.Protocol, compressed: u.Conn.Compression(), sender: sender != "" && u.ID == sender}
+		frame, ok := frames[key]
+		if !ok {
+			payload := others
+			if key.sender {
+				payload = data
+			}
+			if frame, err = api.compileFrame(u, payload); err != nil {
+				log.Error(err)
+				return
 			}
+			frames[key] = frame
 		}
-	})
+		if err := u.Conn.SendFrame(frame); err != nil {
+			log.Warn(err)
+		}
+	}
 }
@@ -0,0 +1,1755 @@
+package api
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gobwas/httphead"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack/v5"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"smotri.me/config"
+	"smotri.me/model"
+	"smotri.me/pkg/msgbroker"
+	"smotri.me/pkg/netpoll"
+	"smotri.me/pkg/ratelimit"
+	"smotri.me/pkg/utils"
+	"smotri.me/pkg/websocket"
+	"smotri.me/pkg/wsconn"
+	"smotri.me/storage"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.OFF)
+	os.Exit(m.Run())
+}
+
+// Returns API backed by the in-memory storage and message broker
+func newTestAPI(t testing.TB) *API {
+	mb := msgbroker.NewMemoryBroker()
+	api := New(&config.Config{MaxWorkers: 10, BroadcastWorkers: 4, WriteQueueSize: 256, SlowConsumerPolicy: wsconn.PolicyDropOldest}, storage.NewMemory(time.Minute, mb), mb)
+	require.NoError(t, api.subscribe())
+	return api
+}
+
+// Runs the test in every connection handling mode, netpoll is skipped where it is not supported
+func forEachMode(t *testing.T, test func(t *testing.T, api *API)) {
+	for _, mode := range []string{"goroutine", "netpoll"} {
+		t.Run(mode, func(t *testing.T) {
+			api := newTestAPI(t)
+			defer api.stop()
+			if mode == "netpoll" {
+				poller, err := netpoll.New()
+				if err == netpoll.ErrNotSupported {
+					t.Skip(err)
+				}
+				require.NoError(t, err)
+				api.poller = poller
+			}
+			test(t, api)
+		})
+	}
+}
+
+// Stops the API, message sources go first, so nothing is submitted to the stopped worker pool
+func (api *API) stop() {
+	api.pinger.Close()
+	if api.poller != nil {
+		_ = api.poller.Close()
+	}
+	_ = api.msgBroker.Close()
+	api.workerPool.StopWait()
+	api.broadcastPool.StopWait()
+	_ = api.storage.Close()
+}
+
+func (api *API) request(method, target, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	api.echo.ServeHTTP(rec, req)
+	return rec
+}
+
+// Connects to the room websocket of the test server, extra query params may be passed
+func dial(t *testing.T, server *httptest.Server, roomID, username string, query ...string) net.Conn {
+	u := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?room_id=" + roomID + "&username=" + username
+	for _, q := range query {
+		u += "&" + q
+	}
+	conn, br, _, err := ws.Dial(context.Background(), u)
+	require.NoError(t, err)
+	if br != nil {
+		// frames sent right after the handshake may be already buffered
+		return &bufferedConn{Conn: conn, r: br}
+	}
+	return conn
+}
+
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func send(t *testing.T, conn net.Conn, msg string) {
+	require.NoError(t, wsutil.WriteClientText(conn, []byte(msg)))
+}
+
+// message is the server message with the params decoded as is
+type message struct {
+	websocket.Message
+	Params map[string]interface{} `json:"params"`
+}
+
+// Reads messages until one with the method arrives
+func receive(t *testing.T, conn net.Conn, method string) *message {
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	for {
+		b, err := wsutil.ReadServerText(conn)
+		require.NoError(t, err)
+		msg := &message{}
+		require.NoError(t, json.Unmarshal(b, msg))
+		if msg.Method == method {
+			return msg
+		}
+	}
+}
+
+func TestPing(t *testing.T) {
+	api := newTestAPI(t)
+	defer api.stop()
+
+	rec := api.request(http.MethodGet, "/", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "OK", rec.Body.String())
+
+	rec = api.request(http.MethodGet, "/visits?date="+time.Now().Format("02.01.06"), "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"visits": 1}`, rec.Body.String())
+
+	rec = api.request(http.MethodGet, "/visits?date=invalid", "")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = api.request(http.MethodGet, "/visits?date=01.01.01", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestCreateRoom(t *testing.T) {
+	api := newTestAPI(t)
+	defer api.stop()
+
+	rec := api.request(http.MethodPost, "/room", `{"title": "Movie", "video_url": "https://youtube.com/watch?v=1"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var room model.Room
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &room))
+	assert.NotEmpty(t, room.ID)
+	assert.Equal(t, "Movie", room.Title)
+
+	rec = api.request(http.MethodGet, "/room/"+room.ID, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var got model.Room
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &got))
+	assert.Equal(t, room.ID, got.ID)
+	assert.Equal(t, "https://youtube.com/watch?v=1", got.VideoURL)
+	assert.Empty(t, got.Members)
+
+	rec = api.request(http.MethodPost, "/room", `{"title": "M", "video_url": "ftp://video"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+
+	// the server state of the room can not be set by the creator
+	rec = api.request(http.MethodPost, "/room", `{"title": "Movie", "video_url": "https://youtube.com", "id": "mine", "host_token": "mine",
+		"members": [{"id": "ghost", "name": "Ghost"}], "playback": {"position": 100, "playing": true, "rate": 4},
+		"chat": {"slow_mode": 3600, "link_policy": "host"}}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	room = model.Room{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &room))
+	assert.NotEqual(t, "mine", room.ID)
+	assert.NotEqual(t, "mine", room.HostToken)
+	assert.Empty(t, room.Members)
+	assert.Equal(t, &model.Playback{Rate: 1, UpdatedAt: room.Playback.UpdatedAt}, room.Playback)
+	assert.Equal(t, model.NewChatSettings(), room.Chat)
+
+	rec = api.request(http.MethodGet, "/room/unknown", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestWebsocketHandlerRejects(t *testing.T) {
+	api := newTestAPI(t)
+	defer api.stop()
+	roomID, err := api.storage.CreateTempRoom(&model.Room{Title: "Movie", VideoURL: "https://youtube.com"}, time.Hour)
+	require.NoError(t, err)
+
+	rec := api.request(http.MethodGet, "/ws?room_id=unknown&username=Cheburek", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = api.request(http.MethodGet, "/ws?room_id="+roomID+"&username=-", "")
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+}
+
+func TestHandleMessages(t *testing.T) {
+	api := newTestAPI(t)
+	defer api.stop()
+
+	var clients []net.Conn
+	for _, roomID := range []string{"room", "room", "other"} {
+		serverConn, clientConn := net.Pipe()
+		defer clientConn.Close()
+		conn := wsconn.New(serverConn, wsconn.Options{QueueSize: 10})
+		defer conn.Close()
+		api.channels.Subscribe(&model.User{ID: utils.RandString(5), RoomID: roomID, Conn: conn}, roomID)
+		clients = append(clients, clientConn)
+	}
+
+	require.NoError(t, api.msgBroker.Publish([]byte(`{"method":"video_play"}`), "messages:room"))
+	for _, c := range clients[:2] {
+		_ = c.SetReadDeadline(time.Now().Add(time.Second))
+		b, err := wsutil.ReadServerText(c)
+		require.NoError(t, err)
+		assert.Equal(t, `{"method":"video_play"}`, string(b))
+	}
+
+	_ = clients[2].SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err := wsutil.ReadServerText(clients[2])
+	assert.Error(t, err)
+}
+
+func TestOrderedDelivery(t *testing.T) {
+	api := newTestAPI(t)
+	defer api.stop()
+
+	const count = 200
+	rooms := []string{"a", "b", "c", "d", "e", "f"}
+	var wg sync.WaitGroup
+	for _, roomID := range rooms {
+		for i := 0; i < 2; i++ {
+			serverConn, clientConn := net.Pipe()
+			defer clientConn.Close()
+			conn := wsconn.New(serverConn, wsconn.Options{QueueSize: count})
+			defer conn.Close()
+			api.channels.Subscribe(&model.User{ID: utils.RandString(5), RoomID: roomID, Conn: conn}, roomID)
+
+			wg.Add(1)
+			go func(roomID string, c net.Conn) {
+				defer wg.Done()
+				for i := 0; i < count; i++ {
+					_ = c.SetReadDeadline(time.Now().Add(time.Second))
+					b, err := wsutil.ReadServerText(c)
+					if !assert.NoError(t, err, roomID) || !assert.Equal(t, roomID+strconv.Itoa(i), string(b)) {
+						return
+					}
+				}
+			}(roomID, clientConn)
+		}
+	}
+
+	// rooms are published concurrently, so their messages interleave
+	for _, roomID := range rooms {
+		wg.Add(1)
+		go func(roomID string) {
+			defer wg.Done()
+			for i := 0; i < count; i++ {
+				assert.NoError(t, api.msgBroker.Publish([]byte(roomID+strconv.Itoa(i)), "messages:"+roomID))
+			}
+		}(roomID)
+	}
+	wg.Wait()
+}
+
+func TestPublishSeqOrder(t *testing.T) {
+	api := newTestAPI(t)
+	defer api.stop()
+	roomID, err := api.storage.CreateTempRoom(&model.Room{Title: "Movie", VideoURL: "https://youtube.com"}, time.Hour)
+	require.NoError(t, err)
+
+	const publishers, count = 8, 50
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		serverConn, clientConn := net.Pipe()
+		defer clientConn.Close()
+		conn := wsconn.New(serverConn, wsconn.Options{QueueSize: publishers * count})
+		defer conn.Close()
+		api.channels.Subscribe(&model.User{ID: utils.RandString(5), RoomID: roomID, Conn: conn}, roomID)
+
+		wg.Add(1)
+		go func(c net.Conn) {
+			defer wg.Done()
+			var last int64
+			for i := 0; i < publishers*count; i++ {
+				_ = c.SetReadDeadline(time.Now().Add(time.Second))
+				b, err := wsutil.ReadServerText(c)
+				if !assert.NoError(t, err) {
+					return
+				}
+				msg := &message{}
+				if !assert.NoError(t, json.Unmarshal(b, msg)) || !assert.Equal(t, last+1, msg.Seq) {
+					return
+				}
+				last = msg.Seq
+			}
+		}(clientConn)
+	}
+
+	// racing publishers of the same room
+	for i := 0; i < publishers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < count; i++ {
+				assert.NoError(t, api.publish(roomID, &websocket.Message{UserID: "user", Method: "new_message"}))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestSlowConsumer(t *testing.T) {
+	api := newTestAPI(t)
+	defer api.stop()
+
+	newClient := func(policy string) net.Conn {
+		serverConn, clientConn := net.Pipe()
+		conn := wsconn.New(serverConn, wsconn.Options{QueueSize: 5, Policy: policy, Metrics: api.connMetrics})
+		api.channels.Subscribe(&model.User{ID: utils.RandString(5), RoomID: "room", Conn: conn}, "room")
+		return clientConn
+	}
+	fast := newClient(wsconn.PolicyDisconnect)
+	defer fast.Close()
+	// stalled clients never read
+	stalled := newClient(wsconn.PolicyDisconnect)
+	defer stalled.Close()
+	dropping := newClient(wsconn.PolicyDropOldest)
+	defer dropping.Close()
+
+	const count = 20
+	for i := 0; i < count; i++ {
+		require.NoError(t, api.msgBroker.Publish([]byte(strconv.Itoa(i)), "messages:room"))
+		// the fast client is not blocked by the stalled ones
+		_ = fast.SetReadDeadline(time.Now().Add(time.Second))
+		b, err := wsutil.ReadServerText(fast)
+		require.NoError(t, err)
+		assert.Equal(t, strconv.Itoa(i), string(b))
+	}
+
+	assert.Equal(t, uint64(1), api.connMetrics.Disconnected())
+	assert.True(t, api.connMetrics.Dropped() > 0)
+
+	_ = stalled.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := ioutil.ReadAll(stalled)
+	assert.NoError(t, err, "the stalled connection must be closed")
+
+	rec := api.request(http.MethodGet, "/stats", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var stats map[string]uint64
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &stats))
+	assert.Equal(t, uint64(1), stats["disconnected_slow_consumers"])
+	assert.Equal(t, api.connMetrics.Dropped(), stats["dropped_messages"])
+}
+
+func TestChatHistory(t *testing.T) {
+	api := newTestAPI(t)
+	defer api.stop()
+	server := httptest.NewServer(api.echo)
+	defer server.Close()
+	roomID, err := api.storage.CreateTempRoom(&model.Room{Title: "Movie", VideoURL: "https://youtube.com"}, time.Hour)
+	require.NoError(t, err)
+
+	first := dial(t, server, roomID, "First")
+	defer first.Close()
+	for _, content := range []string{"one", "two", "three"} {
+		send(t, first, `{"method": "new_message", "params": {"content": "`+content+`"}}`)
+		msg := receive(t, first, "new_message")
+		assert.Equal(t, content, msg.Params["content"])
+		assert.NotEmpty(t, msg.ID)
+	}
+
+	late := dial(t, server, roomID, "Late")
+	defer late.Close()
+	send(t, late, `{"method": "get_history", "params": {"limit": 2}}`)
+	msg := receive(t, late, "get_history")
+	messages, _ := msg.Params["messages"].([]interface{})
+	require.Len(t, messages, 2)
+	assert.Equal(t, "two", messages[0].(map[string]interface{})["content"])
+	assert.Equal(t, "First", messages[1].(map[string]interface{})["name"])
+	assert.Equal(t, float64(2), msg.Params["next_cursor"])
+
+	send(t, late, `{"method": "get_history", "params": {"before": 2, "limit": 2}}`)
+	msg = receive(t, late, "get_history")
+	messages, _ = msg.Params["messages"].([]interface{})
+	require.Len(t, messages, 1)
+	assert.Equal(t, "one", messages[0].(map[string]interface{})["content"])
+	assert.Equal(t, float64(0), msg.Params["next_cursor"])
+
+	rec := api.request(http.MethodGet, "/room/"+roomID+"/messages?limit=3", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var history struct {
+		Messages   []*model.ChatMessage `json:"messages"`
+		NextCursor int64                `json:"next_cursor"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &history))
+	require.Len(t, history.Messages, 3)
+	assert.Equal(t, "three", history.Messages[2].Content)
+	assert.Equal(t, int64(3), history.Messages[2].Seq)
+
+	rec = api.request(http.MethodGet, "/room/unknown/messages", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestResync(t *testing.T) {
+	api := newTestAPI(t)
+	defer api.stop()
+	server := httptest.NewServer(api.echo)
+	defer server.Close()
+	roomID, err := api.storage.CreateTempRoom(&model.Room{Title: "Movie", VideoURL: "https://youtube.com", HostToken: "secret"}, time.Hour)
+	require.NoError(t, err)
+
+	host := dial(t, server, roomID, "Host")
+	defer host.Close()
+	assert.Equal(t, int64(1), receive(t, host, "new_member").Seq)
+	viewer := dial(t, server, roomID, "Viewer")
+	defer viewer.Close()
+	assert.Equal(t, int64(2), receive(t, host, "new_member").Seq)
+
+	// every broadcast is stamped with the next seq
+	send(t, host, `{"request_id": "play", "method": "video_play", "params": {"position": 10}}`)
+	assert.Equal(t, int64(3), receive(t, viewer, "video_play").Seq)
+	send(t, host, `{"method": "new_message", "params": {"content": "hi"}}`)
+	assert.Equal(t, int64(4), receive(t, viewer, "new_message").Seq)
+
+	// missed broadcasts are replayed as they were sent
+	send(t, viewer, `{"method": "resync", "params": {"since": 2}}`)
+	msg := receive(t, viewer, "resync")
+	assert.Zero(t, msg.Seq)
+	assert.Equal(t, float64(4), msg.Params["seq"])
+	events, _ := msg.Params["events"].([]interface{})
+	require.Len(t, events, 2)
+	assert.Equal(t, "video_play", events[0].(map[string]interface{})["method"])
+	assert.Equal(t, float64(3), events[0].(map[string]interface{})["seq"])
+	assert.NotContains(t, events[0], "request_id", "the request ID is for the sender only")
+	assert.Equal(t, "hi", events[1].(map[string]interface{})["params"].(map[string]interface{})["content"])
+
+	send(t, viewer, `{"method": "resync", "params": {"since": 4}}`)
+	msg = receive(t, viewer, "resync")
+	assert.Empty(t, msg.Params["events"])
+
+	// the gap is too large, the room state is sent instead
+	for i := 0; i < storage.EventRetention; i++ {
+		send(t, host, `{"method": "video_sync", "params": {"position": 20}}`)
+	}
+	for seq := int64(5); seq <= 4+storage.EventRetention; seq++ {
+		require.Equal(t, seq, receive(t, host, "video_sync").Seq)
+	}
+	send(t, viewer, `{"method": "resync", "params": {"since": 2}}`)
+	msg = receive(t, viewer, "resync")
+	assert.Equal(t, float64(4+storage.EventRetention), msg.Params["seq"])
+	assert.Nil(t, msg.Params["events"])
+	snapshot, _ := msg.Params["snapshot"].(map[string]interface{})
+	require.NotNil(t, snapshot)
+	assert.Equal(t, "Movie", snapshot["title"])
+	assert.Nil(t, snapshot["host_token"])
+	assert.Len(t, snapshot["members"], 2)
+	assert.Equal(t, true, snapshot["playback"].(map[string]interface{})["playing"])
+}
+
+// Reads messages until nothing arrives within the timeout, returns their methods
+func receiveAll(t *testing.T, conn net.Conn, timeout time.Duration) []string {
+	var methods []string
+	for {
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(timeout)))
+		b, err := wsutil.ReadServerText(conn)
+		if err != nil {
+			return methods
+		}
+		msg := &message{}
+		require.NoError(t, json.Unmarshal(b, msg))
+		methods = append(methods, msg.Method)
+	}
+}
+
+func TestSessionResume(t *testing.T) {
+	api := newTestAPI(t)
+	api.config.ResumeWindow = 300 * time.Millisecond
+	defer api.stop()
+	server := httptest.NewServer(api.echo)
+	defer server.Close()
+	roomID, err := api.storage.CreateTempRoom(&model.Room{Title: "Movie", VideoURL: "https://youtube.com"}, time.Hour)
+	require.NoError(t, err)
+
+	host := dial(t, server, roomID, "Host")
+	defer host.Close()
+	viewer := dial(t, server, roomID, "Viewer")
+	session := receive(t, viewer, "welcome")
+	assert.Equal(t, false, session.Params["resumed"])
+	me := session.Params["me"].(map[string]interface{})
+	userID, _ := me["id"].(string)
+	color := me["color"]
+	token, _ := session.Params["resume_token"].(string)
+	require.NotEmpty(t, token)
+	for receive(t, host, "new_member").UserID != userID {
+	}
+
+	require.NoError(t, viewer.Close())
+	require.Eventually(t, func() bool {
+		return len(api.channels.GetSubscribers(roomID)) == 1
+	}, time.Second, time.Millisecond)
+	send(t, host, `{"method": "new_message", "params": {"content": "missed"}}`)
+	receive(t, host, "new_message")
+
+	// the identity is restored and the missed broadcasts are replayed
+	viewer = dial(t, server, roomID, "Other", "resume_token="+token)
+	defer viewer.Close()
+	session = receive(t, viewer, "welcome")
+	assert.Equal(t, true, session.Params["resumed"])
+	assert.Equal(t, userID, session.Params["me"].(map[string]interface{})["id"])
+	assert.NotEqual(t, token, session.Params["resume_token"])
+	resync := receive(t, viewer, "resync")
+	events, _ := resync.Params["events"].([]interface{})
+	require.Len(t, events, 1)
+	assert.Equal(t, "missed", events[0].(map[string]interface{})["params"].(map[string]interface{})["content"])
+	send(t, viewer, `{"method": "get_me"}`)
+	me = receive(t, viewer, "get_me").Params
+	assert.Equal(t, userID, me["id"])
+	assert.Equal(t, "Viewer", me["name"])
+	assert.Equal(t, color, me["color"])
+
+	// the room has not noticed the reconnect
+	methods := receiveAll(t, host, api.config.ResumeWindow+100*time.Millisecond)
+	assert.NotContains(t, methods, "logout_member")
+	assert.NotContains(t, methods, "new_member")
+	send(t, host, `{"method": "get_members"}`)
+	assert.Len(t, receive(t, host, "get_members").Params["members"], 2)
+
+	// tokens are single-use
+	other := dial(t, server, roomID, "Other", "resume_token="+token)
+	defer other.Close()
+	session = receive(t, other, "welcome")
+	assert.Equal(t, false, session.Params["resumed"])
+	assert.NotEqual(t, userID, session.Params["me"].(map[string]interface{})["id"])
+
+	// the member leaves once the window is over
+	require.NoError(t, viewer.Close())
+	for {
+		msg := receive(t, host, "logout_member")
+		if msg.UserID == userID {
+			break
+		}
+	}
+}
+
+func TestSessionTakeover(t *testing.T) {
+	forEachMode(t, func(t *testing.T, api *API) {
+		api.config.ResumeWindow = 300 * time.Millisecond
+		server := httptest.NewServer(api.echo)
+		defer server.Close()
+		roomID, err := api.storage.CreateTempRoom(&model.Room{Title: "Movie", VideoURL: "https://youtube.com"}, time.Hour)
+		require.NoError(t, err)
+
+		host := dial(t, server, roomID, "Host")
+		defer host.Close()
+		viewer := dial(t, server, roomID, "Viewer")
+		defer viewer.Close()
+		session := receive(t, viewer, "welcome")
+		userID := session.Params["me"].(map[string]interface{})["id"].(string)
+		token := session.Params["resume_token"].(string)
+		for receive(t, host, "new_member").UserID != userID {
+		}
+
+		// the first connection is still open, the server has not noticed it is gone
+		resumed := dial(t, server, roomID, "Other", "resume_token="+token)
+		defer resumed.Close()
+		session = receive(t, resumed, "welcome")
+		assert.Equal(t, true, session.Params["resumed"])
+		assert.Equal(t, userID, session.Params["me"].(map[string]interface{})["id"])
+		assert.Equal(t, "Viewer", session.Params["me"].(map[string]interface{})["name"])
+		code, _ := receiveClose(t, viewer)
+		assert.Equal(t, ws.StatusNormalClosure, code)
+
+		// the room has not noticed the takeover and the member stays after the window
+		send(t, host, `{"method": "new_message", "params": {"content": "live"}}`)
+		assert.Equal(t, "live", receive(t, resumed, "new_message").Params["content"])
+		methods := receiveAll(t, host, api.config.ResumeWindow+100*time.Millisecond)
+		assert.NotContains(t, methods, "logout_member")
+		assert.NotContains(t, methods, "new_member")
+		send(t, host, `{"method": "get_members"}`)
+		assert.Len(t, receive(t, host, "get_members").Params["members"], 2)
+		send(t, resumed, `{"method": "get_me"}`)
+		assert.Equal(t, userID, receive(t, resumed, "get_me").Params["id"])
+
+		// the token of the closed connection is used up
+		other := dial(t, server, roomID, "Other", "resume_token="+token)
+		defer other.Close()
+		assert.Equal(t, false, receive(t, other, "welcome").Params["resumed"])
+	})
+}
+
+func TestWelcome(t *testing.T) {
+	api := newTestAPI(t)
+	defer api.stop()
+	server := httptest.NewServer(api.echo)
+	defer server.Close()
+	roomID, err := api.storage.CreateTempRoom(&model.Room{Title: "Movie", VideoURL: "https://youtube.com", HostToken: "secret"}, time.Hour)
+	require.NoError(t, err)
+
+	host := dial(t, server, roomID, "Host", "host_token=secret")
+	defer host.Close()
+	welcome := receive(t, host, "welcome")
+	assert.Equal(t, model.RoleHost, welcome.Params["me"].(map[string]interface{})["role"])
+	send(t, host, `{"method": "video_play", "params": {"position": 10}}`)
+	receive(t, host, "video_play")
+	for _, content := range []string{"one", "two"} {
+		send(t, host, `{"method": "new_message", "params": {"content": "`+content+`"}}`)
+		receive(t, host, "new_message")
+	}
+
+	viewer := dial(t, server, roomID, "Viewer")
+	defer viewer.Close()
+	welcome = receive(t, viewer, "welcome")
+	me := welcome.Params["me"].(map[string]interface{})
+	assert.Equal(t, welcome.UserID, me["id"])
+	assert.Equal(t, "Viewer", me["name"])
+	assert.Equal(t, model.RoleMember, me["role"])
+	assert.NotEmpty(t, me["color"])
+	assert.NotEmpty(t, welcome.Params["resume_token"])
+	assert.Equal(t, map[string]interface{}{
+		"id":             roomID,
+		"title":          "Movie",
+		"video_url":      "https://youtube.com",
+		"control_policy": model.PolicyEveryone,
+		"chat":           map[string]interface{}{"slow_mode": float64(0), "link_policy": model.PolicyEveryone},
+	}, welcome.Params["room"])
+	members, _ := welcome.Params["members"].([]interface{})
+	assert.Len(t, members, 2)
+	assert.Equal(t, true, welcome.Params["playback"].(map[string]interface{})["playing"])
+	messages, _ := welcome.Params["history"].(map[string]interface{})["messages"].([]interface{})
+	require.Len(t, messages, 2)
+	assert.Equal(t, "two", messages[1].(map[string]interface{})["content"])
+	// the host joining, the play and two chat messages, the viewer joining follows the welcome
+	assert.Equal(t, float64(4), welcome.Params["seq"])
+	assert.Equal(t, int64(5), receive(t, viewer, "new_member").Seq)
+}
+
+func TestWelcomeFirst(t *testing.T) {
+	forEachMode(t, func(t *testing.T, api *API) {
+		server := httptest.NewServer(api.echo)
+		defer server.Close()
+		roomID, err := api.storage.CreateTempRoom(&model.Room{Title: "Movie", VideoURL: "https://youtube.com"}, time.Hour)
+		require.NoError(t, err)
+
+		host := dial(t, server, roomID, "Host")
+		defer host.Close()
+		receive(t, host, "welcome")
+		synced := make(chan struct{})
+		go func() {
+			defer close(synced)
+			for i := 0; i < 100; i++ {
+				_ = wsutil.WriteClientText(host, []byte(`{"method": "video_sync", "params": {"position": 1}}`))
+			}
+		}()
+
+		// the room is busy while the viewer joins, nothing comes before the welcome and nothing after it is lost
+		viewer := dial(t, server, roomID, "Viewer")
+		defer viewer.Close()
+		require.NoError(t, viewer.SetReadDeadline(time.Now().Add(time.Second)))
+		b, err := wsutil.ReadServerText(viewer)
+		require.NoError(t, err)
+		welcome := &message{}
+		require.NoError(t, json.Unmarshal(b, welcome))
+		require.Equal(t, "welcome", welcome.Method)
+		<-synced
+		send(t, host, `{"method": "new_message", "params": {"content": "done"}}`)
+
+		seen := make(map[int64]bool)
+		for {
+			b, err := wsutil.ReadServerText(viewer)
+			require.NoError(t, err)
+			msg := &message{}
+			require.NoError(t, json.Unmarshal(b, msg))
+			seen[msg.Seq] = true
+			if msg.Method == "new_message" {
+				for seq := int64(welcome.Params["seq"].(float64)) + 1; seq <= msg.Seq; seq++ {
+					assert.True(t, seen[seq], "missed seq %d", seq)
+				}
+				return
+			}
+		}
+	})
+}
+
+func TestMsgpackProtocol(t *testing.T) {
+	forEachMode(t, func(t *testing.T, api *API) {
+		server := httptest.NewServer(api.echo)
+		defer server.Close()
+		roomID, err := api.storage.CreateTempRoom(&model.Room{Title: "Movie", VideoURL: "https://youtube.com"}, time.Hour)
+		require.NoError(t, err)
+
+		u := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?room_id=" + roomID + "&username=Binary"
+		conn, br, hs, err := ws.Dialer{Protocols: []string{"cbor", websocket.ProtocolMsgpack}}.Dial(context.Background(), u)
+		require.NoError(t, err)
+		defer conn.Close()
+		assert.Equal(t, websocket.ProtocolMsgpack, hs.Protocol)
+		binary := conn
+		if br != nil {
+			binary = &bufferedConn{Conn: conn, r: br}
+		}
+		// clients asking for no subprotocol keep JSON
+		text := dial(t, server, roomID, "Text")
+		defer text.Close()
+
+		receiveMsgpack := func(method string) map[string]interface{} {
+			require.NoError(t, binary.SetReadDeadline(time.Now().Add(time.Second)))
+			for {
+				b, op, err := wsutil.ReadServerData(binary)
+				require.NoError(t, err)
+				require.Equal(t, ws.OpBinary, op)
+				var msg map[string]interface{}
+				require.NoError(t, msgpack.Unmarshal(b, &msg))
+				if msg["method"] == method {
+					return msg
+				}
+			}
+		}
+		welcome := receiveMsgpack("welcome")
+		assert.Equal(t, "Binary", welcome["params"].(map[string]interface{})["me"].(map[string]interface{})["name"])
+
+		req, err := msgpack.Marshal(map[string]interface{}{
+			"request_id": "1",
+			"method":     "video_sync",
+			"params":     map[string]interface{}{"position": 12, "rate": 1.5, "playing": true},
+		})
+		require.NoError(t, err)
+		require.NoError(t, wsutil.WriteClientBinary(binary, req))
+
+		sync := receiveMsgpack("video_sync")
+		assert.Equal(t, "1", sync["request_id"])
+		params := sync["params"].(map[string]interface{})
+		assert.EqualValues(t, 12, params["position"])
+		assert.EqualValues(t, 1.5, params["rate"])
+		assert.Equal(t, true, params["playing"])
+		others := receive(t, text, "video_sync")
+		assert.Equal(t, 1.5, others.Params["rate"])
+		assert.Empty(t, others.RequestID, "the request ID is for the sender only")
+
+		// errors are encoded for the client too, text frames are ignored
+		require.NoError(t, wsutil.WriteClientText(binary, []byte(`{"method": "get_me"}`)))
+		require.NoError(t, wsutil.WriteClientBinary(binary, []byte{0xc1}))
+		assert.Equal(t, websocket.ErrCodeBadRequest, receiveMsgpack("error")["params"].(map[string]interface{})["code"])
+	})
+}
+
+func TestCompression(t *testing.T) {
+	forEachMode(t, func(t *testing.T, api *API) {
+		api.config.Compression = true
+		api.config.CompressionThreshold = 200
+		server := httptest.NewServer(api.echo)
+		defer server.Close()
+		roomID, err := api.storage.CreateTempRoom(&model.Room{Title: "Movie", VideoURL: "https://youtube.com"}, time.Hour)
+		require.NoError(t, err)
+
+		u := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?room_id=" + roomID + "&username=Mobile"
+		dialer := ws.Dialer{Extensions: []httphead.Option{wsflate.DefaultParameters.Option()}}
+		conn, br, hs, err := dialer.Dial(context.Background(), u)
+		require.NoError(t, err)
+		defer conn.Close()
+		require.Len(t, hs.Extensions, 1)
+		compressed := conn
+		if br != nil {
+			compressed = &bufferedConn{Conn: conn, r: br}
+		}
+		plain := dial(t, server, roomID, "Desktop")
+		defer plain.Close()
+
+		// messages not smaller than the threshold arrive compressed
+		receiveCompressed := func(method string) *message {
+			require.NoError(t, compressed.SetReadDeadline(time.Now().Add(time.Second)))
+			for {
+				frame, err := ws.ReadFrame(compressed)
+				require.NoError(t, err)
+				if frame.Header.OpCode.IsControl() {
+					continue
+				}
+				wasCompressed, err := wsflate.IsCompressed(frame.Header)
+				require.NoError(t, err)
+				frame, err = wsflate.DecompressFrame(frame)
+				require.NoError(t, err)
+				assert.Equal(t, len(frame.Payload) >= 200, wasCompressed, string(frame.Payload))
+				msg := &message{}
+				require.NoError(t, json.Unmarshal(frame.Payload, msg))
+				if msg.Method == method {
+					return msg
+				}
+			}
+		}
+		receiveCompressed("welcome")
+
+		// the client compresses its messages too
+		content := strings.Repeat("long message ", 30)
+		var buf bytes.Buffer
+		w := wsflate.NewWriter(&buf, func(w io.Writer) wsflate.Compressor {
+			f, _ := flate.NewWriter(w, flate.BestCompression)
+			return f
+		})
+		_, err = w.Write([]byte(`{"method": "new_message", "params": {"content": "` + content + `"}}`))
+		require.NoError(t, err)
+		require.NoError(t, w.Flush())
+		frame := ws.NewTextFrame(buf.Bytes())
+		frame.Header.Rsv = ws.Rsv(true, false, false)
+		require.NoError(t, ws.WriteFrame(compressed, ws.MaskFrameInPlace(frame)))
+		assert.Equal(t, content, receiveCompressed("new_message").Params["content"])
+		assert.Equal(t, content, receive(t, plain, "new_message").Params["content"])
+
+		send(t, plain, `{"method": "get_me"}`)
+		receive(t, plain, "get_me")
+		require.NoError(t, wsutil.WriteClientText(compressed, []byte(`{"method": "get_playback"}`)))
+		receiveCompressed("get_playback")
+
+		// the extension is declined when compression is disabled
+		api.config.Compression = false
+		conn, _, hs, err = dialer.Dial(context.Background(), u)
+		require.NoError(t, err)
+		defer conn.Close()
+		assert.Empty(t, hs.Extensions)
+	})
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	forEachMode(t, func(t *testing.T, api *API) {
+		api.config.MaxMessageSize = 100
+		server := httptest.NewServer(api.echo)
+		defer server.Close()
+		roomID, err := api.storage.CreateTempRoom(&model.Room{Title: "Movie", VideoURL: "https://youtube.com"}, time.Hour)
+		require.NoError(t, err)
+
+		conn := dial(t, server, roomID, "Viewer")
+		defer conn.Close()
+		receive(t, conn, "welcome")
+		send(t, conn, `{"method": "new_message", "params": {"content": "`+strings.Repeat("a", 100)+`"}}`)
+		code, _ := receiveClose(t, conn)
+		assert.Equal(t, ws.StatusMessageTooBig, code)
+	})
+}
+
+func TestPlayback(t *testing.T) {
+	api := newTestAPI(t)
+	defer api.stop()
+	server := httptest.NewServer(api.echo)
+	defer server.Close()
+	roomID, err := api.storage.CreateTempRoom(&model.Room{Title: "Movie", VideoURL: "https://youtube.com"}, time.Hour)
+	require.NoError(t, err)
+
+	host := dial(t, server, roomID, "Host")
+	defer host.Close()
+	playback := receive(t, host, "welcome").Params["playback"].(map[string]interface{})
+	assert.Equal(t, false, playback["playing"])
+	assert.Equal(t, float64(0), playback["position"])
+
+	send(t, host, `{"method": "video_play", "params": {"position": 10, "rate": 2}}`)
+	msg := receive(t, host, "video_play")
+	assert.Equal(t, true, msg.Params["playing"])
+	assert.Equal(t, float64(10), msg.Params["position"])
+	assert.Equal(t, float64(2), msg.Params["rate"])
+
+	time.Sleep(100 * time.Millisecond)
+	late := dial(t, server, roomID, "Late")
+	defer late.Close()
+	playback = receive(t, late, "welcome").Params["playback"].(map[string]interface{})
+	assert.Equal(t, true, playback["playing"])
+	assert.Greater(t, playback["position"], 10.1)
+	assert.Equal(t, float64(2), playback["rate"])
+
+	send(t, late, `{"method": "video_pause", "params": {"position": 20}}`)
+	msg = receive(t, host, "video_pause")
+	assert.Equal(t, false, msg.Params["playing"])
+	assert.Equal(t, float64(20), msg.Params["position"])
+	assert.Equal(t, float64(2), msg.Params["rate"])
+
+	send(t, host, `{"method": "get_playback"}`)
+	msg = receive(t, host, "get_playback")
+	assert.Equal(t, false, msg.Params["playing"])
+	assert.Equal(t, float64(20), msg.Params["position"])
+
+	rec := api.request(http.MethodGet, "/room/"+roomID, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var room model.Room
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &room))
+	assert.Equal(t, float64(20), room.Playback.Position)
+	assert.False(t, room.Playback.Playing)
+}
+
+func TestEditRemoveMessage(t *testing.T) {
+	api := newTestAPI(t)
+	defer api.stop()
+	server := httptest.NewServer(api.echo)
+	defer server.Close()
+	roomID, err := api.storage.CreateTempRoom(&model.Room{Title: "Movie", VideoURL: "https://youtube.com", HostToken: "secret"}, time.Hour)
+	require.NoError(t, err)
+
+	host := dial(t, server, roomID, "Host", "host_token=secret")
+	defer host.Close()
+	author := dial(t, server, roomID, "Author")
+	defer author.Close()
+	other := dial(t, server, roomID, "Other")
+	defer other.Close()
+
+	postMessage := func(content string) string {
+		send(t, author, `{"method": "new_message", "params": {"content": "`+content+`"}}`)
+		msg := receive(t, author, "new_message")
+		receive(t, other, "new_message")
+		return msg.ID
+	}
+	first, second := postMessage("helo"), postMessage("spam")
+
+	expectError := func(conn net.Conn, request, code string) {
+		send(t, conn, request)
+		msg := receive(t, conn, "error")
+		assert.Equal(t, code, msg.Params["code"], request)
+	}
+	expectError(other, `{"method": "edit_message", "params": {"message_id": "`+first+`", "content": "hacked"}}`, websocket.ErrCodeForbidden)
+	expectError(host, `{"method": "edit_message", "params": {"message_id": "`+first+`", "content": "hacked"}}`, websocket.ErrCodeForbidden)
+	expectError(author, `{"method": "edit_message", "params": {"message_id": "unknown", "content": "hello"}}`, websocket.ErrCodeNotFound)
+	expectError(other, `{"method": "remove_message", "params": {"message_id": "`+second+`"}}`, websocket.ErrCodeForbidden)
+
+	send(t, author, `{"method": "edit_message", "params": {"message_id": "`+first+`", "content": "hello"}}`)
+	edited := receive(t, other, "edit_message")
+	assert.Equal(t, first, edited.Params["message_id"])
+	assert.Equal(t, "hello", edited.Params["content"])
+	assert.NotZero(t, edited.Params["edited_at"])
+
+	// the host removes any message
+	send(t, host, `{"method": "remove_message", "params": {"message_id": "`+second+`"}}`)
+	assert.Equal(t, second, receive(t, author, "remove_message").Params["message_id"])
+	expectError(author, `{"method": "remove_message", "params": {"message_id": "`+second+`"}}`, websocket.ErrCodeNotFound)
+
+	messages, err := api.storage.GetRoomMessages(roomID, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, messages, 1)
+	assert.Equal(t, "hello", messages[0].Content)
+	assert.Equal(t, []*model.MessageEdit{{Content: "helo", EditedAt: messages[0].EditedAt}}, messages[0].Edits)
+
+	// the author removes own message
+	send(t, author, `{"method": "remove_message", "params": {"message_id": "`+first+`"}}`)
+	assert.Equal(t, first, receive(t, author, "remove_message").Params["message_id"])
+	messages, err = api.storage.GetRoomMessages(roomID, 0, 10)
+	require.NoError(t, err)
+	assert.Empty(t, messages)
+}
+
+// Reads frames until the close one arrives, returns its status code and reason
+func receiveClose(t *testing.T, conn net.Conn) (ws.StatusCode, string) {
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	for {
+		frame, err := ws.ReadFrame(conn)
+		require.NoError(t, err)
+		if frame.Header.OpCode == ws.OpClose {
+			return ws.ParseCloseFrameData(frame.Payload)
+		}
+	}
+}
+
+func TestModeration(t *testing.T) {
+	forEachMode(t, func(t *testing.T, api *API) {
+		api.config.ResumeWindow = time.Minute
+		server := httptest.NewServer(api.echo)
+		defer server.Close()
+		roomID, err := api.storage.CreateTempRoom(&model.Room{Title: "Movie", VideoURL: "https://youtube.com", HostToken: "secret"}, time.Hour)
+		require.NoError(t, err)
+		hostRequest := func(method, target, body string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, "/room/"+roomID+target, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set(hostTokenHeader, "secret")
+			rec := httptest.NewRecorder()
+			api.echo.ServeHTTP(rec, req)
+			return rec
+		}
+		join := func(name string) (net.Conn, string, string) {
+			conn := dial(t, server, roomID, name)
+			welcome := receive(t, conn, "welcome")
+			return conn, welcome.Params["me"].(map[string]interface{})["id"].(string), welcome.Params["resume_token"].(string)
+		}
+
+		host := dial(t, server, roomID, "Host", "host_token=secret")
+		defer host.Close()
+		hostID := receive(t, host, "welcome").Params["me"].(map[string]interface{})["id"].(string)
+		alice, aliceID, aliceToken := join("Alice")
+		defer alice.Close()
+		bob, bobID, _ := join("Bob")
+		defer bob.Close()
+
+		expectError := func(conn net.Conn, request, code string) {
+			send(t, conn, request)
+			assert.Equal(t, code, receive(t, conn, "error").Params["code"], request)
+		}
+		expectError(alice, `{"method": "kick_member", "params": {"user_id": "`+bobID+`"}}`, websocket.ErrCodeForbidden)
+		expectError(host, `{"method": "kick_member", "params": {"user_id": "`+hostID+`"}}`, websocket.ErrCodeForbidden)
+		expectError(host, `{"method": "mute_member", "params": {"user_id": "unknown"}}`, websocket.ErrCodeNotFound)
+		expectError(host, `{"method": "unban_member", "params": {"user_id": "`+bobID+`"}}`, websocket.ErrCodeNotFound)
+
+		// muted members can not chat
+		send(t, host, `{"method": "mute_member", "params": {"user_id": "`+bobID+`"}}`)
+		assert.Equal(t, bobID, receive(t, bob, "mute_member").Params["user_id"])
+		expectError(bob, `{"method": "new_message", "params": {"content": "spam"}}`, websocket.ErrCodeForbidden)
+		require.Equal(t, http.StatusNoContent, hostRequest(http.MethodDelete, "/mutes/"+bobID, "").Code)
+		assert.Equal(t, bobID, receive(t, bob, "unmute_member").Params["user_id"])
+		send(t, bob, `{"method": "new_message", "params": {"content": "sorry"}}`)
+		receive(t, bob, "new_message")
+
+		// the kicked member is disconnected with the reason and leaves the room without waiting to resume
+		send(t, host, `{"method": "kick_member", "params": {"user_id": "`+aliceID+`", "reason": "spoilers"}}`)
+		code, reason := receiveClose(t, alice)
+		assert.Equal(t, ws.StatusPolicyViolation, code)
+		assert.Equal(t, "kicked by the host: spoilers", reason)
+		kick := receive(t, host, "kick_member")
+		assert.Equal(t, aliceID, kick.Params["user_id"])
+		assert.Equal(t, "spoilers", kick.Params["reason"])
+		assert.Equal(t, aliceID, receive(t, host, "logout_member").UserID)
+		// and may join again, but not resume
+		alice = dial(t, server, roomID, "Alice", "resume_token="+aliceToken)
+		defer alice.Close()
+		assert.Equal(t, false, receive(t, alice, "welcome").Params["resumed"])
+
+		// the banned member is recognized by the IP once disconnected
+		rec := hostRequest(http.MethodPost, "/bans", `{"user_id": "`+bobID+`", "reason": "rude"}`)
+		require.Equal(t, http.StatusNoContent, rec.Code, rec.Body.String())
+		_, reason = receiveClose(t, bob)
+		assert.Equal(t, "banned by the host: rude", reason)
+		assert.Equal(t, bobID, receive(t, host, "ban_member").Params["user_id"])
+		require.Eventually(t, func() bool {
+			bans, err := api.storage.GetRoomBans(roomID)
+			return err == nil && len(bans) == 1 && bans[0].IP != ""
+		}, time.Second, time.Millisecond)
+		rec = hostRequest(http.MethodGet, "/bans", "")
+		require.Equal(t, http.StatusOK, rec.Code)
+		var bans struct{ Bans []map[string]interface{} }
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &bans))
+		require.Len(t, bans.Bans, 1)
+		assert.Equal(t, "Bob", bans.Bans[0]["name"])
+		assert.NotContains(t, bans.Bans[0], "ip")
+		assert.NotContains(t, bans.Bans[0], "resume_token")
+
+		wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?room_id=" + roomID + "&username=Bob"
+		_, _, _, err = ws.Dial(context.Background(), wsURL)
+		assert.Equal(t, ws.StatusError(http.StatusForbidden), err)
+		// forwarding headers of the client are not trusted
+		spoofed := ws.Dialer{Header: ws.HandshakeHeaderHTTP(http.Header{
+			echo.HeaderXForwardedFor: []string{"203.0.113.7"},
+			echo.HeaderXRealIP:       []string{"203.0.113.7"},
+		})}
+		_, _, _, err = spoofed.Dial(context.Background(), wsURL)
+		assert.Equal(t, ws.StatusError(http.StatusForbidden), err)
+		// the host is never banned
+		other := dial(t, server, roomID, "Host", "host_token=secret")
+		defer other.Close()
+		receive(t, other, "welcome")
+
+		send(t, host, `{"method": "unban_member", "params": {"user_id": "`+bobID+`"}}`)
+		receive(t, host, "unban_member")
+		bob = dial(t, server, roomID, "Bob")
+		defer bob.Close()
+		receive(t, bob, "welcome")
+	})
+}
+
+func TestModerateSuspended(t *testing.T) {
+	api := newTestAPI(t)
+	api.config.ResumeWindow = time.Minute
+	defer api.stop()
+	server := httptest.NewServer(api.echo)
+	defer server.Close()
+	roomID, err := api.storage.CreateTempRoom(&model.Room{Title: "Movie", VideoURL: "https://youtube.com", HostToken: "secret"}, time.Hour)
+	require.NoError(t, err)
+
+	host := dial(t, server, roomID, "Host", "host_token=secret")
+	defer host.Close()
+	receive(t, host, "welcome")
+	suspend := func(name string) (string, string) {
+		conn := dial(t, server, roomID, name)
+		welcome := receive(t, conn, "welcome")
+		userID := welcome.Params["me"].(map[string]interface{})["id"].(string)
+		token := welcome.Params["resume_token"].(string)
+		for receive(t, host, "new_member").UserID != userID {
+		}
+		require.NoError(t, conn.Close())
+		require.Eventually(t, func() bool {
+			_, err := api.storage.GetSession(roomID, token)
+			return err == nil
+		}, time.Second, time.Millisecond)
+		return userID, token
+	}
+
+	// the member kicked during the resume window leaves the room right away and can not resume
+	aliceID, aliceToken := suspend("Alice")
+	send(t, host, `{"method": "kick_member", "params": {"user_id": "`+aliceID+`"}}`)
+	assert.Equal(t, aliceID, receive(t, host, "logout_member").UserID)
+	assert.Equal(t, aliceID, receive(t, host, "kick_member").Params["user_id"])
+	alice := dial(t, server, roomID, "Alice", "resume_token="+aliceToken)
+	defer alice.Close()
+	welcome := receive(t, alice, "welcome")
+	assert.Equal(t, false, welcome.Params["resumed"])
+	assert.NotEqual(t, aliceID, welcome.Params["me"].(map[string]interface{})["id"])
+	require.NoError(t, alice.Close())
+
+	// the banned one is banned by the IP of the session as well
+	bobID, bobToken := suspend("Bob")
+	send(t, host, `{"method": "ban_member", "params": {"user_id": "`+bobID+`"}}`)
+	assert.Equal(t, bobID, receive(t, host, "logout_member").UserID)
+	assert.Equal(t, bobID, receive(t, host, "ban_member").Params["user_id"])
+	bans, err := api.storage.GetRoomBans(roomID)
+	require.NoError(t, err)
+	require.Len(t, bans, 1)
+	assert.NotEmpty(t, bans[0].IP)
+	_, err = api.storage.GetSession(roomID, bobToken)
+	assert.Error(t, err)
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?room_id=" + roomID + "&username=Bob"
+	_, _, _, err = ws.Dial(context.Background(), wsURL)
+	assert.Equal(t, ws.StatusError(http.StatusForbidden), err)
+}
+
+func TestRejectedResumeKeepsSession(t *testing.T) {
+	api := newTestAPI(t)
+	api.config.ResumeWindow = 300 * time.Millisecond
+	defer api.stop()
+	server := httptest.NewServer(api.echo)
+	defer server.Close()
+	roomID, err := api.storage.CreateTempRoom(&model.Room{Title: "Movie", VideoURL: "https://youtube.com", HostToken: "secret"}, time.Hour)
+	require.NoError(t, err)
+
+	host := dial(t, server, roomID, "Host", "host_token=secret")
+	defer host.Close()
+	receive(t, host, "welcome")
+	viewer := dial(t, server, roomID, "Viewer")
+	welcome := receive(t, viewer, "welcome")
+	viewerID := welcome.Params["me"].(map[string]interface{})["id"].(string)
+	token := welcome.Params["resume_token"].(string)
+	receive(t, host, "new_member")
+	require.NoError(t, viewer.Close())
+
+	// a ban applies to the suspended member, banning it with the method would drop the session
+	require.Eventually(t, func() bool {
+		_, err := api.storage.GetSession(roomID, token)
+		return err == nil
+	}, time.Second, time.Millisecond)
+	require.NoError(t, api.storage.SaveRoomBan(roomID, &model.Ban{UserID: viewerID}))
+
+	// neither the banned resume nor the failed upgrade take the session
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?room_id=" + roomID + "&username=Viewer&resume_token=" + token
+	_, _, _, err = ws.Dial(context.Background(), wsURL)
+	assert.Equal(t, ws.StatusError(http.StatusForbidden), err)
+	require.NoError(t, api.storage.RemoveRoomBan(roomID, viewerID))
+	resp, err := http.Get(server.URL + "/ws?room_id=" + roomID + "&username=Viewer&resume_token=" + token)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	_, err = api.storage.GetSession(roomID, token)
+	assert.NoError(t, err)
+
+	// so the member leaves the room once the resume window ends
+	assert.Equal(t, viewerID, receive(t, host, "logout_member").UserID)
+}
+
+func TestIPExtractor(t *testing.T) {
+	request := func(remoteAddr, xff string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+		req.RemoteAddr = remoteAddr
+		if xff != "" {
+			req.Header.Set(echo.HeaderXForwardedFor, xff)
+		}
+		req.Header.Set(echo.HeaderXRealIP, "203.0.113.9")
+		return req
+	}
+
+	direct := ipExtractor(nil)
+	assert.Equal(t, "10.0.0.1", direct(request("10.0.0.1:1234", "203.0.113.7")))
+
+	proxied := ipExtractor([]string{"10.0.0.0/24"})
+	assert.Equal(t, "203.0.113.7", proxied(request("10.0.0.1:1234", "203.0.113.7")))
+	// the addresses the client put before the proxy are not trusted
+	assert.Equal(t, "198.51.100.1", proxied(request("10.0.0.1:1234", "203.0.113.7, 198.51.100.1")))
+	// neither are requests bypassing the proxy, private networks included
+	assert.Equal(t, "10.0.1.1", proxied(request("10.0.1.1:1234", "203.0.113.7")))
+	assert.Equal(t, "127.0.0.1", proxied(request("127.0.0.1:1234", "203.0.113.7")))
+}
+
+func TestModerationEndpoints(t *testing.T) {
+	api := newTestAPI(t)
+	defer api.stop()
+	roomID, err := api.storage.CreateTempRoom(&model.Room{Title: "Movie", VideoURL: "https://youtube.com", HostToken: "secret"}, time.Hour)
+	require.NoError(t, err)
+	require.NoError(t, api.storage.AddUserToRoom(roomID, &model.User{ID: "user", Name: "User"}))
+	request := func(method, target, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(hostTokenHeader, token)
+		rec := httptest.NewRecorder()
+		api.echo.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusNotFound, request(http.MethodPost, "/room/unknown/kick", "secret", `{"user_id": "user"}`).Code)
+	assert.Equal(t, http.StatusForbidden, request(http.MethodPost, "/room/"+roomID+"/kick", "wrong", `{"user_id": "user"}`).Code)
+	assert.Equal(t, http.StatusForbidden, request(http.MethodGet, "/room/"+roomID+"/bans", "", "").Code)
+	rec := request(http.MethodPost, "/room/"+roomID+"/kick", "secret", `{"user": "user"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	assert.Contains(t, rec.Body.String(), "param 'user' is unknown")
+	assert.Equal(t, http.StatusNotFound, request(http.MethodPost, "/room/"+roomID+"/mutes", "secret", `{"user_id": "unknown"}`).Code)
+	assert.Equal(t, http.StatusNotFound, request(http.MethodDelete, "/room/"+roomID+"/bans/user", "secret", "").Code)
+
+	require.Equal(t, http.StatusNoContent, request(http.MethodPost, "/room/"+roomID+"/mutes", "secret", `{"user_id": "user"}`).Code)
+	muted, err := api.storage.IsMemberMuted(roomID, "user")
+	require.NoError(t, err)
+	assert.True(t, muted)
+	require.Equal(t, http.StatusNoContent, request(http.MethodPost, "/room/"+roomID+"/bans", "secret", `{"user_id": "user"}`).Code)
+	require.Equal(t, http.StatusNoContent, request(http.MethodDelete, "/room/"+roomID+"/bans/user", "secret", "").Code)
+	bans, err := api.storage.GetRoomBans(roomID)
+	require.NoError(t, err)
+	assert.Empty(t, bans)
+}
+
+func TestRateLimit(t *testing.T) {
+	forEachMode(t, func(t *testing.T, api *API) {
+		api.config.RateLimitStrikes = ratelimit.Limit{Events: 3, Per: time.Hour}
+		api.rateLimits[rateChat] = rateLimits{user: ratelimit.Limit{Events: 2, Per: time.Hour}, room: ratelimit.Limit{Events: 3, Per: time.Hour}}
+		api.rateLimits[rateQuery] = rateLimits{user: ratelimit.Limit{Events: 1, Per: time.Hour}}
+		server := httptest.NewServer(api.echo)
+		defer server.Close()
+		roomID, err := api.storage.CreateTempRoom(&model.Room{Title: "Movie", VideoURL: "https://youtube.com"}, time.Hour)
+		require.NoError(t, err)
+
+		alice := dial(t, server, roomID, "Alice")
+		defer alice.Close()
+		bob := dial(t, server, roomID, "Bob")
+		defer bob.Close()
+		expectError := func(conn net.Conn, request, message string) {
+			send(t, conn, request)
+			msg := receive(t, conn, "error")
+			assert.Equal(t, websocket.ErrCodeRateLimited, msg.Params["code"], request)
+			assert.Equal(t, message, msg.Params["message"], request)
+		}
+
+		for i := 0; i < 2; i++ {
+			send(t, alice, `{"method": "new_message", "params": {"content": "hi"}}`)
+			receive(t, alice, "new_message")
+		}
+		expectError(alice, `{"method": "new_message", "params": {"content": "hi"}}`, "too many chat requests, slow down")
+		// classes are limited separately
+		send(t, alice, `{"method": "get_me"}`)
+		receive(t, alice, "get_me")
+		expectError(alice, `{"method": "get_playback"}`, "too many query requests, slow down")
+
+		// the room is limited as a whole
+		send(t, bob, `{"method": "new_message", "params": {"content": "hi"}}`)
+		receive(t, bob, "new_message")
+		expectError(bob, `{"method": "new_message", "params": {"content": "hi"}}`, "too many chat requests in the room, try again later")
+
+		// repeat offenders are disconnected right after the error reply
+		expectError(alice, `{"method": "new_message", "params": {"content": "hi"}}`, "too many chat requests, slow down")
+		expectError(alice, `{"method": "new_message", "params": {"content": "hi"}}`, "too many chat requests, slow down")
+		code, reason := receiveClose(t, alice)
+		assert.Equal(t, ws.StatusPolicyViolation, code)
+		assert.Equal(t, "too many requests", reason)
+		assert.Equal(t, uint64(4), api.methodStats["new_message"].Errors())
+	})
+}
+
+func TestInvalidRequestsLimited(t *testing.T) {
+	forEachMode(t, func(t *testing.T, api *API) {
+		api.config.RateLimitStrikes = ratelimit.Limit{Events: 3, Per: time.Hour}
+		api.rateLimits[rateQuery] = rateLimits{user: ratelimit.Limit{Events: 2, Per: time.Hour}}
+		server := httptest.NewServer(api.echo)
+		defer server.Close()
+		roomID, err := api.storage.CreateTempRoom(&model.Room{Title: "Movie", VideoURL: "https://youtube.com"}, time.Hour)
+		require.NoError(t, err)
+
+		conn := dial(t, server, roomID, "Flooder")
+		defer conn.Close()
+		receive(t, conn, "welcome")
+		expectError := func(request, code string) {
+			send(t, conn, request)
+			assert.Equal(t, code, receive(t, conn, "error").Params["code"], request)
+		}
+
+		// malformed requests and unknown methods take query tokens and every one is a strike
+		expectError(`{"method": "unknown"}`, websocket.ErrCodeUnknownMethod)
+		expectError(`{"method": "get_me", "params": []}`, websocket.ErrCodeBadRequest)
+		expectError(`not json`, websocket.ErrCodeRateLimited)
+		expectError(`{"method": "unknown"}`, websocket.ErrCodeRateLimited)
+		code, reason := receiveClose(t, conn)
+		assert.Equal(t, ws.StatusPolicyViolation, code)
+		assert.Equal(t, "too many requests", reason)
+	})
+}
+
+func TestChatFilters(t *testing.T) {
+	api := newTestAPI(t)
+	api.config.MaxMessageLength = 10
+	api.config.DuplicateMessageWindow = time.Minute
+	defer api.stop()
+	server := httptest.NewServer(api.echo)
+	defer server.Close()
+	roomID, err := api.storage.CreateTempRoom(&model.Room{Title: "Movie", VideoURL: "https://youtube.com", HostToken: "secret"}, time.Hour)
+	require.NoError(t, err)
+
+	host := dial(t, server, roomID, "Host", "host_token=secret")
+	defer host.Close()
+	viewer := dial(t, server, roomID, "Viewer")
+	defer viewer.Close()
+	expectError := func(conn net.Conn, request, code, message string) {
+		send(t, conn, request)
+		msg := receive(t, conn, "error")
+		assert.Equal(t, code, msg.Params["code"], request)
+		assert.Equal(t, message, msg.Params["message"], request)
+	}
+	post := func(conn net.Conn, content string) string {
+		send(t, conn, `{"method": "new_message", "params": {"content": "`+content+`"}}`)
+		return receive(t, conn, "new_message").ID
+	}
+
+	expectError(viewer, `{"method": "new_message", "params": {"content": "way too long"}}`, websocket.ErrCodeInvalidParams,
+		"invalid 'new_message' request, param 'content' must be at most 10 characters long")
+	first := post(viewer, "Hi  there")
+	expectError(viewer, `{"method": "new_message", "params": {"content": "hi there"}}`, websocket.ErrCodeDuplicateMessage,
+		"the message repeats the previous one")
+	post(viewer, "hi again")
+	expectError(viewer, `{"method": "update_chat_settings", "params": {"slow_mode": 30}}`, websocket.ErrCodeForbidden,
+		"method 'update_chat_settings' is allowed to the host only")
+
+	send(t, host, `{"method": "update_chat_settings", "params": {"slow_mode": 30, "link_policy": "host"}}`)
+	settings := receive(t, viewer, "update_chat_settings").Params
+	assert.Equal(t, float64(30), settings["slow_mode"])
+	assert.Equal(t, model.PolicyHost, settings["link_policy"])
+	expectError(viewer, `{"method": "new_message", "params": {"content": "slow"}}`, websocket.ErrCodeRateLimited,
+		"slow mode is on, wait 30 seconds before the next message")
+	expectError(viewer, `{"method": "edit_message", "params": {"message_id": "`+first+`", "content": "a.com"}}`, websocket.ErrCodeForbidden,
+		"links are allowed to the host and co-hosts only")
+	// the host is not filtered
+	post(host, "b.com")
+	post(host, "fast")
+
+	// settings are changed one by one and the room knows them
+	send(t, host, `{"method": "update_chat_settings", "params": {"slow_mode": 0}}`)
+	settings = receive(t, viewer, "update_chat_settings").Params
+	assert.Equal(t, float64(0), settings["slow_mode"])
+	assert.Equal(t, model.PolicyHost, settings["link_policy"])
+	post(viewer, "no wait")
+	rec := api.request(http.MethodGet, "/room/"+roomID, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"chat":{"slow_mode":0,"link_policy":"host"}`)
+}
+
+func TestChatFilterExemption(t *testing.T) {
+	api := newTestAPI(t)
+	api.config.MaxMessageLength = 10
+	api.config.DuplicateMessageWindow = time.Minute
+	defer api.stop()
+	now := time.Now()
+
+	filters := []struct {
+		name     string
+		settings model.ChatSettings
+		method   string
+		content  string
+		code     string
+	}{
+		{"slow mode", model.ChatSettings{SlowMode: 30, LinkPolicy: model.PolicyEveryone}, "new_message", "other", websocket.ErrCodeRateLimited},
+		{"link", model.ChatSettings{LinkPolicy: model.PolicyHost}, "new_message", "a.com", websocket.ErrCodeForbidden},
+		{"edited link", model.ChatSettings{LinkPolicy: model.PolicyHost}, "edit_message", "a.com", websocket.ErrCodeForbidden},
+		{"duplicate", model.ChatSettings{LinkPolicy: model.PolicyEveryone}, "new_message", "hi", websocket.ErrCodeDuplicateMessage},
+		{"max length", model.ChatSettings{LinkPolicy: model.PolicyEveryone}, "new_message", "way too long", websocket.ErrCodeInvalidParams},
+	}
+	for _, f := range filters {
+		for _, role := range []string{model.RoleMember, model.RoleCohost, model.RoleHost} {
+			t.Run(f.name+"/"+role, func(t *testing.T) {
+				roomID, err := api.storage.CreateTempRoom(&model.Room{Title: "Movie", VideoURL: "https://youtube.com"}, time.Hour)
+				require.NoError(t, err)
+				require.NoError(t, api.storage.UpdateChatSettings(roomID, &f.settings))
+				u := &model.User{ID: "user", RoomID: roomID, Role: model.RoleMember}
+				require.NoError(t, api.storage.AddUserToRoom(roomID, u))
+				// the role is changed after the connection cached it
+				require.NoError(t, api.storage.SetMemberRole(roomID, u.ID, role))
+				last := &model.LastMessage{Digest: messageDigest("hi"), CreatedAt: utils.UnixMilli(now) - 1000}
+				require.NoError(t, api.storage.SaveLastMessage(roomID, u.ID, last))
+
+				err = api.filterMessage(u, f.method, f.content, now)
+				if role == model.RoleMember || f.code == websocket.ErrCodeInvalidParams {
+					require.Error(t, err)
+					assert.Equal(t, f.code, err.(*websocket.Error).Code)
+				} else {
+					assert.NoError(t, err, "privileged members are not filtered")
+				}
+			})
+		}
+	}
+}
+
+func TestHostPermissions(t *testing.T) {
+	api := newTestAPI(t)
+	defer api.stop()
+	server := httptest.NewServer(api.echo)
+	defer server.Close()
+
+	rec := api.request(http.MethodPost, "/room", `{"title": "Movie", "video_url": "https://youtube.com", "control_policy": "host"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var room model.Room
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &room))
+	require.NotEmpty(t, room.HostToken)
+
+	rec = api.request(http.MethodGet, "/room/"+room.ID, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.NotContains(t, rec.Body.String(), room.HostToken)
+	assert.Contains(t, rec.Body.String(), `"control_policy":"host"`)
+
+	rec = api.request(http.MethodGet, "/ws?room_id="+room.ID+"&username=Host&host_token=wrong", "")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	host := dial(t, server, room.ID, "Host", "host_token="+room.HostToken)
+	defer host.Close()
+	send(t, host, `{"method": "get_me"}`)
+	me := receive(t, host, "get_me")
+	assert.Equal(t, model.RoleHost, me.Params["role"])
+
+	viewer := dial(t, server, room.ID, "Viewer")
+	defer viewer.Close()
+	send(t, viewer, `{"method": "get_me"}`)
+	viewerID := receive(t, viewer, "get_me").Params["id"].(string)
+
+	send(t, viewer, `{"method": "video_play", "params": {"position": 1}}`)
+	msg := receive(t, viewer, "error")
+	assert.Equal(t, "video_play", msg.Params["method"])
+	assert.Equal(t, websocket.ErrCodeForbidden, msg.Params["code"])
+	send(t, viewer, `{"method": "grant_cohost", "params": {"user_id": "`+viewerID+`"}}`)
+	msg = receive(t, viewer, "error")
+	assert.Equal(t, "grant_cohost", msg.Params["method"])
+
+	send(t, host, `{"method": "grant_cohost", "params": {"user_id": "`+viewerID+`"}}`)
+	msg = receive(t, viewer, "grant_cohost")
+	assert.Equal(t, model.RoleCohost, msg.Params["role"])
+	send(t, viewer, `{"method": "video_play", "params": {"position": 1}}`)
+	receive(t, host, "video_play")
+
+	send(t, host, `{"method": "revoke_cohost", "params": {"user_id": "`+viewerID+`"}}`)
+	receive(t, viewer, "revoke_cohost")
+	send(t, viewer, `{"method": "video_pause", "params": {"position": 2}}`)
+	receive(t, viewer, "error")
+
+	send(t, host, `{"method": "set_control_policy", "params": {"policy": "everyone"}}`)
+	receive(t, viewer, "set_control_policy")
+	send(t, viewer, `{"method": "video_pause", "params": {"position": 2}}`)
+	receive(t, host, "video_pause")
+}
+
+func TestErrorReplies(t *testing.T) {
+	forEachMode(t, func(t *testing.T, api *API) {
+		server := httptest.NewServer(api.echo)
+		defer server.Close()
+		roomID, err := api.storage.CreateTempRoom(&model.Room{Title: "Movie", VideoURL: "https://youtube.com"}, 300*time.Millisecond)
+		require.NoError(t, err)
+
+		conn := dial(t, server, roomID, "Cheburek")
+		defer conn.Close()
+
+		cases := []struct {
+			request, requestID, method, code string
+		}{
+			{`{"request_id": "1", "method": "new_message", "params": {"content": ""}}`, "1", "new_message", websocket.ErrCodeInvalidParams},
+			{`{"request_id": "2", "method": "drop_room"}`, "2", "drop_room", websocket.ErrCodeUnknownMethod},
+			{`{"request_id": "3", "method": "get_me", "params": []}`, "3", "get_me", websocket.ErrCodeBadRequest},
+			{`not a json`, "", "", websocket.ErrCodeBadRequest},
+			{`{"request_id": "4", "method": "grant_cohost", "params": {"user_id": "x"}}`, "4", "grant_cohost", websocket.ErrCodeForbidden},
+		}
+		for _, c := range cases {
+			send(t, conn, c.request)
+			msg := receive(t, conn, "error")
+			assert.Equal(t, c.requestID, msg.RequestID, c.request)
+			assert.Equal(t, c.method, msg.Params["method"], c.request)
+			assert.Equal(t, c.code, msg.Params["code"], c.request)
+			assert.NotEmpty(t, msg.Params["message"], c.request)
+		}
+
+		// storage failure, the room has expired
+		time.Sleep(300 * time.Millisecond)
+		send(t, conn, `{"request_id": "5", "method": "get_members"}`)
+		msg := receive(t, conn, "error")
+		assert.Equal(t, "5", msg.RequestID)
+		assert.Equal(t, websocket.ErrCodeInternal, msg.Params["code"])
+	})
+}
+
+func TestRequestCorrelation(t *testing.T) {
+	forEachMode(t, func(t *testing.T, api *API) {
+		server := httptest.NewServer(api.echo)
+		defer server.Close()
+		roomID, err := api.storage.CreateTempRoom(&model.Room{Title: "Movie", VideoURL: "https://youtube.com"}, time.Hour)
+		require.NoError(t, err)
+
+		conn := dial(t, server, roomID, "Cheburek")
+		defer conn.Close()
+
+		// requests are sent at once, replies are matched by request ID
+		expected := map[string]string{
+			"me":      "get_me",
+			"members": "get_members",
+			"history": "get_history",
+			"play":    "video_play",
+			"chat":    "new_message",
+			"invalid": "error",
+		}
+		send(t, conn, `{"request_id": "me", "method": "get_me"}`)
+		send(t, conn, `{"request_id": "members", "method": "get_members"}`)
+		send(t, conn, `{"request_id": "history", "method": "get_history"}`)
+		send(t, conn, `{"request_id": "play", "method": "video_play", "params": {"position": 3}}`)
+		send(t, conn, `{"request_id": "chat", "method": "new_message", "params": {"content": "hi"}}`)
+		send(t, conn, `{"request_id": "invalid", "method": "rename_member", "params": {"name": ""}}`)
+
+		got := make(map[string]string)
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+		for len(got) < len(expected) {
+			b, err := wsutil.ReadServerText(conn)
+			require.NoError(t, err)
+			msg := &message{}
+			require.NoError(t, json.Unmarshal(b, msg))
+			if msg.RequestID == "" {
+				// server initiated messages
+				assert.Contains(t, []string{"new_member", "welcome"}, msg.Method)
+				continue
+			}
+			got[msg.RequestID] = msg.Method
+		}
+		assert.Equal(t, expected, got)
+	})
+}
+
+func TestGhostMembersReaped(t *testing.T) {
+	forEachMode(t, func(t *testing.T, api *API) {
+		api.pinger = wsconn.NewPinger(20*time.Millisecond, 10*time.Millisecond, time.Second)
+		server := httptest.NewServer(api.echo)
+		defer server.Close()
+		roomID, err := api.storage.CreateTempRoom(&model.Room{Title: "Movie", VideoURL: "https://youtube.com"}, time.Hour)
+		require.NoError(t, err)
+
+		// the ghost never reads, so it never answers pings
+		ghost := dial(t, server, roomID, "Ghost")
+		defer ghost.Close()
+		// reading answers pings
+		conn := dial(t, server, roomID, "Cheburek")
+		defer conn.Close()
+		me := receive(t, conn, "new_member")
+
+		logout := receive(t, conn, "logout_member")
+		assert.NotEqual(t, me.UserID, logout.UserID)
+
+		room, err := api.storage.GetTempRoom(roomID)
+		require.NoError(t, err)
+		require.Len(t, room.Members, 1)
+		assert.Equal(t, me.UserID, room.Members[0].ID)
+		assert.Equal(t, uint64(1), api.connMetrics.PongTimeouts())
+	})
+}
+
+func TestDeadNodeMembersReaped(t *testing.T) {
+	api := newTestAPI(t)
+	defer api.stop()
+	api.config.NodeLease = time.Minute
+	server := httptest.NewServer(api.echo)
+	defer server.Close()
+	roomID, err := api.storage.CreateTempRoom(&model.Room{Title: "Movie", VideoURL: "https://youtube.com"}, time.Hour)
+	require.NoError(t, err)
+
+	// member of another instance which stops heartbeating
+	require.NoError(t, api.storage.HeartbeatNode("crashed", 10*time.Millisecond))
+	require.NoError(t, api.storage.AddUserToRoom(roomID, &model.User{ID: "ghost", RoomID: roomID, NodeID: "crashed"}))
+
+	conn := dial(t, server, roomID, "Cheburek")
+	defer conn.Close()
+	me := receive(t, conn, "new_member")
+
+	time.Sleep(20 * time.Millisecond)
+	api.beat()
+	logout := receive(t, conn, "logout_member")
+	assert.Equal(t, "ghost", logout.UserID)
+
+	room, err := api.storage.GetTempRoom(roomID)
+	require.NoError(t, err)
+	require.Len(t, room.Members, 1)
+	assert.Equal(t, me.UserID, room.Members[0].ID)
+
+	// members of the alive instance are kept
+	time.Sleep(20 * time.Millisecond)
+	api.beat()
+	room, err = api.storage.GetTempRoom(roomID)
+	require.NoError(t, err)
+	assert.Len(t, room.Members, 1)
+}
+
+// discardConn is a connection of the client reading everything instantly
+type discardConn struct {
+	net.Conn
+}
+
+func (discardConn) Write(p []byte) (int, error)        { return len(p), nil }
+func (discardConn) SetWriteDeadline(_ time.Time) error { return nil }
+func (discardConn) Close() error                       { return nil }
+
+// Measures the fan-out of a room broadcast to the subscribers of the node,
+// "per-subscriber" frames the payload for every subscriber the way it was done before,
+// "pre-encoded" builds the frame once
+func BenchmarkBroadcast(b *testing.B) {
+	payload := []byte(`{"id":"abcde","user_id":"roomIDabcde","method":"new_message","params":{"content":"Hello everyone, the movie starts in five minutes!","created_at":1589000000000,"seq":42}}`)
+	for _, n := range []int{10, 100, 1000} {
+		api := newTestAPI(b)
+		for i := 0; i < n; i++ {
+			conn := wsconn.New(discardConn{}, wsconn.Options{QueueSize: 1024, Policy: wsconn.PolicyDropOldest})
+			api.channels.Subscribe(&model.User{ID: strconv.Itoa(i), RoomID: "room", Conn: conn}, "room")
+		}
+
+		b.Run(fmt.Sprintf("per-subscriber/%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				for _, u := range api.channels.GetSubscribers("room") {
+					_ = u.Conn.SendText(payload)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("pre-encoded/%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				api.broadcast("room", payload)
+			}
+		})
+
+		for _, u := range api.channels.GetSubscribers("room") {
+			_ = u.Conn.Close()
+		}
+		api.stop()
+	}
+}
+
+// Clients stalling in the middle of a frame must not hold the workers reading the other connections
+func TestNetpollStalledClients(t *testing.T) {
+	api := newTestAPI(t)
+	defer api.stop()
+	poller, err := netpoll.New()
+	if err == netpoll.ErrNotSupported {
+		t.Skip(err)
+	}
+	require.NoError(t, err)
+	api.poller = poller
+	api.config.NetpollReadTimeout = 100 * time.Millisecond
+	server := httptest.NewServer(api.echo)
+	defer server.Close()
+	roomID, err := api.storage.CreateTempRoom(&model.Room{Title: "Movie", VideoURL: "https://youtube.com"}, time.Hour)
+	require.NoError(t, err)
+
+	viewer := dial(t, server, roomID, "Viewer")
+	defer viewer.Close()
+	receive(t, viewer, "welcome")
+
+	// as many clients as workers stall in the middle of a frame header
+	stalled := make([]net.Conn, api.config.MaxWorkers)
+	for i := range stalled {
+		stalled[i] = dial(t, server, roomID, "Stalled")
+		defer stalled[i].Close()
+		receive(t, stalled[i], "welcome")
+		_, err = stalled[i].Write([]byte{0x81})
+		require.NoError(t, err)
+	}
+
+	send(t, viewer, `{"method": "new_message", "params": {"content": "hello"}}`)
+	receive(t, viewer, "new_message")
+	for _, conn := range stalled {
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+		for {
+			if _, err = wsutil.ReadServerText(conn); err != nil {
+				break
+			}
+		}
+		netErr, ok := err.(net.Error)
+		assert.False(t, ok && netErr.Timeout(), "stalled client is not disconnected")
+	}
+}
+
+// Load test reporting memory and goroutines per idle websocket connection in every connection handling mode,
+// the client side of the connections lives in the same process and is included. It runs only if
+// LOAD_TEST_CONNECTIONS sets the number of connections, run with -v to see the report
+func TestMemoryPerConnection(t *testing.T) {
+	connections := os.Getenv("LOAD_TEST_CONNECTIONS")
+	if connections == "" || testing.Short() {
+		t.Skip("load test, set LOAD_TEST_CONNECTIONS to run")
+	}
+	n := utils.ParseInt(connections, 1000, 1, 100000)
+
+	forEachMode(t, func(t *testing.T, api *API) {
+		server := httptest.NewServer(api.echo)
+		defer server.Close()
+		// a room per connection, so the report is not skewed by the greetings fan-out
+		rooms := make([]string, n)
+		for i := range rooms {
+			var err error
+			rooms[i], err = api.storage.CreateTempRoom(&model.Room{Title: "Movie", VideoURL: "https://youtube.com"}, time.Hour)
+			require.NoError(t, err)
+		}
+
+		// let the goroutines of the previous tests exit
+		for prev := -1; prev != runtime.NumGoroutine(); time.Sleep(100 * time.Millisecond) {
+			prev = runtime.NumGoroutine()
+		}
+		var before, after runtime.MemStats
+		// objects with finalizers, like the closed sockets, are freed by the second run
+		runtime.GC()
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		goroutinesBefore := runtime.NumGoroutine()
+
+		conns := make([]net.Conn, n)
+		for i := range conns {
+			conns[i] = dial(t, server, rooms[i], "Viewer")
+		}
+		defer func() {
+			for _, c := range conns {
+				_ = c.Close()
+			}
+			// release the connections before the next mode is measured
+			for _, roomID := range rooms {
+				assert.Eventually(t, func() bool {
+					return len(api.channels.GetSubscribers(roomID)) == 0
+				}, time.Second, time.Millisecond)
+			}
+		}()
+		for _, roomID := range rooms {
+			require.Eventually(t, func() bool {
+				return len(api.channels.GetSubscribers(roomID)) == 1
+			}, time.Second, time.Millisecond)
+		}
+		// let the writers deliver the greetings and stop
+		time.Sleep(100 * time.Millisecond)
+
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		goroutines := float64(runtime.NumGoroutine()-goroutinesBefore) / float64(n)
+		memory := float64(int64(after.HeapAlloc+after.StackInuse)-int64(before.HeapAlloc+before.StackInuse)) / float64(n)
+		t.Logf("%d connections: %.0f bytes and %.2f goroutines per connection", n, memory, goroutines)
+
+		if api.poller != nil {
+			assert.True(t, goroutines < 0.1, "idle connections must not hold goroutines")
+		}
+	})
+}
@@ -0,0 +1,616 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/labstack/gommon/log"
+	"reflect"
+	"smotri.me/model"
+	"smotri.me/pkg/jsonschema"
+	"smotri.me/pkg/utils"
+	"smotri.me/pkg/websocket"
+	"smotri.me/storage"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Who is allowed to call a method
+const (
+	// Every member
+	accessAny = iota
+	// Everyone or host and co-hosts depending on the room control policy
+	accessControl
+	// The host only
+	accessHost
+)
+
+// unknownMethod is the stats key of the requests with unregistered methods
+const unknownMethod = "unknown"
+
+type (
+	// method is the websocket method declaration, adding a method takes a single entry in methods
+	method struct {
+		// params is the zero value of the params type, the request params are strictly decoded into a new one,
+		// websocket.NoParams if nil
+		params interface{}
+		access int
+		// response methods reply to the caller only, the others are broadcast to the room
+		response bool
+		// chat methods are rejected for the members muted by the host and are rate limited as chat,
+		// response methods are rate limited as queries and the others as control
+		chat bool
+		// handle applies the request with the decoded params and sets the params of the reply or broadcast,
+		// the request is broadcast as is if it is nil
+		handle func(api *API, u *model.User, msg *websocket.Message, params interface{}) error
+		// reply is the zero value of the params type of the reply or broadcast, the params type if nil
+		reply interface{}
+	}
+
+	// request is the client message with the params kept raw until they are decoded by the method
+	request struct {
+		websocket.Message
+		Params json.RawMessage `json:"params"`
+	}
+
+	// methodStats counts requests of a method, safe for concurrent use
+	methodStats struct {
+		calls  uint64
+		errors uint64
+	}
+)
+
+var methods = map[string]*method{
+	"new_message": {
+		params: websocket.NewMessageParams{},
+		chat:   true,
+		handle: (*API).newMessage,
+		reply:  websocket.PostedMessage{},
+	},
+	"edit_message": {
+		params: websocket.EditMessageParams{},
+		chat:   true,
+		handle: (*API).editMessage,
+		reply:  websocket.EditedMessage{},
+	},
+	"remove_message": {
+		params: websocket.RemoveMessageParams{},
+		handle: (*API).removeMessage,
+	},
+	"rename_member": {
+		params: websocket.RenameMemberParams{},
+		handle: (*API).renameMember,
+	},
+	"update_room": {
+		params: websocket.UpdateRoomParams{},
+		access: accessControl,
+		handle: (*API).updateRoom,
+	},
+	"grant_cohost": {
+		params: websocket.MemberParams{},
+		access: accessHost,
+		handle: (*API).setCohost,
+		reply:  websocket.RoleChange{},
+	},
+	"revoke_cohost": {
+		params: websocket.MemberParams{},
+		access: accessHost,
+		handle: (*API).setCohost,
+		reply:  websocket.RoleChange{},
+	},
+	"update_chat_settings": {
+		params: websocket.ChatSettingsParams{},
+		access: accessHost,
+		handle: (*API).updateChatSettings,
+		reply:  model.ChatSettings{},
+	},
+	"set_control_policy": {
+		params: websocket.ControlPolicyParams{},
+		access: accessHost,
+		handle: (*API).setControlPolicy,
+	},
+	"kick_member": {
+		params: websocket.ModerationParams{},
+		access: accessHost,
+		handle: (*API).moderate,
+	},
+	"ban_member": {
+		params: websocket.ModerationParams{},
+		access: accessHost,
+		handle: (*API).moderate,
+	},
+	"unban_member": {
+		params: websocket.MemberParams{},
+		access: accessHost,
+		handle: (*API).moderate,
+	},
+	"mute_member": {
+		params: websocket.ModerationParams{},
+		access: accessHost,
+		handle: (*API).moderate,
+	},
+	"unmute_member": {
+		params: websocket.MemberParams{},
+		access: accessHost,
+		handle: (*API).moderate,
+	},
+	"get_me": {
+		response: true,
+		handle:   (*API).getMe,
+		reply:    websocket.MemberInfo{},
+	},
+	"get_members": {
+		response: true,
+		handle:   (*API).getMembers,
+		reply:    websocket.MemberList{},
+	},
+	"video_play": {
+		params: websocket.PlaybackParams{},
+		access: accessControl,
+		handle: (*API).controlPlayback,
+		reply:  model.Playback{},
+	},
+	"video_pause": {
+		params: websocket.PlaybackParams{},
+		access: accessControl,
+		handle: (*API).controlPlayback,
+		reply:  model.Playback{},
+	},
+	"video_sync": {
+		params: websocket.SyncParams{},
+		access: accessControl,
+		handle: (*API).controlPlayback,
+		reply:  model.Playback{},
+	},
+	"get_playback": {
+		response: true,
+		handle:   (*API).getPlayback,
+		reply:    model.Playback{},
+	},
+	"get_history": {
+		params:   websocket.HistoryParams{},
+		response: true,
+		handle:   (*API).getHistoryPage,
+		reply:    websocket.HistoryPage{},
+	},
+	"resync": {
+		params:   websocket.ResyncParams{},
+		response: true,
+		handle:   (*API).resyncRoom,
+		reply:    websocket.ResyncResult{},
+	},
+}
+
+// serverMessages are the messages initiated by the server with the zero value of their params type
+var serverMessages = map[string]interface{}{
+	"welcome":       websocket.WelcomeParams{},
+	"error":         websocket.ErrorParams{},
+	"new_member":    websocket.MemberInfo{},
+	"logout_member": websocket.NoParams{},
+}
+
+// Returns stats for every registered method and for the unknown ones
+func newMethodStats() map[string]*methodStats {
+	stats := make(map[string]*methodStats, len(methods)+1)
+	for name := range methods {
+		stats[name] = &methodStats{}
+	}
+	stats[unknownMethod] = &methodStats{}
+	return stats
+}
+
+func (s *methodStats) Calls() uint64 {
+	return atomic.LoadUint64(&s.calls)
+}
+
+func (s *methodStats) Errors() uint64 {
+	return atomic.LoadUint64(&s.errors)
+}
+
+// Returns the JSON Schema of the websocket protocol: the envelopes of the client requests and of the server messages,
+// with the params of every method and server message in the definitions
+func protocolSchema() *jsonschema.Schema {
+	names := make([]string, 0, len(methods))
+	for name := range methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	serverNames := make([]string, 0, len(methods)+len(serverMessages))
+	serverNames = append(serverNames, names...)
+	for name := range serverMessages {
+		serverNames = append(serverNames, name)
+	}
+	sort.Strings(serverNames)
+
+	maxRequestID := websocket.MaxRequestIDLength
+	request := &jsonschema.Schema{
+		Description: "Message sent by the client",
+		Type:        "object",
+		Properties: map[string]*jsonschema.Schema{
+			"request_id": {Type: "string", MaxLength: &maxRequestID, Description: "Echoed in the response and error caused by the request, and in the broadcast copy sent to the requester only"},
+			"method":     {Type: "string", Enum: make([]interface{}, 0, len(names))},
+			"params":     {Type: "object"},
+		},
+		Required: []string{"method"},
+	}
+	server := &jsonschema.Schema{
+		Description: "Message sent by the server: the response, the broadcast or the message initiated by the server",
+		Type:        "object",
+		Properties: map[string]*jsonschema.Schema{
+			"id":         {Type: "string", Description: "Chat message ID, set for chat messages only"},
+			"request_id": {Type: "string", MaxLength: &maxRequestID, Description: "Request ID of the request causing the response, the error or the broadcast, set for the requester only"},
+			"seq":        {Type: "integer", Description: "Room sequence number of the broadcast, absent in direct responses"},
+			"user_id":    {Type: "string"},
+			"method":     {Type: "string", Enum: make([]interface{}, 0, len(serverNames))},
+			"params":     {},
+		},
+		Required: []string{"user_id", "method"},
+	}
+	schema := &jsonschema.Schema{
+		Schema:      jsonschema.Draft,
+		Title:       "smotri.me websocket protocol",
+		Definitions: make(map[string]*jsonschema.Schema, len(names)+len(serverNames)+2),
+		AnyOf: []*jsonschema.Schema{
+			{Ref: "#/definitions/request"},
+			{Ref: "#/definitions/server_message"},
+		},
+	}
+	schema.Definitions["request"] = request
+	schema.Definitions["server_message"] = server
+	for _, name := range names {
+		schema.Definitions["request."+name] = jsonschema.Reflect(reflect.New(methods[name].paramsType()).Interface())
+		addMethod(request, name, "#/definitions/request."+name)
+	}
+	for _, name := range serverNames {
+		params, ok := serverMessages[name]
+		if !ok {
+			params = reflect.New(methods[name].replyType()).Interface()
+		}
+		schema.Definitions["server."+name] = jsonschema.Reflect(params)
+		addMethod(server, name, "#/definitions/server."+name)
+	}
+	return schema
+}
+
+// Adds the method to the envelope schema with the reference to its params schema
+func addMethod(envelope *jsonschema.Schema, name, ref string) {
+	envelope.Properties["method"].Enum = append(envelope.Properties["method"].Enum, name)
+	envelope.AllOf = append(envelope.AllOf, &jsonschema.Schema{
+		If: &jsonschema.Schema{Properties: map[string]*jsonschema.Schema{"method": {Const: name}}},
+		Then: &jsonschema.Schema{Properties: map[string]*jsonschema.Schema{
+			"params": {Ref: ref},
+		}},
+	})
+}
+
+// Returns the type of the method params
+func (m *method) paramsType() reflect.Type {
+	if m.params == nil {
+		return reflect.TypeOf(websocket.NoParams{})
+	}
+	return reflect.TypeOf(m.params)
+}
+
+// Returns the type of the params of the method response or broadcast
+func (m *method) replyType() reflect.Type {
+	if m.reply == nil {
+		return m.paramsType()
+	}
+	return reflect.TypeOf(m.reply)
+}
+
+// Decodes the request params into a new value of the params type
+func (m *method) decode(method string, raw json.RawMessage) (interface{}, error) {
+	params := reflect.New(m.paramsType()).Interface()
+	if err := jsonschema.Decode(raw, params); err != nil {
+		e := err.(*jsonschema.Error)
+		if e.Field == "" {
+			return nil, websocket.NewError(websocket.ErrCodeInvalidParams, "invalid '%s' request, params %s", method, e.Message)
+		}
+		return nil, websocket.NewError(websocket.ErrCodeInvalidParams, "invalid '%s' request, param '%s' %s", method, e.Field, e.Message)
+	}
+	return params, nil
+}
+
+// Handles the text message of the user: the request is validated, checked for permission
+// and applied by the method handler, then replied to the user or broadcast to the room
+func (api *API) handleUserMessage(u *model.User, b []byte) {
+	// params are kept raw until the method is known, on failure msg keeps the fields parsed so far
+	var req request
+	msg := &req.Message
+	b, err := websocket.CodecOf(u.Protocol).Decode(b)
+	if err == nil {
+		err = json.Unmarshal(b, &req)
+	}
+	if err != nil {
+		api.rejectInvalid(u, msg, websocket.NewError(websocket.ErrCodeBadRequest, "invalid message: %s", err))
+		return
+	}
+	if err = msg.Validate(); err != nil {
+		api.rejectInvalid(u, msg, err)
+		return
+	}
+	if params := bytes.TrimSpace(req.Params); len(params) > 0 && params[0] != '{' && !bytes.Equal(params, []byte("null")) {
+		api.rejectInvalid(u, msg, websocket.NewError(websocket.ErrCodeBadRequest, "invalid message: params must be object"))
+		return
+	}
+
+	m, exists := methods[msg.Method]
+	if !exists {
+		stats := api.methodStats[unknownMethod]
+		atomic.AddUint64(&stats.calls, 1)
+		atomic.AddUint64(&stats.errors, 1)
+		api.rejectInvalid(u, msg, websocket.NewError(websocket.ErrCodeUnknownMethod, "invalid request method: '%s'", msg.Method))
+		return
+	}
+	stats := api.methodStats[msg.Method]
+	atomic.AddUint64(&stats.calls, 1)
+	if !api.rateLimit(u, msg, m) {
+		atomic.AddUint64(&stats.errors, 1)
+		return
+	}
+	if err = api.callMethod(m, u, &req); err != nil {
+		atomic.AddUint64(&stats.errors, 1)
+		api.sendError(u, msg, err)
+	}
+}
+
+func (api *API) callMethod(m *method, u *model.User, req *request) error {
+	msg := &req.Message
+	params, err := m.decode(msg.Method, req.Params)
+	if err != nil {
+		return err
+	}
+	// the request params are broadcast as is unless the handler sets the params of the reply
+	msg.Params = params
+	if err := api.checkPermission(u, msg.Method, m.access); err != nil {
+		return err
+	}
+	if m.chat {
+		muted, err := api.storage.IsMemberMuted(u.RoomID, u.ID)
+		if err != nil {
+			return err
+		}
+		if muted {
+			return websocket.NewError(websocket.ErrCodeForbidden, "chat is muted by the host")
+		}
+	}
+	if m.handle != nil {
+		if err := m.handle(api, u, msg, params); err != nil {
+			return err
+		}
+	}
+
+	// the request ID stays in the response and in the broadcast copy of the sender
+	msg.UserID = u.ID
+	if m.response {
+		api.sendToUser(u, msg)
+		return nil
+	}
+	return api.publish(u.RoomID, msg)
+}
+
+// Checks whether the user is allowed to call the method, refreshes the user role on the way
+func (api *API) checkPermission(u *model.User, method string, access int) error {
+	if access == accessAny {
+		return nil
+	}
+
+	role, err := api.storage.GetMemberRole(u.RoomID, u.ID)
+	if err != nil {
+		return err
+	}
+	u.Role = role
+
+	if access == accessHost {
+		if role != model.RoleHost {
+			return websocket.NewError(websocket.ErrCodeForbidden, "method '%s' is allowed to the host only", method)
+		}
+		return nil
+	}
+
+	policy, err := api.storage.GetControlPolicy(u.RoomID)
+	if err != nil {
+		return err
+	}
+	if policy == model.PolicyHost && !model.Privileged(role) {
+		return websocket.NewError(websocket.ErrCodeForbidden, "method '%s' is allowed to the host and co-hosts only", method)
+	}
+	return nil
+}
+
+func (api *API) newMessage(u *model.User, msg *websocket.Message, params interface{}) error {
+	content := params.(*websocket.NewMessageParams).Content
+	now := time.Now()
+	if err := api.filterMessage(u, msg.Method, content, now); err != nil {
+		return err
+	}
+	msg.ID = utils.RandString(5)
+	chatMsg := &model.ChatMessage{
+		ID:        msg.ID,
+		UserID:    u.ID,
+		Name:      u.Name,
+		Color:     u.Color,
+		Content:   content,
+		CreatedAt: utils.UnixMilli(now),
+	}
+	if err := api.storage.AddRoomMessage(u.RoomID, chatMsg); err != nil {
+		return err
+	}
+	api.rememberMessage(u, chatMsg)
+	msg.Params = &websocket.PostedMessage{Content: content, CreatedAt: chatMsg.CreatedAt, Seq: chatMsg.Seq}
+	return nil
+}
+
+// Only the author can edit the message, the previous content is kept in the message edit history
+func (api *API) editMessage(u *model.User, msg *websocket.Message, params interface{}) error {
+	p := params.(*websocket.EditMessageParams)
+	if err := api.authorizeMessageChange(u, p.MessageID, false); err != nil {
+		return err
+	}
+	now := time.Now()
+	if err := api.filterMessage(u, msg.Method, p.Content, now); err != nil {
+		return err
+	}
+	chatMsg, err := api.storage.EditRoomMessage(u.RoomID, p.MessageID, p.Content, utils.UnixMilli(now))
+	if err == storage.ErrMessageNotFound {
+		return websocket.NewError(websocket.ErrCodeNotFound, "message '%s' not found", p.MessageID)
+	}
+	if err != nil {
+		return err
+	}
+	msg.Params = &websocket.EditedMessage{MessageID: p.MessageID, Content: p.Content, EditedAt: chatMsg.EditedAt}
+	return nil
+}
+
+// The message can be removed by its author, the host and co-hosts
+func (api *API) removeMessage(u *model.User, msg *websocket.Message, params interface{}) error {
+	p := params.(*websocket.RemoveMessageParams)
+	if err := api.authorizeMessageChange(u, p.MessageID, true); err != nil {
+		return err
+	}
+	err := api.storage.RemoveRoomMessage(u.RoomID, p.MessageID)
+	if err == storage.ErrMessageNotFound {
+		return websocket.NewError(websocket.ErrCodeNotFound, "message '%s' not found", p.MessageID)
+	}
+	return err
+}
+
+// Checks whether the user is the author of the chat message, or whether the user is privileged
+// if privileged users are allowed to change the message
+func (api *API) authorizeMessageChange(u *model.User, messageID string, privilegedAllowed bool) error {
+	chatMsg, err := api.storage.GetRoomMessage(u.RoomID, messageID)
+	if err == storage.ErrMessageNotFound {
+		return websocket.NewError(websocket.ErrCodeNotFound, "message '%s' not found", messageID)
+	}
+	if err != nil {
+		return err
+	}
+	if chatMsg.UserID == u.ID {
+		return nil
+	}
+	if !privilegedAllowed {
+		return websocket.NewError(websocket.ErrCodeForbidden, "only the author can edit the message")
+	}
+	role, err := api.storage.GetMemberRole(u.RoomID, u.ID)
+	if err != nil {
+		return err
+	}
+	u.Role = role
+	if !model.Privileged(role) {
+		return websocket.NewError(websocket.ErrCodeForbidden, "only the author, the host and co-hosts can remove the message")
+	}
+	return nil
+}
+
+func (api *API) renameMember(u *model.User, msg *websocket.Message, params interface{}) error {
+	u.Name = params.(*websocket.RenameMemberParams).Name
+	return api.storage.UpdateRoomUser(u.RoomID, u)
+}
+
+func (api *API) updateRoom(u *model.User, msg *websocket.Message, params interface{}) error {
+	p := params.(*websocket.UpdateRoomParams)
+	return api.storage.UpdateTempRoom(&model.Room{
+		ID:       u.RoomID,
+		Title:    p.Title,
+		VideoURL: p.VideoURL,
+	})
+}
+
+func (api *API) setCohost(u *model.User, msg *websocket.Message, params interface{}) error {
+	userID := params.(*websocket.MemberParams).UserID
+	role := model.RoleCohost
+	if msg.Method == "revoke_cohost" {
+		role = model.RoleMember
+	}
+	if userID == u.ID {
+		return websocket.NewError(websocket.ErrCodeForbidden, "host can not change own role")
+	}
+	if targetRole, _ := api.storage.GetMemberRole(u.RoomID, userID); targetRole == model.RoleHost {
+		return websocket.NewError(websocket.ErrCodeForbidden, "host role can not be changed")
+	}
+	if err := api.storage.SetMemberRole(u.RoomID, userID, role); err != nil {
+		log.Warn(err)
+		return websocket.NewError(websocket.ErrCodeNotFound, "member '%s' not found", userID)
+	}
+	msg.Params = &websocket.RoleChange{UserID: userID, Role: role}
+	return nil
+}
+
+func (api *API) setControlPolicy(u *model.User, msg *websocket.Message, params interface{}) error {
+	return api.storage.UpdateControlPolicy(u.RoomID, params.(*websocket.ControlPolicyParams).Policy)
+}
+
+// Applies the given chat settings, the broadcast carries all of them
+func (api *API) updateChatSettings(u *model.User, msg *websocket.Message, params interface{}) error {
+	p := params.(*websocket.ChatSettingsParams)
+	settings, err := api.storage.GetChatSettings(u.RoomID)
+	if err != nil {
+		return err
+	}
+	if p.SlowMode != nil {
+		settings.SlowMode = *p.SlowMode
+	}
+	if p.LinkPolicy != nil {
+		settings.LinkPolicy = *p.LinkPolicy
+	}
+	if err = api.storage.UpdateChatSettings(u.RoomID, settings); err != nil {
+		return err
+	}
+	msg.Params = settings
+	return nil
+}
+
+func (api *API) getMe(u *model.User, msg *websocket.Message, _ interface{}) error {
+	msg.Params = websocket.NewMemberInfo(u)
+	return nil
+}
+
+func (api *API) getMembers(u *model.User, msg *websocket.Message, _ interface{}) error {
+	room, err := api.storage.GetTempRoom(u.RoomID)
+	if err != nil {
+		return err
+	}
+	msg.Params = &websocket.MemberList{Members: room.Members}
+	return nil
+}
+
+func (api *API) controlPlayback(u *model.User, msg *websocket.Message, params interface{}) error {
+	var p *websocket.SyncParams
+	switch params := params.(type) {
+	case *websocket.SyncParams:
+		p = params
+	case *websocket.PlaybackParams:
+		p = &websocket.SyncParams{PlaybackParams: *params}
+	}
+	playback, err := api.updatePlayback(u.RoomID, msg.Method, p)
+	if err != nil {
+		return err
+	}
+	msg.Params = playback
+	return nil
+}
+
+func (api *API) getPlayback(u *model.User, msg *websocket.Message, _ interface{}) error {
+	playback, err := api.storage.GetPlayback(u.RoomID)
+	if err != nil {
+		return err
+	}
+	msg.Params = playback.At(time.Now())
+	return nil
+}
+
+func (api *API) getHistoryPage(u *model.User, msg *websocket.Message, params interface{}) (err error) {
+	p := params.(*websocket.HistoryParams)
+	limit := p.Limit
+	if limit == 0 {
+		limit = historyPageSize
+	}
+	msg.Params, err = api.getHistory(u.RoomID, p.Before, limit)
+	return err
+}
+
+func (api *API) resyncRoom(u *model.User, msg *websocket.Message, params interface{}) (err error) {
+	msg.Params, err = api.resync(u.RoomID, params.(*websocket.ResyncParams).Since)
+	return err
+}
@@ -0,0 +1,239 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"smotri.me/model"
+	"smotri.me/pkg/jsonschema"
+	"smotri.me/pkg/utils"
+	"smotri.me/pkg/websocket"
+	"testing"
+	"time"
+)
+
+func TestMethodDecode(t *testing.T) {
+	cases := []struct {
+		method string
+		params string
+		err    string
+	}{
+		{"new_message", `{"content": "hi"}`, ""},
+		{"new_message", `{"content": " "}`, "param 'content' must not be blank"},
+		{"new_message", ``, "param 'content' is required and must be string"},
+		{"new_message", `{"content": "hi", "color": "red"}`, "param 'color' is unknown"},
+		{"new_message", `["hi"]`, "params must be object"},
+		{"edit_message", `{"message_id": 1, "content": "hi"}`, "param 'message_id' must be string, got number"},
+		{"video_play", `{"position": 1.5}`, ""},
+		{"video_play", `{"position": -1}`, "param 'position' must be greater than or equal to 0"},
+		{"video_play", `{"position": 1, "rate": 5}`, "param 'rate' must be less than or equal to 4"},
+		{"video_play", `{"position": 1, "rate": 0}`, "param 'rate' must be greater than 0"},
+		{"video_play", `{"position": 1, "playing": true}`, "param 'playing' is unknown"},
+		{"video_sync", `{"position": 1, "playing": "yes"}`, "param 'playing' must be boolean, got string"},
+		{"video_sync", `{"position": 1, "playing": false}`, ""},
+		{"set_control_policy", `{"policy": "nobody"}`, "param 'policy' must be one of: everyone, host"},
+		{"get_history", `{"limit": "10"}`, "param 'limit' must be integer, got string"},
+		{"get_history", `{"limit": 1000}`, "param 'limit' must be less than or equal to 100"},
+		{"get_history", `{"before": 1.5}`, "param 'before' must be integer, got number 1.5"},
+		{"resync", `{"since": 0}`, ""},
+		{"resync", `{"since": -1}`, "param 'since' must be greater than or equal to 0"},
+		{"get_me", `null`, ""},
+		{"get_me", `{"verbose": true}`, "param 'verbose' is unknown"},
+	}
+	for _, c := range cases {
+		_, err := methods[c.method].decode(c.method, json.RawMessage(c.params))
+		if c.err == "" {
+			assert.NoError(t, err, c.method)
+			continue
+		}
+		require.IsType(t, &websocket.Error{}, err, c.method)
+		assert.Equal(t, websocket.ErrCodeInvalidParams, err.(*websocket.Error).Code, c.method)
+		assert.Equal(t, "invalid '"+c.method+"' request, "+c.err, err.Error(), c.method)
+	}
+}
+
+func TestSchema(t *testing.T) {
+	api := newTestAPI(t)
+	defer api.stop()
+
+	rec := api.request(http.MethodGet, "/schema", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	type object struct {
+		Properties           map[string]map[string]interface{} `json:"properties"`
+		Required             []string                          `json:"required"`
+		AdditionalProperties bool                              `json:"additionalProperties"`
+		AllOf                []interface{}                     `json:"allOf"`
+	}
+	var schema struct {
+		Schema      string            `json:"$schema"`
+		Definitions map[string]object `json:"definitions"`
+		AnyOf       []interface{}     `json:"anyOf"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &schema))
+	assert.Equal(t, "http://json-schema.org/draft-07/schema#", schema.Schema)
+	assert.Len(t, schema.AnyOf, 2)
+	assert.Len(t, schema.Definitions, 2+2*len(methods)+len(serverMessages))
+	assert.Len(t, schema.Definitions["request"].AllOf, len(methods))
+	assert.Len(t, schema.Definitions["server_message"].AllOf, len(methods)+len(serverMessages))
+	assert.Equal(t, []string{"user_id", "method"}, schema.Definitions["server_message"].Required)
+
+	sync := schema.Definitions["request.video_sync"]
+	assert.False(t, sync.AdditionalProperties)
+	assert.Equal(t, []string{"position"}, sync.Required)
+	assert.Equal(t, map[string]interface{}{"type": "number", "exclusiveMinimum": 0.0, "maximum": 4.0,
+		"description": "Playback rate, unchanged if omitted"}, sync.Properties["rate"])
+	assert.Equal(t, "boolean", sync.Properties["playing"]["type"])
+	assert.Equal(t, []interface{}{"everyone", "host"}, schema.Definitions["request.set_control_policy"].Properties["policy"]["enum"])
+	assert.Empty(t, schema.Definitions["request.get_me"].Properties)
+	// the video URL is described the way the server checks it, the scheme may be omitted
+	videoURL := schema.Definitions["request.update_room"].Properties["video_url"]
+	assert.Equal(t, utils.URLPattern, videoURL["pattern"])
+	assert.NotContains(t, videoURL, "format")
+
+	// responses and broadcasts are described by their own params, echoed requests by the request params
+	assert.ElementsMatch(t, []string{"position", "playing", "rate", "updated_at"}, schema.Definitions["server.video_play"].Required)
+	assert.Contains(t, schema.Definitions["server.new_message"].Properties, "created_at")
+	assert.Equal(t, schema.Definitions["request.rename_member"], schema.Definitions["server.rename_member"])
+	assert.Contains(t, schema.Definitions["server.welcome"].Properties, "resume_token")
+	assert.Equal(t, []interface{}{"host", "cohost", "member"}, schema.Definitions["server.new_member"].Properties["role"]["enum"])
+	assert.Contains(t, schema.Definitions["server.error"].Properties["code"]["enum"], websocket.ErrCodeRateLimited)
+}
+
+// Checks the params of the server messages strictly against the types their schema is generated from
+func TestServerMessagesConformToSchema(t *testing.T) {
+	api := newTestAPI(t)
+	defer api.stop()
+	server := httptest.NewServer(api.echo)
+	defer server.Close()
+	roomID, err := api.storage.CreateTempRoom(&model.Room{Title: "Movie", VideoURL: "https://youtube.com", HostToken: "secret"}, time.Hour)
+	require.NoError(t, err)
+
+	seen := make(map[string]bool)
+	// reads the next message checking its params against the declared type
+	next := func(conn net.Conn) (*message, error) {
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(200*time.Millisecond)))
+		b, err := wsutil.ReadServerText(conn)
+		if err != nil {
+			return nil, err
+		}
+		var raw struct {
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+		}
+		require.NoError(t, json.Unmarshal(b, &raw))
+		var params interface{}
+		if zero, ok := serverMessages[raw.Method]; ok {
+			params = reflect.New(reflect.TypeOf(zero)).Interface()
+		} else {
+			require.Contains(t, methods, raw.Method)
+			params = reflect.New(methods[raw.Method].replyType()).Interface()
+		}
+		if len(raw.Params) == 0 {
+			raw.Params = json.RawMessage(`{}`)
+		}
+		assert.NoError(t, jsonschema.Decode(raw.Params, params), "%s: %s", raw.Method, raw.Params)
+		seen[raw.Method] = true
+
+		msg := &message{}
+		require.NoError(t, json.Unmarshal(b, msg))
+		return msg, nil
+	}
+	receiveChecked := func(conn net.Conn, method string) *message {
+		for {
+			msg, err := next(conn)
+			require.NoError(t, err)
+			if msg.Method == method {
+				return msg
+			}
+		}
+	}
+
+	host := dial(t, server, roomID, "Host", "host_token=secret")
+	defer host.Close()
+	receiveChecked(host, "welcome")
+	viewer := dial(t, server, roomID, "Viewer")
+	defer viewer.Close()
+	viewerID := receiveChecked(viewer, "welcome").Params["me"].(map[string]interface{})["id"].(string)
+
+	send(t, host, `{"method": "new_message", "params": {"content": "hi"}}`)
+	messageID := receiveChecked(host, "new_message").ID
+	requests := []string{
+		`{"method": "edit_message", "params": {"message_id": "` + messageID + `", "content": "hello"}}`,
+		`{"method": "remove_message", "params": {"message_id": "` + messageID + `"}}`,
+		`{"method": "rename_member", "params": {"name": "Hostess"}}`,
+		`{"method": "update_room", "params": {"title": "Series", "video_url": "youtube.com/watch?v=2"}}`,
+		`{"method": "grant_cohost", "params": {"user_id": "` + viewerID + `"}}`,
+		`{"method": "revoke_cohost", "params": {"user_id": "` + viewerID + `"}}`,
+		`{"method": "update_chat_settings", "params": {"slow_mode": 5}}`,
+		`{"method": "set_control_policy", "params": {"policy": "everyone"}}`,
+		`{"method": "video_play", "params": {"position": 1}}`,
+		`{"method": "video_pause", "params": {"position": 2, "rate": 1.5}}`,
+		`{"method": "video_sync", "params": {"position": 3, "playing": true}}`,
+		`{"method": "get_me"}`,
+		`{"method": "get_members"}`,
+		`{"method": "get_playback"}`,
+		`{"method": "get_history"}`,
+		`{"method": "resync", "params": {"since": 0}}`,
+		`{"method": "hack_room"}`,
+		`{"method": "mute_member", "params": {"user_id": "` + viewerID + `"}}`,
+		`{"method": "unmute_member", "params": {"user_id": "` + viewerID + `"}}`,
+		`{"method": "kick_member", "params": {"user_id": "` + viewerID + `", "reason": "spam"}}`,
+	}
+	for _, req := range requests {
+		send(t, host, req)
+	}
+
+	for _, conn := range []net.Conn{host, viewer} {
+		for {
+			if _, err := next(conn); err != nil {
+				break
+			}
+		}
+	}
+	for _, req := range requests {
+		var r struct {
+			Method string `json:"method"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(req), &r))
+		if _, ok := methods[r.Method]; ok {
+			assert.True(t, seen[r.Method], r.Method)
+		}
+	}
+	for name := range serverMessages {
+		assert.True(t, seen[name], name)
+	}
+}
+
+func TestMethodStats(t *testing.T) {
+	api := newTestAPI(t)
+	defer api.stop()
+	server := httptest.NewServer(api.echo)
+	defer server.Close()
+	roomID, err := api.storage.CreateTempRoom(&model.Room{Title: "Movie", VideoURL: "https://youtube.com"}, time.Hour)
+	require.NoError(t, err)
+
+	conn := dial(t, server, roomID, "Viewer")
+	defer conn.Close()
+	send(t, conn, `{"method": "get_me"}`)
+	receive(t, conn, "get_me")
+	send(t, conn, `{"method": "video_play"}`)
+	receive(t, conn, "error")
+	send(t, conn, `{"method": "hack_room"}`)
+	msg := receive(t, conn, "error")
+	assert.Equal(t, websocket.ErrCodeUnknownMethod, msg.Params["code"])
+
+	rec := api.request(http.MethodGet, "/stats/methods", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var stats map[string]map[string]uint64
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &stats))
+	assert.Equal(t, map[string]uint64{"calls": 1, "errors": 0}, stats["get_me"])
+	assert.Equal(t, map[string]uint64{"calls": 1, "errors": 1}, stats["video_play"])
+	assert.Equal(t, map[string]uint64{"calls": 1, "errors": 1}, stats[unknownMethod])
+	assert.Equal(t, map[string]uint64{"calls": 0, "errors": 0}, stats["new_message"])
+	assert.Len(t, stats, len(methods)+1)
+}
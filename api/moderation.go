@@ -0,0 +1,288 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/gobwas/ws"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"io/ioutil"
+	"net/http"
+	"smotri.me/model"
+	"smotri.me/pkg/msgbroker"
+	"smotri.me/pkg/utils"
+	"smotri.me/pkg/websocket"
+	"smotri.me/storage"
+	"time"
+)
+
+// hostTokenHeader authorizes the REST requests of the room host
+const hostTokenHeader = "X-Host-Token"
+
+// moderation is the control message telling the instance serving the member to disconnect it,
+// published to the 'moderation:<room ID>' channel
+type moderation struct {
+	UserID string `json:"user_id"`
+	Reason string `json:"reason,omitempty"`
+	// Ban is set if the member is banned, the instance adds the member resume token and IP to it
+	Ban *model.Ban `json:"ban,omitempty"`
+}
+
+// moderationMethods apply the moderation methods of the host to the room,
+// they are shared by the websocket methods and the REST endpoints
+var moderationMethods = map[string]func(api *API, roomID string, params interface{}) error{
+	"kick_member":   (*API).kickMember,
+	"ban_member":    (*API).banMember,
+	"unban_member":  (*API).unbanMember,
+	"mute_member":   (*API).muteMember,
+	"unmute_member": (*API).unmuteMember,
+}
+
+// Handles the moderation websocket methods, the request is broadcast as is
+func (api *API) moderate(u *model.User, msg *websocket.Message, params interface{}) error {
+	return moderationMethods[msg.Method](api, u.RoomID, params)
+}
+
+func (api *API) kickMember(roomID string, params interface{}) error {
+	p := params.(*websocket.ModerationParams)
+	if _, err := api.moderationTarget(roomID, p.UserID); err != nil {
+		return err
+	}
+	if err := api.dropSuspendedMember(roomID, p.UserID, nil); err != nil {
+		return err
+	}
+	return api.disconnectMember(roomID, &moderation{UserID: p.UserID, Reason: p.Reason})
+}
+
+// The member is banned by the user ID right away, the resume token and IP are added to the ban
+// by the instance serving the member, the IP of the suspended member is taken from its session
+func (api *API) banMember(roomID string, params interface{}) error {
+	p := params.(*websocket.ModerationParams)
+	target, err := api.moderationTarget(roomID, p.UserID)
+	if err != nil {
+		return err
+	}
+	ban := &model.Ban{
+		UserID:    target.ID,
+		Name:      target.Name,
+		Reason:    p.Reason,
+		CreatedAt: utils.UnixMilli(time.Now()),
+	}
+	if err = api.dropSuspendedMember(roomID, p.UserID, ban); err != nil {
+		return err
+	}
+	if err = api.storage.SaveRoomBan(roomID, ban); err != nil {
+		return err
+	}
+	return api.disconnectMember(roomID, &moderation{UserID: p.UserID, Reason: p.Reason, Ban: ban})
+}
+
+func (api *API) unbanMember(roomID string, params interface{}) error {
+	userID := params.(*websocket.MemberParams).UserID
+	err := api.storage.RemoveRoomBan(roomID, userID)
+	if err == storage.ErrBanNotFound {
+		return websocket.NewError(websocket.ErrCodeNotFound, "member '%s' is not banned", userID)
+	}
+	return err
+}
+
+func (api *API) muteMember(roomID string, params interface{}) error {
+	p := params.(*websocket.ModerationParams)
+	if _, err := api.moderationTarget(roomID, p.UserID); err != nil {
+		return err
+	}
+	return api.storage.SetMemberMuted(roomID, p.UserID, true)
+}
+
+func (api *API) unmuteMember(roomID string, params interface{}) error {
+	return api.storage.SetMemberMuted(roomID, params.(*websocket.MemberParams).UserID, false)
+}
+
+// Returns the room member to be moderated, the host can not be moderated
+func (api *API) moderationTarget(roomID, userID string) (*model.User, error) {
+	room, err := api.storage.GetTempRoom(roomID)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range room.Members {
+		if m.ID != userID {
+			continue
+		}
+		if m.Role == model.RoleHost {
+			return nil, websocket.NewError(websocket.ErrCodeForbidden, "host can not be moderated")
+		}
+		return m, nil
+	}
+	return nil, websocket.NewError(websocket.ErrCodeNotFound, "member '%s' not found", userID)
+}
+
+// Removes the member disconnected before the moderation from the room, so its session can not be resumed,
+// the ban gets the IP of the session. Nothing is done if the member is connected
+func (api *API) dropSuspendedMember(roomID, userID string, ban *model.Ban) error {
+	session, err := api.storage.DeleteUserSession(roomID, userID)
+	if err != nil || session == nil {
+		return err
+	}
+	if ban != nil {
+		ban.IP = session.IP
+	}
+	api.removeMember(session.User)
+	return nil
+}
+
+// Tells the instance serving the member to disconnect it
+func (api *API) disconnectMember(roomID string, m *moderation) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return api.msgBroker.Publish(b, "moderation:"+roomID)
+}
+
+// Message broker handler of the moderation control messages. Members are disconnected
+// by the room broadcast worker, so they receive the broadcasts published before
+func (api *API) handleModeration(msg *msgbroker.Message) {
+	if len(msg.Channel) <= len("moderation:") {
+		return
+	}
+	roomID := msg.Channel[len("moderation:"):]
+	var m moderation
+	if err := json.Unmarshal(msg.Data, &m); err != nil {
+		log.Error(err)
+		return
+	}
+	api.broadcastPool.Submit(roomID, func() {
+		api.disconnectSubscribers(roomID, &m)
+	})
+}
+
+// Closes the connections of the member served by this instance with the reason,
+// the member is removed from the room without waiting for the session to be resumed
+func (api *API) disconnectSubscribers(roomID string, m *moderation) {
+	reason := "kicked by the host"
+	if m.Ban != nil {
+		reason = "banned by the host"
+	}
+	if m.Reason != "" {
+		reason += ": " + m.Reason
+	}
+	for _, u := range api.channels.GetSubscribers(roomID) {
+		if u.ID != m.UserID {
+			continue
+		}
+		if m.Ban != nil {
+			ban := *m.Ban
+			ban.ResumeToken = u.ResumeToken
+			ban.IP = u.IP
+			if err := api.storage.SaveRoomBan(roomID, &ban); err != nil {
+				log.Error(err)
+			}
+		}
+		api.kicked.Store(u, struct{}{})
+		// no more broadcasts are queued behind the close frame
+		api.channels.Unsubscribe(u, roomID)
+		if err := u.Conn.Shutdown(ws.StatusPolicyViolation, reason); err != nil {
+			log.Debug(err)
+		}
+	}
+}
+
+// Reports whether any of the room bans applies to the connecting user
+func (api *API) isBanned(roomID, userID, resumeToken, ip string) (bool, error) {
+	bans, err := api.storage.GetRoomBans(roomID)
+	if err != nil {
+		return false, err
+	}
+	for _, b := range bans {
+		if b.Matches(userID, resumeToken, ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Returns the handler of the REST endpoint applying the moderation method, the params are taken
+// from the request body, or the user ID from the path. The room is told about it the same way
+// as about the websocket method
+func (api *API) moderationEndpoint(method string) echo.HandlerFunc {
+	m := methods[method]
+	return func(c echo.Context) error {
+		roomID := c.Param("roomID")
+		if err := api.authorizeHost(c, roomID); err != nil {
+			return err
+		}
+		var raw []byte
+		var err error
+		if userID := c.Param("userID"); userID != "" {
+			raw, err = json.Marshal(map[string]string{"user_id": userID})
+		} else {
+			raw, err = ioutil.ReadAll(c.Request().Body)
+		}
+		if err != nil {
+			return err
+		}
+		params, err := m.decode(method, raw)
+		if err != nil {
+			return httpError(err)
+		}
+		if err = moderationMethods[method](api, roomID, params); err != nil {
+			return httpError(err)
+		}
+
+		msg := &websocket.Message{Method: method, Params: params}
+		if err = api.publish(roomID, msg); err != nil {
+			log.Error(err)
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+// Returns the bans of the room, the resume tokens and IPs are kept secret
+func (api *API) getRoomBans(c echo.Context) error {
+	roomID := c.Param("roomID")
+	if err := api.authorizeHost(c, roomID); err != nil {
+		return err
+	}
+	bans, err := api.storage.GetRoomBans(roomID)
+	if err != nil {
+		log.Info(err)
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+	for _, b := range bans {
+		b.ResumeToken = ""
+		b.IP = ""
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"bans": bans})
+}
+
+// Checks the host token of the request against the room one
+func (api *API) authorizeHost(c echo.Context, roomID string) error {
+	room, err := api.storage.GetTempRoom(roomID)
+	if err != nil {
+		log.Info(err)
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+	token := c.Request().Header.Get(hostTokenHeader)
+	if token == "" || subtle.ConstantTimeCompare([]byte(room.HostToken), []byte(token)) != 1 {
+		return echo.NewHTTPError(http.StatusForbidden)
+	}
+	return nil
+}
+
+// Converts the websocket error to the HTTP one, other errors are logged and reported as internal ones
+func httpError(err error) error {
+	wsErr, ok := err.(*websocket.Error)
+	if !ok {
+		log.Error(err)
+		return echo.NewHTTPError(http.StatusInternalServerError)
+	}
+	switch wsErr.Code {
+	case websocket.ErrCodeBadRequest, websocket.ErrCodeInvalidParams:
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, wsErr.Message)
+	case websocket.ErrCodeForbidden:
+		return echo.NewHTTPError(http.StatusForbidden, wsErr.Message)
+	case websocket.ErrCodeNotFound:
+		return echo.NewHTTPError(http.StatusNotFound, wsErr.Message)
+	}
+	return echo.NewHTTPError(http.StatusInternalServerError, wsErr.Message)
+}
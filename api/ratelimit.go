@@ -0,0 +1,106 @@
+package api
+
+import (
+	"github.com/gobwas/ws"
+	"github.com/labstack/gommon/log"
+	"smotri.me/model"
+	"smotri.me/pkg/ratelimit"
+	"smotri.me/pkg/websocket"
+)
+
+// Rate limit classes of the methods, they name the room buckets as well
+const (
+	// Chat messages
+	rateChat = "chat"
+	// Methods changing the room or the playback, broadcast to the room
+	rateControl = "control"
+	// Methods replying to the caller only
+	rateQuery = "query"
+)
+
+// rateLimits are the limits of a method class
+type rateLimits struct {
+	// user limits the requests of a connection
+	user ratelimit.Limit
+	// room limits the requests of all the room members
+	room ratelimit.Limit
+}
+
+// userLimiter holds the token buckets of the user connection
+type userLimiter struct {
+	// buckets by class, never modified after creation
+	buckets map[string]*ratelimit.Bucket
+	// strikes counts the requests rejected by the buckets
+	strikes *ratelimit.Bucket
+}
+
+// Returns the rate limit class of the method
+func (m *method) rateClass() string {
+	switch {
+	case m.chat:
+		return rateChat
+	case m.response:
+		return rateQuery
+	}
+	return rateControl
+}
+
+// Returns the rate limiter of the user connection, it is created on the first request
+func (api *API) userLimiter(u *model.User) *userLimiter {
+	if l, ok := api.limiters.Load(u); ok {
+		return l.(*userLimiter)
+	}
+	l := &userLimiter{
+		buckets: make(map[string]*ratelimit.Bucket, len(api.rateLimits)),
+		strikes: ratelimit.NewBucket(api.config.RateLimitStrikes),
+	}
+	for class, limits := range api.rateLimits {
+		l.buckets[class] = ratelimit.NewBucket(limits.user)
+	}
+	actual, _ := api.limiters.LoadOrStore(u, l)
+	return actual.(*userLimiter)
+}
+
+// Checks the request against the limits of the connection and the room, replies with the error if it is rejected.
+// Requests rejected by the connection limits are strikes, the connection is closed right after the error reply
+// once the strikes exceed their limit. Reports whether the request is allowed
+func (api *API) rateLimit(u *model.User, msg *websocket.Message, m *method) bool {
+	class := m.rateClass()
+	l := api.userLimiter(u)
+	if !l.buckets[class].Allow() {
+		api.sendError(u, msg, websocket.NewError(websocket.ErrCodeRateLimited, "too many %s requests, slow down", class))
+		api.strike(u, l)
+		return false
+	}
+
+	allowed, err := api.storage.TakeRoomToken(u.RoomID, class, api.rateLimits[class].room)
+	if err != nil {
+		api.sendError(u, msg, err)
+		return false
+	}
+	if !allowed {
+		api.sendError(u, msg, websocket.NewError(websocket.ErrCodeRateLimited, "too many %s requests in the room, try again later", class))
+		return false
+	}
+	return true
+}
+
+// Replies with the error to the malformed request or the one of an unknown method. Such requests take a token
+// of the query bucket, the rate limit error is replied once it is empty, and each of them is a strike
+func (api *API) rejectInvalid(u *model.User, msg *websocket.Message, err error) {
+	l := api.userLimiter(u)
+	if !l.buckets[rateQuery].Allow() {
+		err = websocket.NewError(websocket.ErrCodeRateLimited, "too many %s requests, slow down", rateQuery)
+	}
+	api.sendError(u, msg, err)
+	api.strike(u, l)
+}
+
+// Counts the rejected request, the connection is closed right after the error reply once the strikes
+// exceed their limit
+func (api *API) strike(u *model.User, l *userLimiter) {
+	if !l.strikes.Allow() {
+		log.Infof("user %s disconnected for exceeding the rate limits", u.ID)
+		_ = u.Conn.Shutdown(ws.StatusPolicyViolation, "too many requests")
+	}
+}
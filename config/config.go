@@ -3,15 +3,85 @@ package config
 import (
 	"github.com/kelseyhightower/envconfig"
 	"github.com/labstack/gommon/log"
+	"net"
+	"smotri.me/pkg/ratelimit"
+	"smotri.me/pkg/wsconn"
 	"sync"
+	"time"
+)
+
+// Storage and message broker drivers
+const (
+	DriverRedis  = "redis"
+	DriverMemory = "memory"
 )
 
 type Config struct {
 	HttpPort      int    `envconfig:"HTTP_PORT" required:"true"`
-	RedisAddr     string `envconfig:"REDIS_ADDR" required:"true"`
-	RedisPassword string `envconfig:"REDIS_PASSWORD" required:"true"`
+	RedisAddr     string `envconfig:"REDIS_ADDR" required:"false"`
+	RedisPassword string `envconfig:"REDIS_PASSWORD" required:"false"`
 	RedisDB       int    `envconfig:"REDIS_DB" required:"false" default:"0"`
 	MaxWorkers    int    `envconfig:"MAX_WORKERS" required:"false" default:"1000"`
+	// BroadcastWorkers is the number of workers delivering room messages, messages of a room
+	// are always delivered by the same worker, so they keep the publishing order
+	BroadcastWorkers int `envconfig:"BROADCAST_WORKERS" required:"false" default:"16"`
+	// StorageDriver is either "redis" or "memory", the latter keeps rooms in process memory (single-node mode)
+	StorageDriver string `envconfig:"STORAGE_DRIVER" required:"false" default:"redis"`
+	// BrokerDriver is either "redis" or "memory", the latter delivers messages within the process (single-node mode)
+	BrokerDriver string `envconfig:"BROKER_DRIVER" required:"false" default:"redis"`
+	// MemoryCleanupInterval is how often expired rooms are removed by the memory storage
+	MemoryCleanupInterval time.Duration `envconfig:"MEMORY_CLEANUP_INTERVAL" required:"false" default:"1m"`
+	// WriteQueueSize is the max number of messages waiting to be sent to a websocket client
+	WriteQueueSize int `envconfig:"WRITE_QUEUE_SIZE" required:"false" default:"256"`
+	// SlowConsumerPolicy is either "drop_oldest" or "disconnect", applied when the client write queue is full
+	SlowConsumerPolicy string `envconfig:"SLOW_CONSUMER_POLICY" required:"false" default:"drop_oldest"`
+	// WriteTimeout limits the time of sending a single message to a websocket client
+	WriteTimeout time.Duration `envconfig:"WRITE_TIMEOUT" required:"false" default:"10s"`
+	// PingInterval is how often websocket clients are pinged
+	PingInterval time.Duration `envconfig:"PING_INTERVAL" required:"false" default:"30s"`
+	// PongTimeout is how long to wait for a pong before closing the connection, must be less than PingInterval
+	PongTimeout time.Duration `envconfig:"PONG_TIMEOUT" required:"false" default:"10s"`
+	// MaxIdleTime is the max time without any frame from a websocket client, pongs included
+	MaxIdleTime time.Duration `envconfig:"MAX_IDLE_TIME" required:"false" default:"1m"`
+	// Netpoll enables the epoll based connection handling (linux only): idle connections are parked in a poller
+	// and read by the worker pool when readable, instead of holding a goroutine each
+	Netpoll bool `envconfig:"NETPOLL" required:"false" default:"false"`
+	// NetpollReadTimeout limits reading a frame of a readable connection in netpoll mode, so a client stalling
+	// in the middle of a frame is disconnected instead of holding a worker, zero means no limit
+	NetpollReadTimeout time.Duration `envconfig:"NETPOLL_READ_TIMEOUT" required:"false" default:"5s"`
+	// Compression enables permessage-deflate for the websocket clients asking for it
+	Compression bool `envconfig:"COMPRESSION" required:"false" default:"false"`
+	// CompressionThreshold is the min size in bytes of a message to be sent compressed, smaller ones gain nothing
+	CompressionThreshold int `envconfig:"COMPRESSION_THRESHOLD" required:"false" default:"512"`
+	// MaxMessageSize is the max size in bytes of a websocket message from a client, compressed ones are limited
+	// once inflated, zero means no limit
+	MaxMessageSize int64 `envconfig:"MAX_MESSAGE_SIZE" required:"false" default:"65536"`
+	// ChatRateLimit, ControlRateLimit and QueryRateLimit limit the websocket requests of a connection by the method class:
+	// chat messages, methods changing the room or the playback and methods replying to the caller only
+	ChatRateLimit    ratelimit.Limit `envconfig:"CHAT_RATE_LIMIT" required:"false" default:"5/5s"`
+	ControlRateLimit ratelimit.Limit `envconfig:"CONTROL_RATE_LIMIT" required:"false" default:"10/5s"`
+	QueryRateLimit   ratelimit.Limit `envconfig:"QUERY_RATE_LIMIT" required:"false" default:"20/10s"`
+	// RoomChatRateLimit, RoomControlRateLimit and RoomQueryRateLimit limit the websocket requests of all the room members
+	RoomChatRateLimit    ratelimit.Limit `envconfig:"ROOM_CHAT_RATE_LIMIT" required:"false" default:"50/5s"`
+	RoomControlRateLimit ratelimit.Limit `envconfig:"ROOM_CONTROL_RATE_LIMIT" required:"false" default:"20/5s"`
+	RoomQueryRateLimit   ratelimit.Limit `envconfig:"ROOM_QUERY_RATE_LIMIT" required:"false" default:"0"`
+	// RateLimitStrikes is how many requests rejected by the connection limits are tolerated,
+	// the connection is closed once they are exceeded
+	RateLimitStrikes ratelimit.Limit `envconfig:"RATE_LIMIT_STRIKES" required:"false" default:"10/1m"`
+	// MaxMessageLength is the max number of characters of a chat message, zero means no limit
+	MaxMessageLength int `envconfig:"MAX_MESSAGE_LENGTH" required:"false" default:"1000"`
+	// DuplicateMessageWindow is how long a member can not repeat the last chat message, zero allows repeating
+	DuplicateMessageWindow time.Duration `envconfig:"DUPLICATE_MESSAGE_WINDOW" required:"false" default:"30s"`
+	// TrustedProxies are the CIDR ranges of the reverse proxies in front of the API, the client IP is taken
+	// from X-Forwarded-For only if the request comes through them, otherwise the connection address is used
+	TrustedProxies []string `envconfig:"TRUSTED_PROXIES" required:"false"`
+	// ResumeWindow is how long a disconnected member stays in the room waiting to resume the session,
+	// zero disables the resumption
+	ResumeWindow time.Duration `envconfig:"RESUME_WINDOW" required:"false" default:"30s"`
+	// NodeHeartbeatInterval is how often the API instance extends its lease and looks for dead instances
+	NodeHeartbeatInterval time.Duration `envconfig:"NODE_HEARTBEAT_INTERVAL" required:"false" default:"10s"`
+	// NodeLease is how long members of the API instance are kept after its last heartbeat
+	NodeLease time.Duration `envconfig:"NODE_LEASE" required:"false" default:"30s"`
 }
 
 var (
@@ -25,6 +95,42 @@ func Get() *Config {
 		if err != nil {
 			log.Fatal(err)
 		}
+		if c.StorageDriver != DriverRedis && c.StorageDriver != DriverMemory {
+			log.Fatalf("invalid storage driver: '%s'", c.StorageDriver)
+		}
+		if c.BrokerDriver != DriverRedis && c.BrokerDriver != DriverMemory {
+			log.Fatalf("invalid message broker driver: '%s'", c.BrokerDriver)
+		}
+		// the redis storage publishes the room events with redis itself
+		if c.StorageDriver == DriverRedis && c.BrokerDriver != DriverRedis {
+			log.Fatalf("message broker driver must be '%s' with the '%s' storage", DriverRedis, DriverRedis)
+		}
+		if !wsconn.IsPolicyValid(c.SlowConsumerPolicy) {
+			log.Fatalf("invalid slow consumer policy: '%s'", c.SlowConsumerPolicy)
+		}
+		if c.MaxMessageLength < 0 {
+			log.Fatalf("invalid max message length: %d", c.MaxMessageLength)
+		}
+		if c.MaxMessageSize < 0 {
+			log.Fatalf("invalid max message size: %d", c.MaxMessageSize)
+		}
+		if c.CompressionThreshold < 0 {
+			log.Fatalf("invalid compression threshold: %d", c.CompressionThreshold)
+		}
+		for _, proxy := range c.TrustedProxies {
+			if _, _, err := net.ParseCIDR(proxy); err != nil {
+				log.Fatalf("invalid trusted proxy range: '%s'", proxy)
+			}
+		}
+		if c.PongTimeout >= c.PingInterval {
+			log.Fatalf("pong timeout %s must be less than ping interval %s", c.PongTimeout, c.PingInterval)
+		}
+		if c.MaxIdleTime <= c.PingInterval {
+			log.Fatalf("max idle time %s must be greater than ping interval %s", c.MaxIdleTime, c.PingInterval)
+		}
+		if c.NodeLease <= c.NodeHeartbeatInterval {
+			log.Fatalf("node lease %s must be greater than heartbeat interval %s", c.NodeLease, c.NodeHeartbeatInterval)
+		}
 	})
 	return &c
 }
@@ -17,21 +17,34 @@ func main() {
 	// APP configuration
 	c := config.Get()
 
-	// Redis client
-	rdb := redis.NewClient(&redis.Options{
-		Addr:     c.RedisAddr,
-		Password: c.RedisPassword,
-		DB:       c.RedisDB,
-	})
-	err := rdb.Ping().Err()
-	if err != nil {
-		log.Fatal(err)
+	// Redis client, not needed when everything is kept in memory
+	var rdb *redis.Client
+	if c.StorageDriver == config.DriverRedis || c.BrokerDriver == config.DriverRedis {
+		rdb = redis.NewClient(&redis.Options{
+			Addr:     c.RedisAddr,
+			Password: c.RedisPassword,
+			DB:       c.RedisDB,
+		})
+		err := rdb.Ping().Err()
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	// Storage
-	s := storage.New(rdb)
 	// Message broker
-	mb := msgbroker.NewRedisBroker(rdb)
+	var mb msgbroker.MessageBroker
+	if c.BrokerDriver == config.DriverMemory {
+		mb = msgbroker.NewMemoryBroker()
+	} else {
+		mb = msgbroker.NewRedisBroker(rdb)
+	}
+	// Storage, the memory one publishes the room events with the message broker
+	var s storage.Storage
+	if c.StorageDriver == config.DriverMemory {
+		s = storage.NewMemory(c.MemoryCleanupInterval, mb)
+	} else {
+		s = storage.New(rdb)
+	}
 
 	// API
 	a := api.New(c, s, mb)
@@ -43,14 +56,15 @@ func main() {
 		}
 	}()
 
-	signals := make(chan os.Signal)
+	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, os.Interrupt, os.Kill)
 	// waiting for signals
 	quit := <-signals
 	log.Infof("signal %s received, stopping server...", quit)
 	// Stopping server
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
-	if err = a.Close(ctx); err != nil {
+	err := a.Close(ctx)
+	if err != nil {
 		log.Error(err)
 	}
 	cancel()
@@ -58,7 +72,12 @@ func main() {
 	if err = mb.Close(); err != nil {
 		log.Error(err)
 	}
-	if err = rdb.Close(); err != nil {
+	if err = s.Close(); err != nil {
 		log.Error(err)
 	}
+	if rdb != nil {
+		if err = rdb.Close(); err != nil {
+			log.Error(err)
+		}
+	}
 }
@@ -1,28 +1,208 @@
 package model
 
 import (
-	"net"
 	"smotri.me/pkg/utils"
+	"smotri.me/pkg/wsconn"
+	"time"
 )
 
 type (
 	Room struct {
-		ID       string  `json:"id"`
-		Title    string  `json:"title"`
-		VideoURL string  `json:"video_url"`
-		Members  []*User `json:"members"`
+		ID       string    `json:"id"`
+		Title    string    `json:"title"`
+		VideoURL string    `json:"video_url"`
+		Members  []*User   `json:"members"`
+		Playback *Playback `json:"playback"`
+		// HostToken grants host role to its holder, it is revealed only to the room creator
+		HostToken string `json:"host_token,omitempty"`
+		// ControlPolicy defines who can control the playback and update the room
+		ControlPolicy string        `json:"control_policy"`
+		Chat          *ChatSettings `json:"chat"`
+	}
+
+	// ChatSettings are the anti-spam settings of the room chat, set by the host
+	ChatSettings struct {
+		// SlowMode is the min number of seconds between chat messages of a member, zero disables it.
+		// The host and co-hosts are not limited
+		SlowMode int `json:"slow_mode"`
+		// LinkPolicy defines who can post links
+		LinkPolicy string `json:"link_policy"`
+	}
+
+	// LastMessage is what the anti-spam filters remember of the last chat message of a member
+	LastMessage struct {
+		// Digest identifies the normalized content of the message
+		Digest string `json:"digest"`
+		// CreatedAt is the unix time in milliseconds
+		CreatedAt int64 `json:"created_at"`
+	}
+
+	// Playback is the video playback state of a room
+	Playback struct {
+		// Position is the video position in seconds at UpdatedAt
+		Position float64 `json:"position"`
+		Playing  bool    `json:"playing"`
+		Rate     float64 `json:"rate"`
+		// UpdatedAt is the unix time in milliseconds
+		UpdatedAt int64 `json:"updated_at"`
+	}
+
+	// PlaybackUpdate is a change of the playback state, nil fields are left unchanged
+	PlaybackUpdate struct {
+		Position float64
+		Playing  *bool
+		Rate     *float64
+		// UpdatedAt is the unix time in milliseconds of the update
+		UpdatedAt int64
 	}
 
 	User struct {
-		ID     string   `json:"id"`
-		Name   string   `json:"name"`
-		RoomID string   `json:"room_id"`
-		Color  string   `json:"color"`
-		Time   int      `json:"time"`
-		Conn   net.Conn `json:"-"`
+		ID     string       `json:"id"`
+		Name   string       `json:"name"`
+		RoomID string       `json:"room_id"`
+		Color  string       `json:"color"`
+		Time   int          `json:"time"`
+		Role   string       `json:"role"`
+		Conn   *wsconn.Conn `json:"-"`
+		// NodeID is the ID of the API instance serving the user connection
+		NodeID string `json:"-"`
+		// ResumeToken lets the user restore the identity after reconnect, it is single-use
+		ResumeToken string `json:"-"`
+		// Protocol is the websocket subprotocol negotiated by the user connection, it defines the message encoding
+		Protocol string `json:"-"`
+		// IP is the client address of the user connection
+		IP string `json:"-"`
 	}
+
+	// Session is the identity of the disconnected member kept for resumption
+	Session struct {
+		User *User `json:"user"`
+		// Seq is the room broadcast seq at the disconnect, broadcasts following it were missed
+		Seq int64 `json:"seq"`
+		// IP is the client address of the disconnected connection, so the member can be banned by it
+		IP string `json:"ip,omitempty"`
+	}
+
+	// ChatMessage is a chat message kept in the room history
+	ChatMessage struct {
+		ID     string `json:"id"`
+		UserID string `json:"user_id"`
+		Name   string `json:"name"`
+		Color  string `json:"color"`
+		// Content is the message text
+		Content string `json:"content"`
+		// CreatedAt is the unix time in milliseconds
+		CreatedAt int64 `json:"created_at"`
+		// Seq is the position of the message in the room history, used as pagination cursor
+		Seq int64 `json:"seq"`
+		// EditedAt is the unix time in milliseconds of the last edit, zero if the message was not edited
+		EditedAt int64 `json:"edited_at,omitempty"`
+		// Edits are the previous versions of the message content, oldest first
+		Edits []*MessageEdit `json:"edits,omitempty"`
+	}
+
+	// Ban keeps the member out of the room for the room lifetime,
+	// the member is recognized by any of the user ID, the resume token and the IP
+	Ban struct {
+		UserID string `json:"user_id"`
+		Name   string `json:"name"`
+		Reason string `json:"reason,omitempty"`
+		// ResumeToken and IP are known only to the instance serving the member connection,
+		// they are added to the ban once the member is disconnected
+		ResumeToken string `json:"resume_token,omitempty"`
+		IP          string `json:"ip,omitempty"`
+		// CreatedAt is the unix time in milliseconds
+		CreatedAt int64 `json:"created_at"`
+	}
+
+	// MessageEdit is a previous version of the edited chat message content
+	MessageEdit struct {
+		Content string `json:"content"`
+		// EditedAt is the unix time in milliseconds the content was replaced
+		EditedAt int64 `json:"edited_at"`
+	}
+)
+
+// MaxMessageEdits is the max number of previous versions kept per chat message
+const MaxMessageEdits = 20
+
+// Room control policies
+const (
+	// Any member can control the room
+	PolicyEveryone = "everyone"
+	// Only host and co-hosts can control the room
+	PolicyHost = "host"
+)
+
+// Member roles
+const (
+	RoleHost   = "host"
+	RoleCohost = "cohost"
+	RoleMember = "member"
 )
 
 func (r *Room) Valid() bool {
-	return utils.IsLengthValid(r.Title, 2, 100) && utils.IsUrlValid(r.VideoURL)
+	return utils.IsLengthValid(r.Title, 2, 100) && utils.IsUrlValid(r.VideoURL) &&
+		(r.ControlPolicy == "" || IsPolicyValid(r.ControlPolicy))
+}
+
+func IsPolicyValid(policy string) bool {
+	return policy == PolicyEveryone || policy == PolicyHost
+}
+
+// Privileged reports whether the role allows to control the room regardless of the policy
+func Privileged(role string) bool {
+	return role == RoleHost || role == RoleCohost
+}
+
+// NewPlayback returns the initial playback state: paused at the beginning with normal rate
+func NewPlayback() *Playback {
+	return &Playback{Rate: 1, UpdatedAt: utils.UnixMilli(time.Now())}
+}
+
+// NewChatSettings returns the initial chat settings: no slow mode and links allowed to everyone
+func NewChatSettings() *ChatSettings {
+	return &ChatSettings{LinkPolicy: PolicyEveryone}
+}
+
+// At returns the playback state extrapolated to the given time
+func (p *Playback) At(now time.Time) *Playback {
+	c := *p
+	c.UpdatedAt = utils.UnixMilli(now)
+	if p.Playing && c.UpdatedAt > p.UpdatedAt {
+		c.Position += float64(c.UpdatedAt-p.UpdatedAt) / 1000 * p.Rate
+	}
+	return &c
+}
+
+// Apply returns the playback state changed by the update, the update time never goes back
+func (p Playback) Apply(u *PlaybackUpdate) *Playback {
+	p.Position = u.Position
+	if u.Playing != nil {
+		p.Playing = *u.Playing
+	}
+	if u.Rate != nil {
+		p.Rate = *u.Rate
+	}
+	if u.UpdatedAt > p.UpdatedAt {
+		p.UpdatedAt = u.UpdatedAt
+	}
+	return &p
+}
+
+// Edit replaces the message content keeping the previous one in the edit history
+func (m *ChatMessage) Edit(content string, editedAt int64) {
+	m.Edits = append(m.Edits, &MessageEdit{Content: m.Content, EditedAt: editedAt})
+	if excess := len(m.Edits) - MaxMessageEdits; excess > 0 {
+		m.Edits = append(m.Edits[:0:0], m.Edits[excess:]...)
+	}
+	m.Content = content
+	m.EditedAt = editedAt
+}
+
+// Matches reports whether the ban applies to the user with the ID, resume token or IP, empty ones match nothing
+func (b *Ban) Matches(userID, resumeToken, ip string) bool {
+	return (userID != "" && b.UserID == userID) ||
+		(resumeToken != "" && b.ResumeToken == resumeToken) ||
+		(ip != "" && b.IP == ip)
 }
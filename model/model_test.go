@@ -0,0 +1,60 @@
+package model
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestPlaybackAt(t *testing.T) {
+	start := time.Unix(1000, 0)
+	p := &Playback{Position: 10, Playing: true, Rate: 2, UpdatedAt: start.Unix() * 1000}
+
+	current := p.At(start.Add(1500 * time.Millisecond))
+	assert.Equal(t, 13.0, current.Position)
+	assert.Equal(t, start.Add(1500*time.Millisecond).Unix()*1000+500, current.UpdatedAt)
+	assert.Equal(t, 10.0, p.Position, "original state must not change")
+
+	p.Playing = false
+	assert.Equal(t, 10.0, p.At(start.Add(time.Minute)).Position)
+}
+
+func TestPlaybackApply(t *testing.T) {
+	p := &Playback{Position: 10, Playing: true, Rate: 2, UpdatedAt: 1000}
+	rate := 1.5
+	updated := p.Apply(&PlaybackUpdate{Position: 20, Rate: &rate, UpdatedAt: 2000})
+	assert.Equal(t, &Playback{Position: 20, Playing: true, Rate: 1.5, UpdatedAt: 2000}, updated)
+	assert.Equal(t, 10.0, p.Position, "original state must not change")
+
+	playing := false
+	updated = updated.Apply(&PlaybackUpdate{Position: 5, Playing: &playing, UpdatedAt: 1500})
+	assert.Equal(t, &Playback{Position: 5, Playing: false, Rate: 1.5, UpdatedAt: 2000}, updated)
+}
+
+func TestChatMessageEdit(t *testing.T) {
+	m := &ChatMessage{Content: "v0", CreatedAt: 1}
+	m.Edit("v1", 10)
+	m.Edit("v2", 20)
+	assert.Equal(t, "v2", m.Content)
+	assert.Equal(t, int64(20), m.EditedAt)
+	assert.Equal(t, []*MessageEdit{{Content: "v0", EditedAt: 10}, {Content: "v1", EditedAt: 20}}, m.Edits)
+
+	for i := 0; i < MaxMessageEdits; i++ {
+		m.Edit("next", int64(30+i))
+	}
+	assert.Len(t, m.Edits, MaxMessageEdits)
+	assert.Equal(t, "v2", m.Edits[0].Content, "the oldest versions are dropped")
+}
+
+func TestBanMatches(t *testing.T) {
+	b := &Ban{UserID: "user", ResumeToken: "token", IP: "10.0.0.1"}
+	assert.True(t, b.Matches("user", "", ""))
+	assert.True(t, b.Matches("other", "token", ""))
+	assert.True(t, b.Matches("", "", "10.0.0.1"))
+	assert.False(t, b.Matches("other", "other", "10.0.0.2"))
+
+	// identities the ban does not know match nothing
+	b = &Ban{UserID: "user"}
+	assert.False(t, b.Matches("", "", ""))
+	assert.False(t, b.Matches("other", "", "10.0.0.1"))
+}
@@ -0,0 +1,369 @@
+package jsonschema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Draft is the JSON Schema version of the generated documents
+const Draft = "http://json-schema.org/draft-07/schema#"
+
+// Schema is the JSON Schema document, only the keywords used by the generator are supported
+type Schema struct {
+	Schema               string             `json:"$schema,omitempty"`
+	Ref                  string             `json:"$ref,omitempty"`
+	Title                string             `json:"title,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Const                interface{}        `json:"const,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	ExclusiveMinimum     *float64           `json:"exclusiveMinimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+	Definitions          map[string]*Schema `json:"definitions,omitempty"`
+	AllOf                []*Schema          `json:"allOf,omitempty"`
+	AnyOf                []*Schema          `json:"anyOf,omitempty"`
+	If                   *Schema            `json:"if,omitempty"`
+	Then                 *Schema            `json:"then,omitempty"`
+}
+
+// Error describes the invalid field, Field is empty if the document as a whole is invalid
+type Error struct {
+	Field   string
+	Message string
+}
+
+// Validator is implemented by the types with checks not expressible by the schema tags,
+// Validate is called after the tag constraints are satisfied
+type Validator interface {
+	Validate() error
+}
+
+// Extender is implemented by the types with constraints not expressible by the schema tags,
+// e.g. defined by constants, ExtendSchema adjusts the reflected schema of the type
+type Extender interface {
+	ExtendSchema(s *Schema)
+}
+
+// field is the JSON property of a struct field
+type field struct {
+	name     string
+	index    []int
+	required bool
+	tag      map[string]string
+}
+
+var (
+	fieldsCache   sync.Map
+	patternsCache sync.Map
+
+	rawMessageType = reflect.TypeOf(json.RawMessage(nil))
+	extenderType   = reflect.TypeOf((*Extender)(nil)).Elem()
+)
+
+func (e *Error) Error() string {
+	if e.Field == "" {
+		return e.Message
+	}
+	return fmt.Sprintf("'%s' %s", e.Field, e.Message)
+}
+
+// Reflect returns the schema of the value type. Struct fields are described by their json tags and
+// the constraints of the schema tag, e.g. `schema:"minimum=0;maximum=4"`, pointer and omitempty fields are optional.
+// Supported constraints: minimum, exclusiveMinimum, maximum, minLength, maxLength, pattern, enum (values separated by |),
+// format and description. json.RawMessage is described as any value, Extender types adjust their schema
+func Reflect(v interface{}) *Schema {
+	return reflectType(reflect.TypeOf(v))
+}
+
+func reflectType(t reflect.Type) *Schema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == rawMessageType {
+		return &Schema{}
+	}
+	s := &Schema{Type: typeName(t)}
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array:
+		s.Items = reflectType(t.Elem())
+	case reflect.Struct:
+		closed := false
+		s.AdditionalProperties = &closed
+		s.Properties = make(map[string]*Schema)
+		for _, f := range structFields(t) {
+			prop := reflectType(t.FieldByIndex(f.index).Type)
+			applyTag(prop, f.tag)
+			s.Properties[f.name] = prop
+			if f.required {
+				s.Required = append(s.Required, f.name)
+			}
+		}
+	}
+	if reflect.PtrTo(t).Implements(extenderType) {
+		reflect.New(t).Interface().(Extender).ExtendSchema(s)
+	}
+	return s
+}
+
+// Returns the JSON type name of the Go type
+func typeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeName(t.Elem())
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Struct, reflect.Map:
+		return "object"
+	}
+	return ""
+}
+
+func applyTag(s *Schema, tag map[string]string) {
+	for key, value := range tag {
+		switch key {
+		case "minimum":
+			s.Minimum = parseFloat(value)
+		case "exclusiveMinimum":
+			s.ExclusiveMinimum = parseFloat(value)
+		case "maximum":
+			s.Maximum = parseFloat(value)
+		case "minLength":
+			s.MinLength = parseInt(value)
+		case "maxLength":
+			s.MaxLength = parseInt(value)
+		case "pattern":
+			s.Pattern = value
+		case "format":
+			s.Format = value
+		case "description":
+			s.Description = value
+		case "enum":
+			for _, v := range strings.Split(value, "|") {
+				s.Enum = append(s.Enum, v)
+			}
+		}
+	}
+}
+
+// Returns the JSON properties of the struct type, embedded structs are flattened
+func structFields(t reflect.Type) []field {
+	if cached, ok := fieldsCache.Load(t); ok {
+		return cached.([]field)
+	}
+	var fields []field
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		name, opts := sf.Tag.Get("json"), ""
+		if comma := strings.Index(name, ","); comma >= 0 {
+			name, opts = name[:comma], name[comma:]
+		}
+		if name == "-" {
+			continue
+		}
+		if sf.Anonymous && name == "" && sf.Type.Kind() == reflect.Struct {
+			for _, f := range structFields(sf.Type) {
+				f.index = append([]int{i}, f.index...)
+				fields = append(fields, f)
+			}
+			continue
+		}
+		if sf.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		fields = append(fields, field{
+			name:     name,
+			index:    []int{i},
+			required: sf.Type.Kind() != reflect.Ptr && !strings.Contains(opts, ",omitempty"),
+			tag:      parseTag(sf.Tag.Get("schema")),
+		})
+	}
+	fieldsCache.Store(t, fields)
+	return fields
+}
+
+func parseTag(tag string) map[string]string {
+	result := make(map[string]string)
+	for _, pair := range strings.Split(tag, ";") {
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) == 2 {
+			result[kv[0]] = kv[1]
+		}
+	}
+	return result
+}
+
+func parseFloat(s string) *float64 {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		panic(fmt.Sprintf("jsonschema: invalid number '%s' in the schema tag", s))
+	}
+	return &f
+}
+
+func parseInt(s string) *int {
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		panic(fmt.Sprintf("jsonschema: invalid integer '%s' in the schema tag", s))
+	}
+	return &i
+}
+
+// Decode decodes the JSON object into the struct pointed by v and checks it against the schema of the struct:
+// unknown, mistyped and missing required fields are rejected as well as the values violating the constraints.
+// Empty data and null are decoded as an empty object. The returned error is *Error
+func Decode(data []byte, v interface{}) error {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || bytes.Equal(data, []byte("null")) {
+		data = []byte("{}")
+	}
+	var present map[string]json.RawMessage
+	if err := json.Unmarshal(data, &present); err != nil {
+		return &Error{Message: "must be object"}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return decodeError(err)
+	}
+
+	rv := reflect.ValueOf(v).Elem()
+	for _, f := range structFields(rv.Type()) {
+		raw, exists := present[f.name]
+		if f.required && (!exists || bytes.Equal(raw, []byte("null"))) {
+			return &Error{Field: f.name, Message: fmt.Sprintf("is required and must be %s", typeName(rv.FieldByIndex(f.index).Type()))}
+		}
+		if !exists {
+			continue
+		}
+		if err := check(rv.FieldByIndex(f.index), f); err != nil {
+			return err
+		}
+	}
+
+	if validator, ok := v.(Validator); ok {
+		if err := validator.Validate(); err != nil {
+			if _, ok := err.(*Error); !ok {
+				err = &Error{Message: err.Error()}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Converts the decoder error to *Error
+func decodeError(err error) error {
+	switch e := err.(type) {
+	case *json.UnmarshalTypeError:
+		return &Error{Field: e.Field, Message: fmt.Sprintf("must be %s, got %s", typeName(e.Type), e.Value)}
+	case *json.SyntaxError:
+		return &Error{Message: e.Error()}
+	}
+	const unknownPrefix = "json: unknown field "
+	if msg := err.Error(); strings.HasPrefix(msg, unknownPrefix) {
+		name, _ := strconv.Unquote(strings.TrimPrefix(msg, unknownPrefix))
+		return &Error{Field: name, Message: "is unknown"}
+	}
+	return &Error{Message: err.Error()}
+}
+
+// Checks the decoded value against the constraints of the field tag
+func check(v reflect.Value, f field) error {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	fail := func(format string, args ...interface{}) error {
+		return &Error{Field: f.name, Message: fmt.Sprintf(format, args...)}
+	}
+
+	var number float64
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		number = float64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		number = float64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		number = v.Float()
+	case reflect.String:
+		return checkString(v.String(), f.tag, fail)
+	default:
+		return nil
+	}
+	if min, ok := f.tag["minimum"]; ok && number < *parseFloat(min) {
+		return fail("must be greater than or equal to %s", min)
+	}
+	if min, ok := f.tag["exclusiveMinimum"]; ok && number <= *parseFloat(min) {
+		return fail("must be greater than %s", min)
+	}
+	if max, ok := f.tag["maximum"]; ok && number > *parseFloat(max) {
+		return fail("must be less than or equal to %s", max)
+	}
+	return nil
+}
+
+func checkString(s string, tag map[string]string, fail func(format string, args ...interface{}) error) error {
+	length := utf8.RuneCountInString(s)
+	if min, ok := tag["minLength"]; ok && length < *parseInt(min) {
+		return fail("must be at least %s characters long", min)
+	}
+	if max, ok := tag["maxLength"]; ok && length > *parseInt(max) {
+		return fail("must be at most %s characters long", max)
+	}
+	if enum, ok := tag["enum"]; ok {
+		valid := false
+		for _, v := range strings.Split(enum, "|") {
+			valid = valid || v == s
+		}
+		if !valid {
+			return fail("must be one of: %s", strings.Replace(enum, "|", ", ", -1))
+		}
+	}
+	if pattern, ok := tag["pattern"]; ok && !compile(pattern).MatchString(s) {
+		return fail("must match the pattern '%s'", pattern)
+	}
+	return nil
+}
+
+func compile(pattern string) *regexp.Regexp {
+	if cached, ok := patternsCache.Load(pattern); ok {
+		return cached.(*regexp.Regexp)
+	}
+	re := regexp.MustCompile(pattern)
+	patternsCache.Store(pattern, re)
+	return re
+}
@@ -0,0 +1,116 @@
+package jsonschema
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+type (
+	base struct {
+		ID string `json:"id" schema:"minLength=1"`
+	}
+
+	item struct {
+		base
+		Title  string   `json:"title" schema:"maxLength=5;description=Short title"`
+		Kind   string   `json:"kind,omitempty" schema:"enum=a|b"`
+		Rate   *float64 `json:"rate,omitempty" schema:"exclusiveMinimum=0;maximum=4"`
+		Count  int      `json:"count,omitempty" schema:"minimum=1"`
+		Tags   []string `json:"tags,omitempty"`
+		Code   string   `json:"code,omitempty" schema:"pattern=^[0-9]+$"`
+		hidden string
+	}
+)
+
+// extended has the pattern defined by a constant
+type extended struct {
+	Code  string          `json:"code"`
+	Extra json.RawMessage `json:"extra,omitempty" schema:"description=Anything"`
+}
+
+const codePattern = "^[a-z]+$"
+
+func (e *extended) ExtendSchema(s *Schema) {
+	s.Properties["code"].Pattern = codePattern
+}
+
+func (i *item) Validate() error {
+	if i.Title == "nope" {
+		return errors.New("title is forbidden")
+	}
+	return nil
+}
+
+func TestReflect(t *testing.T) {
+	b, err := json.Marshal(Reflect(&item{}))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"type": "object",
+		"additionalProperties": false,
+		"required": ["id", "title"],
+		"properties": {
+			"id": {"type": "string", "minLength": 1},
+			"title": {"type": "string", "maxLength": 5, "description": "Short title"},
+			"kind": {"type": "string", "enum": ["a", "b"]},
+			"rate": {"type": "number", "exclusiveMinimum": 0, "maximum": 4},
+			"count": {"type": "integer", "minimum": 1},
+			"tags": {"type": "array", "items": {"type": "string"}},
+			"code": {"type": "string", "pattern": "^[0-9]+$"}
+		}
+	}`, string(b))
+}
+
+func TestReflectExtended(t *testing.T) {
+	b, err := json.Marshal(Reflect([]extended{}))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"type": "array",
+		"items": {
+			"type": "object",
+			"additionalProperties": false,
+			"required": ["code"],
+			"properties": {
+				"code": {"type": "string", "pattern": "^[a-z]+$"},
+				"extra": {"description": "Anything"}
+			}
+		}
+	}`, string(b))
+}
+
+func TestDecode(t *testing.T) {
+	cases := []struct {
+		data, err string
+	}{
+		{`{"id": "1", "title": "hi"}`, ""},
+		{`{"id": "1", "title": "hi", "rate": 1.5, "count": 2, "kind": "b", "tags": ["x"], "code": "42"}`, ""},
+		{`{"id": "1", "title": "hi", "extra": 1}`, "'extra' is unknown"},
+		{`{"id": 1, "title": "hi"}`, "'id' must be string, got number"},
+		{`{"id": "1", "title": "hi", "count": 1.5}`, "'count' must be integer, got number 1.5"},
+		{`{"id": "1", "title": "hi", "tags": [1]}`, "'tags.0' must be string, got number"},
+		{`{"title": "hi"}`, "'id' is required and must be string"},
+		{`{"id": null, "title": "hi"}`, "'id' is required and must be string"},
+		{`{"id": "", "title": "hi"}`, "'id' must be at least 1 characters long"},
+		{`{"id": "1", "title": "привет"}`, "'title' must be at most 5 characters long"},
+		{`{"id": "1", "title": "hi", "kind": "c"}`, "'kind' must be one of: a, b"},
+		{`{"id": "1", "title": "hi", "rate": 0}`, "'rate' must be greater than 0"},
+		{`{"id": "1", "title": "hi", "rate": 4.5}`, "'rate' must be less than or equal to 4"},
+		{`{"id": "1", "title": "hi", "count": 0}`, "'count' must be greater than or equal to 1"},
+		{`{"id": "1", "title": "hi", "code": "x1"}`, "'code' must match the pattern '^[0-9]+$'"},
+		{`{"id": "1", "title": "nope"}`, "title is forbidden"},
+		{`[]`, "must be object"},
+		{``, "'id' is required and must be string"},
+	}
+	for _, c := range cases {
+		var i item
+		err := Decode([]byte(c.data), &i)
+		if c.err == "" {
+			assert.NoError(t, err, c.data)
+			continue
+		}
+		require.IsType(t, &Error{}, err, c.data)
+		assert.Equal(t, c.err, err.Error(), c.data)
+	}
+}
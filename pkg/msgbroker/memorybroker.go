@@ -0,0 +1,211 @@
+package msgbroker
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrClosed is returned by operations on a closed broker
+var ErrClosed = errors.New("message broker is closed")
+
+// memoryBroker is the implementation of MessageBroker delivering messages within the process,
+// it follows the redis PUBLISH/PSUBSCRIBE semantics
+type memoryBroker struct {
+	sync.RWMutex
+	handlers map[string]MessageHandler
+	queue    chan delivery
+	closed   bool
+	done     chan struct{}
+	// stopped is closed once the dispatcher returns
+	stopped chan struct{}
+}
+
+type delivery struct {
+	handler MessageHandler
+	msg     *Message
+}
+
+// NewMemoryBroker returns an in-process implementation of MessageBroker
+func NewMemoryBroker() MessageBroker {
+	mb := &memoryBroker{
+		handlers: make(map[string]MessageHandler),
+		queue:    make(chan delivery, 1024),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go mb.serveMessages()
+	return mb
+}
+
+// Calls handlers one by one, so messages are delivered in the publishing order
+func (mb *memoryBroker) serveMessages() {
+	defer close(mb.stopped)
+	for {
+		select {
+		case <-mb.done:
+			return
+		case d := <-mb.queue:
+			d.handler(d.msg)
+		}
+	}
+}
+
+// Close stops the delivery and waits for the running handler, so it must not be called from a handler
+func (mb *memoryBroker) Close() error {
+	mb.Lock()
+	if mb.closed {
+		mb.Unlock()
+		return ErrClosed
+	}
+	mb.closed = true
+	close(mb.done)
+	mb.Unlock()
+	<-mb.stopped
+	return nil
+}
+
+func (mb *memoryBroker) Publish(msg []byte, channel string) error {
+	mb.RLock()
+	if mb.closed {
+		mb.RUnlock()
+		return ErrClosed
+	}
+	var deliveries []delivery
+	for pattern, handler := range mb.handlers {
+		if matchPattern(pattern, channel) {
+			deliveries = append(deliveries, delivery{
+				handler: handler,
+				msg:     &Message{Channel: channel, Data: msg},
+			})
+		}
+	}
+	mb.RUnlock()
+
+	if len(deliveries) == 0 {
+		return errors.New("no recipients")
+	}
+	for _, d := range deliveries {
+		select {
+		case mb.queue <- d:
+		case <-mb.done:
+			return ErrClosed
+		}
+	}
+	return nil
+}
+
+func (mb *memoryBroker) Subscribe(pattern string, cb MessageHandler) error {
+	mb.Lock()
+	defer mb.Unlock()
+	if mb.closed {
+		return ErrClosed
+	}
+	mb.handlers[pattern] = cb
+	return nil
+}
+
+func (mb *memoryBroker) Unsubscribe(patterns ...string) error {
+	mb.Lock()
+	defer mb.Unlock()
+	if mb.closed {
+		return ErrClosed
+	}
+	for _, p := range patterns {
+		delete(mb.handlers, p)
+	}
+	return nil
+}
+
+// matchPattern reports whether str matches the glob-style pattern the same way redis does:
+// '*' matches any sequence, '?' matches a single char, '[...]' matches a char class
+// (with '^' negation and 'a-z' ranges) and '\' escapes the next char
+func matchPattern(pattern, str string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(str); i++ {
+				if matchPattern(pattern[1:], str[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(str) == 0 {
+				return false
+			}
+			str = str[1:]
+		case '[':
+			if len(str) == 0 {
+				return false
+			}
+			// matchClass leaves pattern on the closing bracket
+			var matched bool
+			matched, pattern = matchClass(pattern[1:], str[0])
+			if !matched {
+				return false
+			}
+			str = str[1:]
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(str) == 0 || pattern[0] != str[0] {
+				return false
+			}
+			str = str[1:]
+		}
+		if len(pattern) == 0 {
+			break
+		}
+		pattern = pattern[1:]
+	}
+	return len(str) == 0
+}
+
+// Matches c against a char class, pattern starts right after '['.
+// Returns the result and the pattern positioned on the closing ']' (or the last char if unterminated)
+func matchClass(pattern string, c byte) (bool, string) {
+	not := len(pattern) > 0 && pattern[0] == '^'
+	if not {
+		pattern = pattern[1:]
+	}
+	matched := false
+	for len(pattern) > 0 {
+		switch {
+		case pattern[0] == '\\' && len(pattern) >= 2:
+			pattern = pattern[1:]
+			if pattern[0] == c {
+				matched = true
+			}
+		case pattern[0] == ']':
+			return matched != not, pattern
+		case len(pattern) >= 3 && pattern[1] == '-':
+			start, end := pattern[0], pattern[2]
+			if start > end {
+				start, end = end, start
+			}
+			pattern = pattern[2:]
+			if c >= start && c <= end {
+				matched = true
+			}
+		default:
+			if pattern[0] == c {
+				matched = true
+			}
+		}
+		if len(pattern) == 1 {
+			// unterminated class, redis treats the end of the pattern as ']'
+			return matched != not, pattern
+		}
+		pattern = pattern[1:]
+	}
+	return matched != not, pattern
+}
@@ -13,6 +13,7 @@ type MessageBroker interface {
 }
 
 // MessageHandler is a callback function that processes messages delivered to subscribers.
+// Handlers are called one by one in the publishing order, so they must not block
 type MessageHandler func(msg *Message)
 
 // Message is the representation of transmitted data
@@ -0,0 +1,221 @@
+package msgbroker
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v7"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Starts a broker implementation for tests, returns the broker and a function releasing resources
+type backend func(t *testing.T) (MessageBroker, func())
+
+var backends = map[string]backend{
+	"redis": func(t *testing.T) (MessageBroker, func()) {
+		mr, err := miniredis.Run()
+		require.NoError(t, err)
+		rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+		mb := NewRedisBroker(rdb)
+		return mb, func() {
+			_ = mb.Close()
+			_ = rdb.Close()
+			mr.Close()
+		}
+	},
+	"memory": func(t *testing.T) (MessageBroker, func()) {
+		mb := NewMemoryBroker()
+		return mb, func() { _ = mb.Close() }
+	},
+}
+
+func forEachBackend(t *testing.T, test func(t *testing.T, mb MessageBroker)) {
+	for name, b := range backends {
+		t.Run(name, func(t *testing.T) {
+			mb, stop := b(t)
+			defer stop()
+			test(t, mb)
+		})
+	}
+}
+
+// recorder collects messages delivered to a handler
+type recorder struct {
+	sync.Mutex
+	messages []*Message
+}
+
+func (r *recorder) handle(msg *Message) {
+	r.Lock()
+	r.messages = append(r.messages, msg)
+	r.Unlock()
+}
+
+func (r *recorder) data() []string {
+	r.Lock()
+	defer r.Unlock()
+	var result []string
+	for _, m := range r.messages {
+		result = append(result, m.Channel+"="+string(m.Data))
+	}
+	return result
+}
+
+func (r *recorder) reset() {
+	r.Lock()
+	r.messages = nil
+	r.Unlock()
+}
+
+// Subscribes and waits until the subscription becomes active,
+// redis confirms subscriptions asynchronously
+func subscribe(t *testing.T, mb MessageBroker, pattern, probeChannel string, r *recorder) {
+	require.NoError(t, mb.Subscribe(pattern, r.handle))
+	require.Eventually(t, func() bool {
+		_ = mb.Publish([]byte("probe"), probeChannel)
+		time.Sleep(5 * time.Millisecond)
+		return len(r.data()) > 0
+	}, time.Second, 5*time.Millisecond)
+	r.reset()
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, mb MessageBroker) {
+		var rooms, users recorder
+		subscribe(t, mb, "messages:*", "messages:probe", &rooms)
+		subscribe(t, mb, "users:a?c", "users:abc", &users)
+
+		require.NoError(t, mb.Publish([]byte("1"), "messages:abc"))
+		require.NoError(t, mb.Publish([]byte("2"), "messages:xyz"))
+		require.NoError(t, mb.Publish([]byte("3"), "users:aXc"))
+		assert.Error(t, mb.Publish([]byte("4"), "users:abcd"))
+		assert.Error(t, mb.Publish([]byte("5"), "other:abc"))
+
+		assert.Eventually(t, func() bool {
+			return len(rooms.data()) == 2 && len(users.data()) == 1
+		}, time.Second, 5*time.Millisecond)
+		assert.ElementsMatch(t, []string{"messages:abc=1", "messages:xyz=2"}, rooms.data())
+		assert.Equal(t, []string{"users:aXc=3"}, users.data())
+	})
+}
+
+// Redis delivers a message once per matching pattern,
+// miniredis does not support that, so only the memory broker is checked
+func TestOverlappingPatterns(t *testing.T) {
+	mb := NewMemoryBroker()
+	defer mb.Close()
+	var all, abc recorder
+	subscribe(t, mb, "messages:*", "messages:probe", &all)
+	subscribe(t, mb, "messages:a?c", "messages:abc", &abc)
+	all.reset()
+
+	require.NoError(t, mb.Publish([]byte("1"), "messages:abc"))
+	assert.Eventually(t, func() bool {
+		return len(all.data()) == 1 && len(abc.data()) == 1
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestDeliveryOrder(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, mb MessageBroker) {
+		var r recorder
+		subscribe(t, mb, "messages:*", "messages:probe", &r)
+
+		var expected []string
+		for i := 0; i < 100; i++ {
+			data := strconv.Itoa(i)
+			expected = append(expected, "messages:abc="+data)
+			require.NoError(t, mb.Publish([]byte(data), "messages:abc"))
+		}
+		assert.Eventually(t, func() bool {
+			return len(r.data()) == len(expected)
+		}, time.Second, 5*time.Millisecond)
+		assert.Equal(t, expected, r.data())
+	})
+}
+
+func TestUnsubscribe(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, mb MessageBroker) {
+		var r recorder
+		subscribe(t, mb, "messages:*", "messages:probe", &r)
+
+		require.NoError(t, mb.Unsubscribe("messages:*"))
+		require.Eventually(t, func() bool {
+			return mb.Publish([]byte("1"), "messages:abc") != nil
+		}, time.Second, 5*time.Millisecond)
+		time.Sleep(20 * time.Millisecond)
+		assert.Empty(t, r.data())
+	})
+}
+
+func TestClose(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, mb MessageBroker) {
+		var r recorder
+		subscribe(t, mb, "messages:*", "messages:probe", &r)
+		require.NoError(t, mb.Close())
+		assert.Error(t, mb.Subscribe("other:*", r.handle))
+	})
+}
+
+func TestMatchPattern(t *testing.T) {
+	cases := []struct {
+		pattern, str string
+		match        bool
+	}{
+		{"messages:*", "messages:abc", true},
+		{"messages:*", "messages:", true},
+		{"messages:*", "messages", false},
+		{"messages:*", "users:abc", false},
+		{"*", "", true},
+		{"**", "anything", true},
+		{"*:abc", "messages:abc", true},
+		{"*:abc", "messages:abd", false},
+		{"a*b*c", "aXXbYYc", true},
+		{"a*b*c", "aXXbYY", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[c-a]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{"h[\\]]llo", "h]llo", true},
+		{"h[ab", "hb", true},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"messages:abc", "messages:abc", true},
+		{"messages:abc", "messages:abcd", false},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.match, matchPattern(c.pattern, c.str), "pattern %q, str %q", c.pattern, c.str)
+	}
+}
+
+// Checks that the pattern matching of the memory broker agrees with redis
+func TestMatchPatternAgreesWithRedis(t *testing.T) {
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+	defer mr.Close()
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	keys := []string{"messages:abc", "messages:xyz", "messages:", "users:abc", "hello", "hallo", "h*llo"}
+	for _, k := range keys {
+		require.NoError(t, rdb.Set(k, 1, 0).Err())
+	}
+	for _, pattern := range []string{"messages:*", "*:abc", "h?llo", "h[ae]llo", "h[^e]llo", "h\\*llo", "m*:[a-x]*"} {
+		expected, err := rdb.Keys(pattern).Result()
+		require.NoError(t, err)
+		var got []string
+		for _, k := range keys {
+			if matchPattern(pattern, k) {
+				got = append(got, k)
+			}
+		}
+		assert.ElementsMatch(t, expected, got, "pattern %q", pattern)
+	}
+}
@@ -25,19 +25,18 @@ func NewRedisBroker(r *redis.Client) MessageBroker {
 	return rb
 }
 
+// Calls handlers one by one, so messages are delivered in the publishing order
 func (rb *redisBroker) serveMessages() {
 	for msg := range rb.pubSub.Channel() {
-		go func() {
-			rb.RLock()
-			handler, exists := rb.handlers[msg.Pattern]
-			rb.RUnlock()
-			if exists {
-				handler(&Message{
-					Channel: msg.Channel,
-					Data:    []byte(msg.Payload),
-				})
-			}
-		}()
+		rb.RLock()
+		handler, exists := rb.handlers[msg.Pattern]
+		rb.RUnlock()
+		if exists {
+			handler(&Message{
+				Channel: msg.Channel,
+				Data:    []byte(msg.Payload),
+			})
+		}
 	}
 }
 
@@ -0,0 +1,23 @@
+package netpoll
+
+import (
+	"errors"
+	"net"
+)
+
+// ErrNotSupported is returned by New on platforms without a poller implementation
+var ErrNotSupported = errors.New("netpoll is not supported on this platform")
+
+// Poller notifies when connections become readable, so they can be read by a worker pool
+// instead of a dedicated goroutine per connection
+type Poller interface {
+	// Start registers the connection, cb is called from the poller goroutine once the connection
+	// becomes readable or the peer hangs up. It must not block. Resume must be called to get the next notification
+	Start(conn net.Conn, cb func()) error
+	// Resume rearms the notification of the connection, it fires immediately if unread data is left
+	Resume(conn net.Conn) error
+	// Stop unregisters the connection, it must be called before the connection is closed
+	Stop(conn net.Conn) error
+	// Close stops the poller and waits for the running callbacks, registered connections stay open
+	Close() error
+}
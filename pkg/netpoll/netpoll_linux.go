@@ -0,0 +1,159 @@
+//go:build linux
+// +build linux
+
+package netpoll
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+)
+
+// Level-triggered one-shot notifications: the connection is reported once per Resume,
+// and reported again after Resume if it still has unread data
+const events = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT
+
+type epoll struct {
+	fd int
+	// wake is the pipe interrupting the wait on Close
+	wake [2]int
+	mu   sync.Mutex
+	// callbacks by file descriptor and file descriptors by connection
+	callbacks map[int]func()
+	fds       map[net.Conn]int
+	closed    bool
+	// stopped is closed once the wait loop returns
+	stopped chan struct{}
+}
+
+// New returns the epoll based poller
+func New() (Poller, error) {
+	fd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	p := &epoll{
+		fd:        fd,
+		callbacks: make(map[int]func()),
+		fds:       make(map[net.Conn]int),
+		stopped:   make(chan struct{}),
+	}
+	if err = syscall.Pipe2(p.wake[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		_ = syscall.Close(fd)
+		return nil, err
+	}
+	err = syscall.EpollCtl(fd, syscall.EPOLL_CTL_ADD, p.wake[0], &syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(p.wake[0])})
+	if err != nil {
+		p.closeFds()
+		return nil, err
+	}
+	go p.wait()
+	return p, nil
+}
+
+func (p *epoll) wait() {
+	defer close(p.stopped)
+	defer p.closeFds()
+	events := make([]syscall.EpollEvent, 128)
+	for {
+		n, err := syscall.EpollWait(p.fd, events, -1)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		for i := 0; i < n; i++ {
+			fd := int(events[i].Fd)
+			if fd == p.wake[0] {
+				return
+			}
+			p.mu.Lock()
+			cb := p.callbacks[fd]
+			p.mu.Unlock()
+			if cb != nil {
+				cb()
+			}
+		}
+	}
+}
+
+func (p *epoll) closeFds() {
+	_ = syscall.Close(p.fd)
+	_ = syscall.Close(p.wake[0])
+	_ = syscall.Close(p.wake[1])
+}
+
+func (p *epoll) Start(conn net.Conn, cb func()) error {
+	fd, err := fileDescriptor(conn)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return errors.New("poller is closed")
+	}
+	if err = syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_ADD, fd, &syscall.EpollEvent{Events: events, Fd: int32(fd)}); err != nil {
+		return err
+	}
+	p.callbacks[fd] = cb
+	p.fds[conn] = fd
+	return nil
+}
+
+func (p *epoll) Resume(conn net.Conn) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fd, exists := p.fds[conn]
+	if !exists || p.closed {
+		return errors.New("connection is not registered")
+	}
+	return syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_MOD, fd, &syscall.EpollEvent{Events: events, Fd: int32(fd)})
+}
+
+func (p *epoll) Stop(conn net.Conn) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fd, exists := p.fds[conn]
+	if !exists || p.closed {
+		return errors.New("connection is not registered")
+	}
+	delete(p.fds, conn)
+	delete(p.callbacks, fd)
+	return syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_DEL, fd, nil)
+}
+
+func (p *epoll) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return errors.New("poller is closed")
+	}
+	p.closed = true
+	_, err := syscall.Write(p.wake[1], []byte{0})
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	<-p.stopped
+	return nil
+}
+
+// Returns the file descriptor of the connection, it stays owned by the connection
+func fileDescriptor(conn net.Conn) (int, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return 0, errors.New("connection has no file descriptor")
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var fd int
+	err = raw.Control(func(f uintptr) {
+		fd = int(f)
+	})
+	return fd, err
+}
@@ -0,0 +1,93 @@
+//go:build linux
+// +build linux
+
+package netpoll
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Returns both ends of a TCP connection
+func tcpPair(t *testing.T) (server, client net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	client, err = net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	server, err = ln.Accept()
+	require.NoError(t, err)
+	return server, client
+}
+
+func TestPoller(t *testing.T) {
+	p, err := New()
+	require.NoError(t, err)
+	defer p.Close()
+	server, client := tcpPair(t)
+	defer server.Close()
+	defer client.Close()
+
+	var notified int32
+	require.NoError(t, p.Start(server, func() {
+		atomic.AddInt32(&notified, 1)
+	}))
+	time.Sleep(20 * time.Millisecond)
+	assert.Zero(t, atomic.LoadInt32(&notified), "nothing to read yet")
+
+	_, err = client.Write([]byte("12"))
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&notified) == 1
+	}, time.Second, time.Millisecond)
+
+	// one shot, no more notifications until resumed
+	_, err = client.Write([]byte("3"))
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&notified))
+
+	// unread data is reported again after resume
+	buf := make([]byte, 1)
+	_, err = server.Read(buf)
+	require.NoError(t, err)
+	require.NoError(t, p.Resume(server))
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&notified) == 2
+	}, time.Second, time.Millisecond)
+
+	// hang up is reported
+	buf = make([]byte, 2)
+	_, err = server.Read(buf)
+	require.NoError(t, err)
+	require.NoError(t, client.Close())
+	require.NoError(t, p.Resume(server))
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&notified) == 3
+	}, time.Second, time.Millisecond)
+
+	require.NoError(t, p.Stop(server))
+	assert.Error(t, p.Stop(server))
+	assert.Error(t, p.Resume(server))
+}
+
+func TestPollerRejects(t *testing.T) {
+	p, err := New()
+	require.NoError(t, err)
+
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	assert.Error(t, p.Start(server, func() {}), "pipes have no file descriptor")
+
+	require.NoError(t, p.Close())
+	assert.Error(t, p.Close())
+	tcpServer, tcpClient := tcpPair(t)
+	defer tcpServer.Close()
+	defer tcpClient.Close()
+	assert.Error(t, p.Start(tcpServer, func() {}))
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package netpoll
+
+// New returns ErrNotSupported, only linux is supported
+func New() (Poller, error) {
+	return nil, ErrNotSupported
+}
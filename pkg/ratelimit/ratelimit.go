@@ -0,0 +1,96 @@
+package ratelimit
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limit allows Events per Per period with bursts of up to Events, zero events mean no limit
+type Limit struct {
+	Events int
+	Per    time.Duration
+}
+
+// Decode parses the limit from "<events>/<period>", like "5/10s", an empty value or "0" means no limit.
+// It implements envconfig.Decoder
+func (l *Limit) Decode(value string) error {
+	value = strings.TrimSpace(value)
+	if value == "" || value == "0" {
+		*l = Limit{}
+		return nil
+	}
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid rate limit '%s', must be <events>/<period>", value)
+	}
+	events, err := strconv.Atoi(parts[0])
+	if err != nil || events < 0 {
+		return fmt.Errorf("invalid rate limit '%s', events must be a non-negative integer", value)
+	}
+	per, err := time.ParseDuration(parts[1])
+	if err != nil || per <= 0 {
+		return fmt.Errorf("invalid rate limit '%s', period must be a positive duration", value)
+	}
+	*l = Limit{Events: events, Per: per}
+	return nil
+}
+
+func (l Limit) String() string {
+	if l.Unlimited() {
+		return "0"
+	}
+	return strconv.Itoa(l.Events) + "/" + l.Per.String()
+}
+
+// Unlimited reports whether the limit allows any number of events
+func (l Limit) Unlimited() bool {
+	return l.Events <= 0 || l.Per <= 0
+}
+
+// Refill returns the number of tokens added to the bucket over the elapsed time
+func (l Limit) Refill(elapsed time.Duration) float64 {
+	return float64(l.Events) * float64(elapsed) / float64(l.Per)
+}
+
+// Bucket is the token bucket of the limit, it starts full. Safe for concurrent use
+type Bucket struct {
+	limit  Limit
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func NewBucket(limit Limit) *Bucket {
+	return &Bucket{limit: limit, tokens: float64(limit.Events)}
+}
+
+// Allow takes a token from the bucket, reports whether there was one
+func (b *Bucket) Allow() bool {
+	return b.AllowAt(time.Now())
+}
+
+// AllowAt takes a token from the bucket at the time, reports whether there was one
+func (b *Bucket) AllowAt(now time.Time) bool {
+	if b.limit.Unlimited() {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if now.After(b.last) {
+		if !b.last.IsZero() {
+			b.tokens += b.limit.Refill(now.Sub(b.last))
+			if max := float64(b.limit.Events); b.tokens > max {
+				b.tokens = max
+			}
+		}
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
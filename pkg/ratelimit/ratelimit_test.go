@@ -0,0 +1,52 @@
+package ratelimit
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestDecode(t *testing.T) {
+	var l Limit
+	require.NoError(t, l.Decode("5/10s"))
+	assert.Equal(t, Limit{Events: 5, Per: 10 * time.Second}, l)
+	assert.Equal(t, "5/10s", l.String())
+	assert.False(t, l.Unlimited())
+
+	for _, value := range []string{"", "0", " 0 "} {
+		require.NoError(t, l.Decode(value))
+		assert.True(t, l.Unlimited(), value)
+	}
+	for _, value := range []string{"5", "a/1s", "-1/1s", "5/0s", "5/abc"} {
+		assert.Error(t, l.Decode(value), value)
+	}
+}
+
+func TestBucket(t *testing.T) {
+	b := NewBucket(Limit{Events: 2, Per: time.Second})
+	now := time.Now()
+	assert.True(t, b.AllowAt(now))
+	assert.True(t, b.AllowAt(now))
+	assert.False(t, b.AllowAt(now))
+
+	// a token every half a second
+	assert.False(t, b.AllowAt(now.Add(400*time.Millisecond)))
+	assert.True(t, b.AllowAt(now.Add(500*time.Millisecond)))
+	assert.False(t, b.AllowAt(now.Add(500*time.Millisecond)))
+
+	// the bucket holds no more than the burst
+	later := now.Add(time.Hour)
+	assert.True(t, b.AllowAt(later))
+	assert.True(t, b.AllowAt(later))
+	assert.False(t, b.AllowAt(later))
+	// the clock going back refills nothing
+	assert.False(t, b.AllowAt(now))
+}
+
+func TestUnlimited(t *testing.T) {
+	b := NewBucket(Limit{})
+	for i := 0; i < 1000; i++ {
+		require.True(t, b.Allow())
+	}
+}
@@ -0,0 +1,69 @@
+package shardpool
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// Pool runs tasks on a fixed number of workers, each key is bound to one of them,
+// so tasks with the same key run one by one in the submission order
+// while tasks with different keys may run in parallel
+type Pool struct {
+	queues []chan func()
+	mu     sync.RWMutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// New starts the pool of the workers, each of them has a queue of queueSize tasks
+func New(workers, queueSize int) *Pool {
+	if workers < 1 {
+		workers = 1
+	}
+	p := &Pool{queues: make([]chan func(), workers)}
+	p.wg.Add(workers)
+	for i := range p.queues {
+		p.queues[i] = make(chan func(), queueSize)
+		go p.work(p.queues[i])
+	}
+	return p
+}
+
+func (p *Pool) work(queue chan func()) {
+	defer p.wg.Done()
+	for task := range queue {
+		task()
+	}
+}
+
+// Returns the index of the worker the key is bound to
+func (p *Pool) shard(key string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(p.queues)))
+}
+
+// Submit queues the task to the worker of the key, blocks while its queue is full.
+// Returns false if the pool is stopped, the task is not run then
+func (p *Pool) Submit(key string, task func()) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return false
+	}
+	p.queues[p.shard(key)] <- task
+	return true
+}
+
+// StopWait stops the pool and waits for the queued tasks to complete
+func (p *Pool) StopWait() {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		for _, q := range p.queues {
+			close(q)
+		}
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+}
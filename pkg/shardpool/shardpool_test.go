@@ -0,0 +1,67 @@
+package shardpool
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSubmitOrder(t *testing.T) {
+	p := New(4, 10)
+	keys := []string{"a", "b", "c", "d", "e"}
+	const count = 100
+
+	var mu sync.Mutex
+	results := make(map[string][]int)
+	for i := 0; i < count; i++ {
+		for _, key := range keys {
+			key, i := key, i
+			require.True(t, p.Submit(key, func() {
+				mu.Lock()
+				results[key] = append(results[key], i)
+				mu.Unlock()
+			}))
+		}
+	}
+	p.StopWait()
+
+	for _, key := range keys {
+		require.Len(t, results[key], count, key)
+		for i, v := range results[key] {
+			assert.Equal(t, i, v, key)
+		}
+	}
+}
+
+func TestKeysRunInParallel(t *testing.T) {
+	p := New(4, 10)
+	defer p.StopWait()
+
+	other := ""
+	for i := 0; other == ""; i++ {
+		if key := strconv.Itoa(i); p.shard(key) != p.shard("blocked") {
+			other = key
+		}
+	}
+
+	release := make(chan struct{})
+	defer close(release)
+	require.True(t, p.Submit("blocked", func() { <-release }))
+	done := make(chan struct{})
+	require.True(t, p.Submit(other, func() { close(done) }))
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the task is held by a task of another key")
+	}
+}
+
+func TestSubmitAfterStop(t *testing.T) {
+	p := New(2, 10)
+	p.StopWait()
+	assert.False(t, p.Submit("key", func() { t.Error("must not run") }))
+	p.StopWait()
+}
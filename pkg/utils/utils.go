@@ -8,12 +8,17 @@ import (
 	"unicode/utf8"
 )
 
+// URLPattern matches the http(s) URLs accepted by IsUrlValid, the scheme may be omitted
+const URLPattern = `^(https?://(www\.)?)?[a-z0-9]+([-.][a-z0-9]+)*\.[a-z]{2,5}(:[0-9]{1,5})?(/.*)?$`
+
 var (
 	src        = rand.NewSource(time.Now().UnixNano())
 	emailRegex = regexp.MustCompile("(?i)^[a-z0-9_.+-]+@[a-z0-9-]+\\.[a-z0-9-.]+$")
 	nameRegex  = regexp.MustCompile("(?i)^[a-zа-яА-Я0-9]+[a-zа-яА-Я0-9 :_-]*[a-zа-яА-Я0-9]+$")
-	urlRegex   = regexp.MustCompile(`^(http:\/\/www\.|https:\/\/www\.|http:\/\/|https:\/\/)?[a-z0-9]+([\-\.]{1}[a-z0-9]+)*\.[a-z]{2,5}(:[0-9]{1,5})?(\/.*)?$`)
-	colors     = []string{
+	urlRegex   = regexp.MustCompile(URLPattern)
+	// linkRegex finds URLs with a scheme or www, and bare domains of the popular zones
+	linkRegex = regexp.MustCompile(`(?i)([a-z][a-z0-9+.-]*://|www\.)\S+|\b[a-z0-9-]+(\.[a-z0-9-]+)*\.(com|net|org|info|io|me|tv|gg|ly|co|be|to|xyz|ru|su)\b`)
+	colors    = []string{
 		"white", "black", "red", "maroon", "yellow", "lime", "green", "aqua", "teal", "blue", "navy", "fuchsia", "purple",
 	}
 )
@@ -82,6 +87,16 @@ func IsUrlValid(url string) bool {
 	return urlRegex.MatchString(url)
 }
 
+// ContainsLink reports whether the text contains something looking like a link
+func ContainsLink(text string) bool {
+	return linkRegex.MatchString(text)
+}
+
 func GetRandomColor() string {
 	return colors[rand.Intn(len(colors)-1)]
 }
+
+// UnixMilli returns t as unix time in milliseconds
+func UnixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
@@ -105,8 +105,24 @@ func TestIsUrlValid(t *testing.T) {
 	assert.False(t, IsUrlValid("ftp://test.com"))
 }
 
+func TestContainsLink(t *testing.T) {
+	assert.True(t, ContainsLink("see https://example.org/page"))
+	assert.True(t, ContainsLink("WWW.example.test"))
+	assert.True(t, ContainsLink("join discord.gg/abc"))
+	assert.True(t, ContainsLink("go to sub.example.com now"))
+	assert.True(t, ContainsLink("ftp://files"))
+
+	assert.False(t, ContainsLink("hello world"))
+	assert.False(t, ContainsLink("pi is 3.14"))
+	assert.False(t, ContainsLink("combo"))
+}
+
 func TestGetRandomColor(t *testing.T) {
 	for i := 0; i < 10; i++ {
 		GetRandomColor()
 	}
 }
+
+func TestUnixMilli(t *testing.T) {
+	assert.Equal(t, int64(1500), UnixMilli(time.Unix(1, 500*int64(time.Millisecond))))
+}
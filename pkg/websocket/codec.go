@@ -0,0 +1,111 @@
+package websocket
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Subprotocols negotiated on the websocket upgrade, JSON is used if the client asks for none
+const (
+	ProtocolJSON    = "json"
+	ProtocolMsgpack = "msgpack"
+)
+
+// Codec converts messages between JSON, which is the format messages are built, stored and published in,
+// and the wire format of the connection
+type Codec interface {
+	// Binary reports whether the messages are exchanged in binary frames instead of text ones
+	Binary() bool
+	// Encode converts the JSON encoded message to the wire format
+	Encode(data []byte) ([]byte, error)
+	// Decode converts the client message from the wire format to JSON
+	Decode(p []byte) ([]byte, error)
+}
+
+type (
+	jsonCodec    struct{}
+	msgpackCodec struct{}
+)
+
+var codecs = map[string]Codec{
+	ProtocolJSON:    jsonCodec{},
+	ProtocolMsgpack: msgpackCodec{},
+}
+
+// IsProtocolSupported reports whether there is a codec for the subprotocol
+func IsProtocolSupported(protocol string) bool {
+	_, ok := codecs[protocol]
+	return ok
+}
+
+// CodecOf returns the codec of the subprotocol, the JSON one if it is not supported
+func CodecOf(protocol string) Codec {
+	if c, ok := codecs[protocol]; ok {
+		return c
+	}
+	return jsonCodec{}
+}
+
+func (jsonCodec) Binary() bool {
+	return false
+}
+
+func (jsonCodec) Encode(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+func (jsonCodec) Decode(p []byte) ([]byte, error) {
+	return p, nil
+}
+
+func (msgpackCodec) Binary() bool {
+	return true
+}
+
+// Integers are kept integers, both integers and floats are encoded in the smallest lossless format
+func (msgpackCodec) Encode(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.UseCompactInts(true)
+	enc.UseCompactFloats(true)
+	if err := enc.Encode(fromJSONNumbers(v)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Decode(p []byte) ([]byte, error) {
+	var v interface{}
+	if err := msgpack.Unmarshal(p, &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// Replaces json.Number values with int64 or float64 ones
+func fromJSONNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = fromJSONNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = fromJSONNumbers(item)
+		}
+	}
+	return v
+}
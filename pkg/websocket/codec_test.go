@@ -0,0 +1,41 @@
+package websocket
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack/v5"
+	"testing"
+)
+
+func TestMsgpackCodec(t *testing.T) {
+	codec := CodecOf(ProtocolMsgpack)
+	assert.True(t, codec.Binary())
+
+	p, err := codec.Encode([]byte(`{"method": "video_sync", "seq": 3, "params": {"position": 1.5, "tags": ["a", 10000000000]}}`))
+	require.NoError(t, err)
+	var v map[string]interface{}
+	require.NoError(t, msgpack.Unmarshal(p, &v))
+	assert.EqualValues(t, 3, v["seq"])
+	assert.IsType(t, int8(0), v["seq"], "integers are compact")
+	params := v["params"].(map[string]interface{})
+	assert.EqualValues(t, 1.5, params["position"])
+	assert.EqualValues(t, 10000000000, params["tags"].([]interface{})[1])
+
+	b, err := codec.Decode(p)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"method": "video_sync", "seq": 3, "params": {"position": 1.5, "tags": ["a", 10000000000]}}`, string(b))
+
+	_, err = codec.Decode([]byte{0xc1})
+	assert.Error(t, err)
+}
+
+func TestCodecOf(t *testing.T) {
+	assert.True(t, IsProtocolSupported(ProtocolJSON))
+	assert.True(t, IsProtocolSupported(ProtocolMsgpack))
+	assert.False(t, IsProtocolSupported("cbor"))
+	assert.False(t, CodecOf("").Binary())
+
+	b, err := CodecOf(ProtocolJSON).Encode([]byte(`{"a":1}`))
+	require.NoError(t, err)
+	assert.Equal(t, `{"a":1}`, string(b))
+}
@@ -0,0 +1,56 @@
+package websocket
+
+import "fmt"
+
+// Error codes sent to clients in 'error' messages
+const (
+	// Request is not a valid JSON message
+	ErrCodeBadRequest = "bad_request"
+	// Request method is not supported
+	ErrCodeUnknownMethod = "unknown_method"
+	// Request params are missing or invalid
+	ErrCodeInvalidParams = "invalid_params"
+	// User is not allowed to call the method
+	ErrCodeForbidden = "forbidden"
+	// Requested entity does not exist
+	ErrCodeNotFound = "not_found"
+	// Too many requests, the request is rejected by the rate limit
+	ErrCodeRateLimited = "rate_limited"
+	// Chat message repeats the last one of the member
+	ErrCodeDuplicateMessage = "duplicate_message"
+	// Request failed on the server side
+	ErrCodeInternal = "internal_error"
+)
+
+// Error is a request failure reported to the client
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// NewError returns Error with the code and the formatted message
+func NewError(code, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// NewErrorMessage returns the 'error' message replying to the request,
+// the request ID is echoed so the client can match it with the request
+func NewErrorMessage(req *Message, e *Error) *Message {
+	requestID := req.RequestID
+	if len(requestID) > MaxRequestIDLength {
+		requestID = ""
+	}
+	return &Message{
+		RequestID: requestID,
+		Method:    "error",
+		Params: &ErrorParams{
+			Code:    e.Code,
+			Message: e.Message,
+			Method:  req.Method,
+		},
+	}
+}
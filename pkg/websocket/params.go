@@ -0,0 +1,135 @@
+package websocket
+
+import (
+	"smotri.me/model"
+	"smotri.me/pkg/jsonschema"
+	"smotri.me/pkg/utils"
+	"strings"
+)
+
+// Params of the client requests, decoded by jsonschema.Decode and described by the schema tags
+type (
+	// NoParams is the params of the methods taking none
+	NoParams struct{}
+
+	// NewMessageParams is the params of 'new_message'
+	NewMessageParams struct {
+		Content string `json:"content" schema:"minLength=1;description=Message text, not blank"`
+	}
+
+	// EditMessageParams is the params of 'edit_message'
+	EditMessageParams struct {
+		MessageID string `json:"message_id" schema:"minLength=1"`
+		Content   string `json:"content" schema:"minLength=1;description=New message text, not blank"`
+	}
+
+	// RemoveMessageParams is the params of 'remove_message'
+	RemoveMessageParams struct {
+		MessageID string `json:"message_id" schema:"minLength=1"`
+	}
+
+	// RenameMemberParams is the params of 'rename_member'
+	RenameMemberParams struct {
+		Name string `json:"name" schema:"minLength=2;maxLength=100;description=Letters, digits, spaces, ':', '_' and '-', starting and ending with a letter or digit"`
+	}
+
+	// UpdateRoomParams is the params of 'update_room'
+	UpdateRoomParams struct {
+		Title    string `json:"title" schema:"minLength=2;maxLength=100"`
+		VideoURL string `json:"video_url" schema:"description=http(s) URL, the scheme may be omitted"`
+	}
+
+	// MemberParams is the params of the methods changing the member role
+	MemberParams struct {
+		UserID string `json:"user_id" schema:"minLength=1"`
+	}
+
+	// ModerationParams is the params of 'kick_member', 'ban_member' and 'mute_member'
+	ModerationParams struct {
+		UserID string `json:"user_id" schema:"minLength=1"`
+		Reason string `json:"reason,omitempty" schema:"maxLength=100;description=Shown to the member and the room"`
+	}
+
+	// ControlPolicyParams is the params of 'set_control_policy'
+	ControlPolicyParams struct {
+		Policy string `json:"policy" schema:"enum=everyone|host"`
+	}
+
+	// ChatSettingsParams is the params of 'update_chat_settings'
+	ChatSettingsParams struct {
+		SlowMode   *int    `json:"slow_mode,omitempty" schema:"minimum=0;maximum=3600;description=Min seconds between messages of a member, 0 disables it, unchanged if omitted"`
+		LinkPolicy *string `json:"link_policy,omitempty" schema:"enum=everyone|host;description=Who can post links, unchanged if omitted"`
+	}
+
+	// PlaybackParams is the params of 'video_play' and 'video_pause'
+	PlaybackParams struct {
+		Position float64  `json:"position" schema:"minimum=0;description=Position in seconds"`
+		Rate     *float64 `json:"rate,omitempty" schema:"exclusiveMinimum=0;maximum=4;description=Playback rate, unchanged if omitted"`
+	}
+
+	// SyncParams is the params of 'video_sync'
+	SyncParams struct {
+		PlaybackParams
+		Playing *bool `json:"playing,omitempty" schema:"description=Playing state, unchanged if omitted"`
+	}
+
+	// HistoryParams is the params of 'get_history'
+	HistoryParams struct {
+		Before int64 `json:"before,omitempty" schema:"minimum=0;description=Seq of the oldest message the client has, the latest page if omitted"`
+		Limit  int   `json:"limit,omitempty" schema:"minimum=1;maximum=100;description=Page size, 50 if omitted"`
+	}
+
+	// ResyncParams is the params of 'resync'
+	ResyncParams struct {
+		Since int64 `json:"since" schema:"minimum=0;description=Seq of the last broadcast the client has"`
+	}
+)
+
+func (p *NewMessageParams) Validate() error {
+	return notBlank("content", p.Content)
+}
+
+func (p *EditMessageParams) Validate() error {
+	return notBlank("content", p.Content)
+}
+
+func (p *RenameMemberParams) Validate() error {
+	if !utils.IsNameValid(p.Name) {
+		return &jsonschema.Error{Field: "name", Message: "must contain letters, digits, spaces, ':', '_' and '-' only and start and end with a letter or digit"}
+	}
+	return nil
+}
+
+func (p *UpdateRoomParams) Validate() error {
+	if !utils.IsUrlValid(p.VideoURL) {
+		return &jsonschema.Error{Field: "video_url", Message: "must be a valid URL"}
+	}
+	return nil
+}
+
+// ExtendSchema describes the video URL by the pattern the server checks it with
+func (p *UpdateRoomParams) ExtendSchema(s *jsonschema.Schema) {
+	s.Properties["video_url"].Pattern = utils.URLPattern
+}
+
+func (p *MemberParams) Validate() error {
+	return notBlank("user_id", p.UserID)
+}
+
+func (p *ModerationParams) Validate() error {
+	return notBlank("user_id", p.UserID)
+}
+
+func (p *ControlPolicyParams) Validate() error {
+	if !model.IsPolicyValid(p.Policy) {
+		return &jsonschema.Error{Field: "policy", Message: "is not a known policy"}
+	}
+	return nil
+}
+
+func notBlank(field, value string) error {
+	if strings.TrimSpace(value) == "" {
+		return &jsonschema.Error{Field: field, Message: "must not be blank"}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package websocket
+
+import (
+	"encoding/json"
+	"smotri.me/model"
+)
+
+// Params of the server messages: the responses, the broadcasts and the messages initiated by the server,
+// described by the schema tags
+type (
+	// MemberInfo is the room member as the room sees it, the params of 'get_me' and 'new_member'
+	MemberInfo struct {
+		ID    string `json:"id"`
+		Name  string `json:"name"`
+		Color string `json:"color"`
+		Time  int    `json:"time"`
+		Role  string `json:"role" schema:"enum=host|cohost|member"`
+	}
+
+	// MemberList is the params of 'get_members'
+	MemberList struct {
+		Members []*model.User `json:"members"`
+	}
+
+	// WelcomeRoom is the room description of 'welcome'
+	WelcomeRoom struct {
+		ID            string             `json:"id"`
+		Title         string             `json:"title"`
+		VideoURL      string             `json:"video_url"`
+		ControlPolicy string             `json:"control_policy" schema:"enum=everyone|host"`
+		Chat          model.ChatSettings `json:"chat"`
+	}
+
+	// WelcomeParams is the params of 'welcome', the first message of the connection
+	// with everything the client needs to render the room
+	WelcomeParams struct {
+		Me          MemberInfo `json:"me"`
+		ResumeToken string     `json:"resume_token" schema:"description=Restores the identity on reconnect with the 'resume_token' query param, single-use"`
+		// Resumed is set if the connection resumed the session, the missed broadcasts follow in 'resync'
+		Resumed  bool           `json:"resumed"`
+		Room     WelcomeRoom    `json:"room"`
+		Members  []*model.User  `json:"members"`
+		Playback model.Playback `json:"playback"`
+		History  HistoryPage    `json:"history"`
+		Seq      int64          `json:"seq" schema:"description=The state reflects at least the broadcasts up to this seq, the following ones come after the welcome"`
+	}
+
+	// ErrorParams is the params of 'error' replying to the rejected request
+	ErrorParams struct {
+		Code    string `json:"code" schema:"enum=bad_request|unknown_method|invalid_params|forbidden|not_found|rate_limited|duplicate_message|internal_error"`
+		Message string `json:"message"`
+		Method  string `json:"method" schema:"description=Method of the rejected request, empty if the request could not be parsed"`
+	}
+
+	// HistoryPage is the params of 'get_history', the page of the chat history oldest first
+	HistoryPage struct {
+		Messages   []*model.ChatMessage `json:"messages"`
+		NextCursor int64                `json:"next_cursor" schema:"description=The 'before' param of the next (older) page, 0 on the last page"`
+	}
+
+	// ResyncResult is the params of 'resync': the broadcasts following the since seq,
+	// or the room snapshot if they are not kept anymore
+	ResyncResult struct {
+		Seq      int64             `json:"seq" schema:"description=Seq of the last room broadcast"`
+		Events   []json.RawMessage `json:"events,omitempty" schema:"description=Missed broadcasts in the seq order, omitted if there are none"`
+		Snapshot *model.Room       `json:"snapshot,omitempty" schema:"description=Room state replacing the missed broadcasts"`
+	}
+
+	// PostedMessage is the params of the 'new_message' broadcast, the message ID is the ID of the broadcast
+	PostedMessage struct {
+		Content   string `json:"content"`
+		CreatedAt int64  `json:"created_at" schema:"description=Unix time in milliseconds"`
+		Seq       int64  `json:"seq" schema:"description=Position of the message in the room history"`
+	}
+
+	// EditedMessage is the params of the 'edit_message' broadcast
+	EditedMessage struct {
+		MessageID string `json:"message_id"`
+		Content   string `json:"content"`
+		EditedAt  int64  `json:"edited_at" schema:"description=Unix time in milliseconds"`
+	}
+
+	// RoleChange is the params of the 'grant_cohost' and 'revoke_cohost' broadcasts
+	RoleChange struct {
+		UserID string `json:"user_id"`
+		Role   string `json:"role" schema:"enum=cohost|member"`
+	}
+)
+
+// NewMemberInfo returns the member info of the user
+func NewMemberInfo(u *model.User) *MemberInfo {
+	return &MemberInfo{
+		ID:    u.ID,
+		Name:  u.Name,
+		Color: u.Color,
+		Time:  u.Time,
+		Role:  u.Role,
+	}
+}
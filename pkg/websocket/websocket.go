@@ -1,10 +1,7 @@
 package websocket
 
 import (
-	"fmt"
 	"smotri.me/model"
-	"smotri.me/pkg/utils"
-	"strings"
 	"sync"
 )
 
@@ -21,19 +18,25 @@ type (
 	}
 
 	Message struct {
-		ID       string                 `json:"id,omitempty"`
-		UserID   string                 `json:"user_id"`
-		Method   string                 `json:"method"`
-		Params   map[string]interface{} `json:"params,omitempty"`
-		Response bool                   `json:"-"`
+		// ID is the chat message ID, set for chat messages only
+		ID string `json:"id,omitempty"`
+		// RequestID is an optional client-chosen string echoed by the server in the direct response
+		// or error caused by the request, and in the sender copy of the broadcast caused by it, so clients can match them.
+		// Messages initiated by the server have no RequestID
+		RequestID string `json:"request_id,omitempty"`
+		// Seq is the room sequence number of the broadcast, it grows by one with every broadcast of the room,
+		// so clients can detect missed ones and catch up with 'resync'. Direct responses have no Seq
+		Seq    int64  `json:"seq,omitempty"`
+		UserID string `json:"user_id"`
+		Method string `json:"method"`
+		// Params is the request params, or the params of the server message
+		// of one of the types declared for the method
+		Params interface{} `json:"params,omitempty"`
 	}
 )
 
-func NewMessage() *Message {
-	return &Message{
-		Params: make(map[string]interface{}),
-	}
-}
+// MaxRequestIDLength is the max length of the client request ID
+const MaxRequestIDLength = 64
 
 func NewChannels() Channels {
 	return &channels{
@@ -53,11 +56,12 @@ func (h *channels) Subscribe(u *model.User, channels ...string) {
 	h.Unlock()
 }
 
+// Unsubscribe removes the user connection from the channels,
+// the connection of the same user subscribed after it stays
 func (h *channels) Unsubscribe(u *model.User, channels ...string) {
 	h.Lock()
 	for _, ch := range channels {
-		_, exists := h.storage[ch]
-		if exists {
+		if h.storage[ch][u.ID] == u {
 			delete(h.storage[ch], u.ID)
 		}
 	}
@@ -67,67 +71,17 @@ func (h *channels) Unsubscribe(u *model.User, channels ...string) {
 func (h *channels) GetSubscribers(channel string) []*model.User {
 	var result []*model.User
 	h.Lock()
-	subscribers, channelExists := h.storage[channel]
-	h.Unlock()
-	if channelExists {
-		for _, s := range subscribers {
-			result = append(result, s)
-		}
+	defer h.Unlock()
+	for _, s := range h.storage[channel] {
+		result = append(result, s)
 	}
 	return result
 }
 
+// Validate checks the message envelope, params are decoded and checked by the method
 func (m *Message) Validate() error {
-	switch m.Method {
-	case "new_message":
-		content, ok := m.Params["content"].(string)
-		if !ok || strings.TrimSpace(content) == "" {
-			return fmt.Errorf("invalid '%s' request, param 'content' is required and must be string", m.Method)
-		}
-	case "edit_message":
-		_, ok := m.Params["message_id"].(string)
-		if !ok {
-			return fmt.Errorf("invalid '%s' request, param 'message_id' is required and must be int", m.Method)
-		}
-
-		content, ok := m.Params["content"].(string)
-		if !ok || strings.TrimSpace(content) == "" {
-			return fmt.Errorf("invalid '%s' request, param 'content' is required and must be string", m.Method)
-		}
-	case "remove_message":
-		_, ok := m.Params["message_id"].(string)
-		if !ok {
-			return fmt.Errorf("invalid '%s' request, param 'message_id' is required and must be int", m.Method)
-		}
-	case "rename_member":
-		name, ok := m.Params["name"].(string)
-		if !ok {
-			return fmt.Errorf("invalid '%s' request, param 'name' is required and must be string", m.Method)
-		}
-		if !utils.IsNameValid(name) {
-			return fmt.Errorf("invalid '%s' request, param 'name' is invalid", m.Method)
-		}
-	case "update_room":
-		title, ok := m.Params["title"].(string)
-		if !ok {
-			return fmt.Errorf("invalid '%s' request, param 'title' is required and must be string", m.Method)
-		}
-		if !utils.IsLengthValid(title, 2, 100) {
-			return fmt.Errorf("invalid '%s' request, param 'title' is invalid", m.Method)
-		}
-
-		videoURL, ok := m.Params["video_url"].(string)
-		if !ok {
-			return fmt.Errorf("invalid '%s' request, param 'video_url' is required and must be string", m.Method)
-		}
-		if !utils.IsUrlValid(videoURL) {
-			return fmt.Errorf("invalid '%s' request, param 'video_url' is invalid", m.Method)
-		}
-	case "video_sync", "video_play", "video_pause":
-	case "get_members", "get_me":
-	default:
-		return fmt.Errorf("invalid request method: '%s'", m.Method)
+	if len(m.RequestID) > MaxRequestIDLength {
+		return NewError(ErrCodeBadRequest, "invalid request, 'request_id' must be at most %d chars", MaxRequestIDLength)
 	}
-
 	return nil
 }
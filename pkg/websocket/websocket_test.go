@@ -0,0 +1,43 @@
+package websocket
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"smotri.me/model"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	assert.NoError(t, (&Message{Method: "get_me"}).Validate())
+	assert.NoError(t, (&Message{Method: "get_me", RequestID: strings.Repeat("a", MaxRequestIDLength)}).Validate())
+
+	err := (&Message{Method: "get_me", RequestID: strings.Repeat("a", MaxRequestIDLength+1)}).Validate()
+	require.IsType(t, &Error{}, err)
+	assert.Equal(t, ErrCodeBadRequest, err.(*Error).Code)
+}
+
+func TestNewErrorMessage(t *testing.T) {
+	req := &Message{RequestID: "42", Method: "new_message"}
+	msg := NewErrorMessage(req, NewError(ErrCodeForbidden, "method '%s' is forbidden", req.Method))
+	assert.Equal(t, "error", msg.Method)
+	assert.Equal(t, "42", msg.RequestID)
+	assert.Equal(t, &ErrorParams{
+		Code:    ErrCodeForbidden,
+		Message: "method 'new_message' is forbidden",
+		Method:  "new_message",
+	}, msg.Params)
+}
+
+func TestUnsubscribeKeepsNewerConnection(t *testing.T) {
+	h := NewChannels()
+	old := &model.User{ID: "user"}
+	resumed := &model.User{ID: "user"}
+	h.Subscribe(old, "room")
+	h.Subscribe(resumed, "room")
+	h.Unsubscribe(old, "room")
+	assert.Equal(t, []*model.User{resumed}, h.GetSubscribers("room"))
+
+	h.Unsubscribe(resumed, "room")
+	assert.Empty(t, h.GetSubscribers("room"))
+}
@@ -0,0 +1,108 @@
+package wsconn
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Pinger keeps connections alive from a single goroutine: it pings them every interval
+// and closes those missing a pong within pongTimeout or having sent nothing for idleTimeout
+type Pinger struct {
+	interval    time.Duration
+	pongTimeout time.Duration
+	idleTimeout time.Duration
+	mu          sync.Mutex
+	conns       map[*Conn]struct{}
+	done        chan struct{}
+	once        sync.Once
+}
+
+// NewPinger starts the pinger, zero interval disables pings, zero timeouts disable the checks.
+// pongTimeout must be less than interval
+func NewPinger(interval, pongTimeout, idleTimeout time.Duration) *Pinger {
+	p := &Pinger{
+		interval:    interval,
+		pongTimeout: pongTimeout,
+		idleTimeout: idleTimeout,
+		conns:       make(map[*Conn]struct{}),
+		done:        make(chan struct{}),
+	}
+	if interval > 0 {
+		go p.run()
+	}
+	return p
+}
+
+// Close stops the pinger, connections stay open
+func (p *Pinger) Close() {
+	p.once.Do(func() {
+		close(p.done)
+	})
+}
+
+func (p *Pinger) add(c *Conn) {
+	p.mu.Lock()
+	p.conns[c] = struct{}{}
+	p.mu.Unlock()
+}
+
+func (p *Pinger) remove(c *Conn) {
+	p.mu.Lock()
+	delete(p.conns, c)
+	p.mu.Unlock()
+}
+
+func (p *Pinger) snapshot() []*Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conns := make([]*Conn, 0, len(p.conns))
+	for c := range p.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+func (p *Pinger) run() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+
+		sent := time.Now()
+		conns := p.snapshot()
+		for _, c := range conns {
+			_ = c.ping()
+		}
+		if p.pongTimeout > 0 {
+			timer := time.NewTimer(p.pongTimeout)
+			select {
+			case <-p.done:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			for _, c := range conns {
+				if c.LastPong().Before(sent) {
+					if closed, _ := c.close(); closed {
+						atomic.AddUint64(&c.opts.Metrics.pongTimeouts, 1)
+					}
+				}
+			}
+		}
+		if p.idleTimeout > 0 {
+			idleSince := time.Now().Add(-p.idleTimeout)
+			for _, c := range p.snapshot() {
+				if c.LastRead().Before(idleSince) {
+					if closed, _ := c.close(); closed {
+						atomic.AddUint64(&c.opts.Metrics.idleTimeouts, 1)
+					}
+				}
+			}
+		}
+	}
+}
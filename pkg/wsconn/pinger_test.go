@@ -0,0 +1,87 @@
+package wsconn
+
+import (
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestPingerKeepsAlive(t *testing.T) {
+	p := NewPinger(20*time.Millisecond, 10*time.Millisecond, 100*time.Millisecond)
+	defer p.Close()
+	metrics := &Metrics{}
+	c, client := newPipe(Options{QueueSize: 10, Pinger: p, Metrics: metrics})
+	defer c.Close()
+	defer client.Close()
+
+	// the server reads pongs, the client answers pings while reading
+	go func() {
+		for {
+			if _, err := c.ReadText(); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		_, _ = wsutil.ReadServerText(client)
+	}()
+
+	assert.Eventually(t, func() bool {
+		return !c.LastPong().IsZero()
+	}, time.Second, 5*time.Millisecond)
+	// pongs keep the connection from being idle
+	time.Sleep(150 * time.Millisecond)
+	assert.NoError(t, c.SendText([]byte("alive")))
+	assert.Zero(t, metrics.PongTimeouts())
+	assert.Zero(t, metrics.IdleTimeouts())
+}
+
+func TestPongTimeout(t *testing.T) {
+	p := NewPinger(20*time.Millisecond, 10*time.Millisecond, 0)
+	defer p.Close()
+	metrics := &Metrics{}
+	var closed bool
+	c, client := newPipe(Options{QueueSize: 10, Pinger: p, Metrics: metrics, OnClose: func() { closed = true }})
+	defer client.Close()
+
+	// the client reads frames, but never answers pings
+	go func() {
+		for {
+			if _, err := ws.ReadFrame(client); err != nil {
+				return
+			}
+		}
+	}()
+
+	assert.Eventually(t, func() bool {
+		return c.SendText([]byte("next")) == ErrClosed
+	}, time.Second, 5*time.Millisecond)
+	assert.True(t, closed)
+	assert.Equal(t, uint64(1), metrics.PongTimeouts())
+	assert.True(t, c.LastPong().IsZero())
+
+	p.mu.Lock()
+	assert.Empty(t, p.conns)
+	p.mu.Unlock()
+}
+
+func TestIdleTimeout(t *testing.T) {
+	p := NewPinger(20*time.Millisecond, 0, 30*time.Millisecond)
+	defer p.Close()
+	metrics := &Metrics{}
+	c, client := newPipe(Options{QueueSize: 10, Pinger: p, Metrics: metrics})
+	defer client.Close()
+
+	// the client reads and answers pings, but the server never reads, so the pongs are not seen
+	go func() {
+		_, _ = wsutil.ReadServerText(client)
+	}()
+
+	assert.Eventually(t, func() bool {
+		return c.SendText([]byte("next")) == ErrClosed
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, uint64(1), metrics.IdleTimeouts())
+	assert.Zero(t, metrics.PongTimeouts())
+}
@@ -0,0 +1,451 @@
+package wsconn
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
+	"github.com/gobwas/ws/wsutil"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// Slow consumer policies, applied when the outbound queue of a connection is full
+const (
+	// The oldest queued frame is dropped to make room for the new one
+	PolicyDropOldest = "drop_oldest"
+	// The connection is closed
+	PolicyDisconnect = "disconnect"
+)
+
+var (
+	// ErrClosed is returned on sending to a closed connection
+	ErrClosed = errors.New("connection is closed")
+	// ErrInvalidUTF8 is returned on reading a text message which is not valid UTF-8
+	ErrInvalidUTF8 = errors.New("invalid utf8 sequence in text message")
+	// ErrSlowConsumer is returned when the connection is closed due to the full outbound queue
+	ErrSlowConsumer = errors.New("slow consumer disconnected")
+	// ErrMessageTooBig is returned on reading a message exceeding the max message size
+	ErrMessageTooBig = errors.New("message is too big")
+)
+
+// closeTimeout limits waiting for the close frame to be written before giving up on the client
+const closeTimeout = time.Second
+
+func IsPolicyValid(policy string) bool {
+	return policy == PolicyDropOldest || policy == PolicyDisconnect
+}
+
+type Options struct {
+	// QueueSize is the max number of frames waiting to be written
+	QueueSize int
+	// Policy is the slow consumer policy
+	Policy string
+	// WriteTimeout limits the time of a single frame write, zero means no limit
+	WriteTimeout time.Duration
+	// Pinger keeps the connection alive, no pings are sent if nil
+	Pinger *Pinger
+	// OnClose is called once the connection is closed for any reason, right before the underlying
+	// connection is closed. It is called synchronously, so it must not block
+	OnClose func()
+	// Metrics collects the stats of the connection, may be shared by connections
+	Metrics *Metrics
+	// Binary connections read binary messages instead of text ones
+	Binary bool
+	// Compression reports whether permessage-deflate without context takeover was negotiated,
+	// compressed messages from the client are inflated on reading
+	Compression bool
+	// MaxMessageSize is the max size in bytes of a message from the client, compressed ones are limited
+	// once inflated. The connection is closed with 1009 status code if exceeded, zero means no limit
+	MaxMessageSize int64
+}
+
+// Metrics of the connections, safe for concurrent use
+type Metrics struct {
+	dropped      uint64
+	disconnected uint64
+	pongTimeouts uint64
+	idleTimeouts uint64
+}
+
+// Dropped returns the number of frames dropped by the drop oldest policy
+func (m *Metrics) Dropped() uint64 {
+	return atomic.LoadUint64(&m.dropped)
+}
+
+// Disconnected returns the number of connections closed by the disconnect policy
+func (m *Metrics) Disconnected() uint64 {
+	return atomic.LoadUint64(&m.disconnected)
+}
+
+// PongTimeouts returns the number of connections closed for missing a pong
+func (m *Metrics) PongTimeouts() uint64 {
+	return atomic.LoadUint64(&m.pongTimeouts)
+}
+
+// IdleTimeouts returns the number of connections closed for being idle for too long
+func (m *Metrics) IdleTimeouts() uint64 {
+	return atomic.LoadUint64(&m.idleTimeouts)
+}
+
+// Conn is the server side websocket connection. Frames sent to the connection are queued
+// and written by a single writer goroutine, so a stalled client never blocks the senders
+// and frames are never interleaved. The writer runs only while there are frames to write,
+// so an idle connection holds no goroutines
+type Conn struct {
+	// lastPong and lastRead are the unix time in nanoseconds of the last pong and of the last frame received,
+	// they go first to be 64-bit aligned for atomic operations
+	lastPong int64
+	lastRead int64
+	net.Conn
+	opts    Options
+	mu      sync.Mutex
+	queue   chan []byte
+	writing bool
+	// closing is set by Shutdown, the connection is closed once the queue is written
+	closing bool
+	done    chan struct{}
+	once    sync.Once
+}
+
+func New(conn net.Conn, opts Options) *Conn {
+	if opts.QueueSize < 1 {
+		opts.QueueSize = 1
+	}
+	if opts.Metrics == nil {
+		opts.Metrics = &Metrics{}
+	}
+	c := &Conn{
+		lastRead: time.Now().UnixNano(),
+		Conn:     conn,
+		opts:     opts,
+		queue:    make(chan []byte, opts.QueueSize),
+		done:     make(chan struct{}),
+	}
+	if opts.Pinger != nil {
+		opts.Pinger.add(c)
+	}
+	return c
+}
+
+// LastPong returns the time of the last pong received, zero time if there were none
+func (c *Conn) LastPong() time.Time {
+	if ns := atomic.LoadInt64(&c.lastPong); ns != 0 {
+		return time.Unix(0, ns)
+	}
+	return time.Time{}
+}
+
+// LastRead returns the time of the last frame received, the connection creation time if there were none
+func (c *Conn) LastRead() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.lastRead))
+}
+
+// Writes queued frames until the queue is empty or the connection is closed
+func (c *Conn) writeLoop() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case frame := <-c.queue:
+			if c.opts.WriteTimeout > 0 {
+				_ = c.Conn.SetWriteDeadline(time.Now().Add(c.opts.WriteTimeout))
+			}
+			if _, err := c.Conn.Write(frame); err != nil {
+				_ = c.Close()
+				return
+			}
+		default:
+			// frames are queued under the lock, so none can be missed
+			c.mu.Lock()
+			if len(c.queue) == 0 {
+				c.writing = false
+				closing := c.closing
+				c.mu.Unlock()
+				if closing {
+					_ = c.Close()
+				}
+				return
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+// SendText queues the text message
+func (c *Conn) SendText(p []byte) error {
+	return c.SendFrame(CompileText(p))
+}
+
+// SendFrame queues the compiled frame, the frame must not be modified afterwards
+func (c *Conn) SendFrame(frame []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closing {
+		return ErrClosed
+	}
+	for {
+		select {
+		case <-c.done:
+			return ErrClosed
+		default:
+		}
+
+		if c.enqueue(frame) {
+			return nil
+		}
+
+		if c.opts.Policy == PolicyDisconnect {
+			atomic.AddUint64(&c.opts.Metrics.disconnected, 1)
+			_ = c.Close()
+			return ErrSlowConsumer
+		}
+		select {
+		case <-c.queue:
+			atomic.AddUint64(&c.opts.Metrics.dropped, 1)
+		default:
+			// the writer took a frame in the meantime
+		}
+	}
+}
+
+// Queues the frame and starts the writer if needed, reports whether the queue had room for the frame.
+// Must be called under the lock
+func (c *Conn) enqueue(frame []byte) bool {
+	select {
+	case c.queue <- frame:
+		if !c.writing {
+			c.writing = true
+			go c.writeLoop()
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+// Shutdown closes the connection gracefully: the close frame with the status code and reason is queued
+// after the frames waiting to be written and the connection is closed once it is written.
+// Frames sent afterwards are rejected, the reason is truncated to fit the control frame
+func (c *Conn) Shutdown(code ws.StatusCode, reason string) error {
+	frame := ws.MustCompileFrame(ws.NewCloseFrame(ws.NewCloseFrameBody(code, truncateReason(reason))))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.done:
+		return ErrClosed
+	default:
+	}
+	if c.closing {
+		return ErrClosed
+	}
+	c.closing = true
+	// the close frame is queued regardless of the slow consumer policy
+	for !c.enqueue(frame) {
+		select {
+		case <-c.queue:
+			atomic.AddUint64(&c.opts.Metrics.dropped, 1)
+		default:
+		}
+	}
+	return nil
+}
+
+// Cuts the close reason to the control frame payload left after the status code, keeping it valid UTF-8
+func truncateReason(reason string) string {
+	max := ws.MaxControlFramePayloadSize - 2
+	if len(reason) <= max {
+		return reason
+	}
+	reason = reason[:max]
+	for !utf8.ValidString(reason) {
+		reason = reason[:len(reason)-1]
+	}
+	return reason
+}
+
+// Queues the ping control frame
+func (c *Conn) ping() error {
+	return c.SendFrame(ws.MustCompileFrame(ws.NewPingFrame([]byte("ping"))))
+}
+
+// ReadText reads the next text message from the client, or the next binary one if the connection is binary.
+// Control frames are handled on the way, replies to them go through the outbound queue
+func (c *Conn) ReadText() ([]byte, error) {
+	for {
+		p, ok, err := c.ReadFrame()
+		if err != nil || ok {
+			return p, err
+		}
+	}
+}
+
+// ReadFrame reads the next frame from the client, ok is true if it was a text message,
+// or a binary one if the connection is binary. Control frames are handled and other data frames are discarded,
+// a fragmented message is read till the end
+func (c *Conn) ReadFrame() (p []byte, ok bool, err error) {
+	rd := &wsutil.Reader{
+		Source:         c.Conn,
+		State:          ws.StateServerSide,
+		OnIntermediate: c.handleControl,
+	}
+	var msg wsflate.MessageState
+	if c.opts.Compression {
+		rd.State |= ws.StateExtended
+		rd.Extensions = []wsutil.RecvExtension{&msg}
+	}
+	hdr, err := rd.NextFrame()
+	if err != nil {
+		return nil, false, err
+	}
+	atomic.StoreInt64(&c.lastRead, time.Now().UnixNano())
+	if hdr.OpCode.IsControl() {
+		return nil, false, c.handleControl(hdr, rd)
+	}
+	opCode := ws.OpText
+	if c.opts.Binary {
+		opCode = ws.OpBinary
+	}
+	if hdr.OpCode != opCode {
+		return nil, false, rd.Discard()
+	}
+	var src io.Reader = rd
+	if msg.IsCompressed() {
+		src = wsflate.NewReader(rd, newDecompressor)
+	}
+	if p, err = c.readMessage(src); err != nil {
+		return nil, false, err
+	}
+	// the payload is checked as a whole since compressed one is not UTF-8
+	if hdr.OpCode == ws.OpText && !utf8.Valid(p) {
+		return nil, false, ErrInvalidUTF8
+	}
+	return p, true, nil
+}
+
+// Reads the message up to the max message size, so neither big messages nor decompression bombs
+// are kept in memory. The connection is shut down if the message exceeds it
+func (c *Conn) readMessage(r io.Reader) ([]byte, error) {
+	if c.opts.MaxMessageSize <= 0 {
+		return ioutil.ReadAll(r)
+	}
+	p, err := ioutil.ReadAll(io.LimitReader(r, c.opts.MaxMessageSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(p)) > c.opts.MaxMessageSize {
+		c.abort(ws.StatusMessageTooBig, ErrMessageTooBig.Error())
+		return nil, ErrMessageTooBig
+	}
+	return p, nil
+}
+
+// Shuts the connection down and waits a while for the close frame to be written,
+// so the client learns the reason before the reader closes the connection
+func (c *Conn) abort(code ws.StatusCode, reason string) {
+	if err := c.Shutdown(code, reason); err != nil {
+		return
+	}
+	timer := time.NewTimer(closeTimeout)
+	defer timer.Stop()
+	select {
+	case <-c.done:
+	case <-timer.C:
+	}
+}
+
+func newDecompressor(r io.Reader) wsflate.Decompressor {
+	return flate.NewReader(r)
+}
+
+// Compression reports whether the client negotiated permessage-deflate
+func (c *Conn) Compression() bool {
+	return c.opts.Compression
+}
+
+func (c *Conn) handleControl(h ws.Header, r io.Reader) error {
+	payload, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	switch h.OpCode {
+	case ws.OpPing:
+		return c.SendFrame(ws.MustCompileFrame(ws.NewPongFrame(payload)))
+	case ws.OpPong:
+		atomic.StoreInt64(&c.lastPong, time.Now().UnixNano())
+	case ws.OpClose:
+		// echo the status code, RFC6455#5.5.1
+		var body []byte
+		code, reason := ws.StatusNoStatusRcvd, ""
+		if len(payload) >= 2 {
+			code, reason = ws.ParseCloseFrameData(payload)
+			body = payload[:2]
+		}
+		_ = c.SendFrame(ws.MustCompileFrame(ws.NewCloseFrame(body)))
+		return wsutil.ClosedError{Code: code, Reason: reason}
+	}
+	return nil
+}
+
+// Close stops the writer and closes the underlying connection, frames left in the queue are discarded
+func (c *Conn) Close() error {
+	_, err := c.close()
+	return err
+}
+
+// Closes the connection, reports whether it was closed by this call
+func (c *Conn) close() (closed bool, err error) {
+	err = ErrClosed
+	c.once.Do(func() {
+		closed = true
+		if c.opts.Pinger != nil {
+			c.opts.Pinger.remove(c)
+		}
+		if c.opts.OnClose != nil {
+			c.opts.OnClose()
+		}
+		close(c.done)
+		err = c.Conn.Close()
+	})
+	return closed, err
+}
+
+// CompileText returns the server side text frame, ready to be sent to any number of connections
+func CompileText(p []byte) []byte {
+	return ws.MustCompileFrame(ws.NewTextFrame(p))
+}
+
+// CompileBinary returns the server side binary frame, ready to be sent to any number of connections
+func CompileBinary(p []byte) []byte {
+	return ws.MustCompileFrame(ws.NewBinaryFrame(p))
+}
+
+// CompileCompressed returns the permessage-deflate compressed frame of the text or binary message.
+// The message is compressed without context takeover, so the frame is ready to be sent to any number
+// of connections which negotiated the compression
+func CompileCompressed(op ws.OpCode, p []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	// the flush ends the message, the writer must not be closed, see RFC7692#7.2.1
+	w := wsflate.NewWriter(&buf, newCompressor)
+	if _, err := w.Write(p); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	frame := ws.NewFrame(op, true, buf.Bytes())
+	frame.Header.Rsv = ws.Rsv(true, false, false)
+	return ws.CompileFrame(frame)
+}
+
+func newCompressor(w io.Writer) wsflate.Compressor {
+	// no error is returned for a valid level
+	f, _ := flate.NewWriter(w, flate.BestSpeed)
+	return f
+}
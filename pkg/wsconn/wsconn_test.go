@@ -0,0 +1,286 @@
+package wsconn
+
+import (
+	"bytes"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newPipe(opts Options) (*Conn, net.Conn) {
+	serverConn, clientConn := net.Pipe()
+	return New(serverConn, opts), clientConn
+}
+
+// Reads text messages until nothing arrives within the timeout
+func readAll(t *testing.T, conn net.Conn, timeout time.Duration) []string {
+	var result []string
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(timeout))
+		b, err := wsutil.ReadServerText(conn)
+		if err != nil {
+			return result
+		}
+		result = append(result, string(b))
+	}
+}
+
+func TestSendText(t *testing.T) {
+	c, client := newPipe(Options{QueueSize: 10})
+	defer c.Close()
+	defer client.Close()
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, c.SendText([]byte(strconv.Itoa(i))))
+	}
+	assert.Equal(t, []string{"0", "1", "2", "3", "4"}, readAll(t, client, 50*time.Millisecond))
+
+	require.NoError(t, c.Close())
+	assert.Equal(t, ErrClosed, c.SendText([]byte("5")))
+	assert.Equal(t, ErrClosed, c.Close())
+}
+
+func TestDropOldest(t *testing.T) {
+	metrics := &Metrics{}
+	c, client := newPipe(Options{QueueSize: 3, Policy: PolicyDropOldest, Metrics: metrics})
+	defer c.Close()
+	defer client.Close()
+
+	// nobody reads, the writer is stuck on the first frame it took
+	const count = 10
+	for i := 0; i < count; i++ {
+		require.NoError(t, c.SendText([]byte(strconv.Itoa(i))))
+	}
+
+	received := readAll(t, client, 50*time.Millisecond)
+	require.True(t, len(received) >= 3)
+	assert.Equal(t, []string{"7", "8", "9"}, received[len(received)-3:])
+	assert.Equal(t, uint64(count-len(received)), metrics.Dropped())
+	assert.Zero(t, metrics.Disconnected())
+}
+
+func TestDisconnect(t *testing.T) {
+	metrics := &Metrics{}
+	c, client := newPipe(Options{QueueSize: 3, Policy: PolicyDisconnect, Metrics: metrics})
+	defer client.Close()
+
+	var err error
+	for i := 0; i < 10 && err == nil; i++ {
+		err = c.SendText([]byte(strconv.Itoa(i)))
+	}
+	assert.Equal(t, ErrSlowConsumer, err)
+	assert.Equal(t, ErrClosed, c.SendText([]byte("next")))
+	assert.Equal(t, uint64(1), metrics.Disconnected())
+	assert.Zero(t, metrics.Dropped())
+}
+
+func TestWriteTimeout(t *testing.T) {
+	c, client := newPipe(Options{QueueSize: 3, WriteTimeout: 10 * time.Millisecond})
+	defer client.Close()
+
+	require.NoError(t, c.SendText([]byte("never read")))
+	assert.Eventually(t, func() bool {
+		return c.SendText([]byte("next")) == ErrClosed
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestReadText(t *testing.T) {
+	c, client := newPipe(Options{QueueSize: 10})
+	defer c.Close()
+	defer client.Close()
+
+	go func() {
+		_ = wsutil.WriteClientMessage(client, ws.OpPing, []byte("hello"))
+		_ = wsutil.WriteClientBinary(client, []byte("skipped"))
+		_ = wsutil.WriteClientText(client, []byte("text"))
+		_ = wsutil.WriteClientMessage(client, ws.OpClose, ws.NewCloseFrameBody(ws.StatusGoingAway, "bye"))
+	}()
+
+	b, err := c.ReadText()
+	require.NoError(t, err)
+	assert.Equal(t, "text", string(b))
+
+	_, err = c.ReadText()
+	assert.Equal(t, wsutil.ClosedError{Code: ws.StatusGoingAway, Reason: "bye"}, err)
+
+	// replies to the control frames are sent through the queue
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	frame, err := ws.ReadFrame(client)
+	require.NoError(t, err)
+	assert.Equal(t, ws.OpPong, frame.Header.OpCode)
+	assert.Equal(t, "hello", string(frame.Payload))
+
+	frame, err = ws.ReadFrame(client)
+	require.NoError(t, err)
+	assert.Equal(t, ws.OpClose, frame.Header.OpCode)
+	code, _ := ws.ParseCloseFrameData(frame.Payload)
+	assert.Equal(t, ws.StatusGoingAway, code)
+}
+
+func TestReadBinary(t *testing.T) {
+	c, client := newPipe(Options{QueueSize: 10, Binary: true})
+	defer c.Close()
+	defer client.Close()
+
+	go func() {
+		_ = wsutil.WriteClientText(client, []byte("skipped"))
+		_ = wsutil.WriteClientBinary(client, []byte{0x81, 0xa1, 'a', 0x01})
+	}()
+
+	b, err := c.ReadText()
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x81, 0xa1, 'a', 0x01}, b)
+}
+
+func TestCompression(t *testing.T) {
+	c, client := newPipe(Options{QueueSize: 10, Compression: true})
+	defer c.Close()
+	defer client.Close()
+
+	go func() {
+		writeCompressed(client, []byte("hello, hello, hello"))
+		_ = wsutil.WriteClientText(client, []byte("plain"))
+	}()
+
+	b, err := c.ReadText()
+	require.NoError(t, err)
+	assert.Equal(t, "hello, hello, hello", string(b))
+	b, err = c.ReadText()
+	require.NoError(t, err)
+	assert.Equal(t, "plain", string(b))
+}
+
+// Writes the compressed frame the way a client would send it, masked
+func writeCompressed(client net.Conn, p []byte) {
+	frame, _ := CompileCompressed(ws.OpText, p)
+	f, _ := ws.ReadFrame(bytes.NewReader(frame))
+	f.Header.Masked = true
+	f.Header.Mask = ws.NewMask()
+	ws.Cipher(f.Payload, f.Header.Mask, 0)
+	_ = ws.WriteFrame(client, f)
+}
+
+// Reads frames until the close one, returns its status code
+func readCloseCode(t *testing.T, client net.Conn) ws.StatusCode {
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		frame, err := ws.ReadFrame(client)
+		require.NoError(t, err)
+		if frame.Header.OpCode == ws.OpClose {
+			code, _ := ws.ParseCloseFrameData(frame.Payload)
+			return code
+		}
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	t.Run("plain", func(t *testing.T) {
+		c, client := newPipe(Options{QueueSize: 10, MaxMessageSize: 10})
+		defer c.Close()
+		defer client.Close()
+
+		go func() {
+			_ = wsutil.WriteClientText(client, []byte("0123456789"))
+			// fragments count as a whole
+			_ = ws.WriteFrame(client, ws.MaskFrameInPlace(ws.NewFrame(ws.OpText, false, []byte("012345"))))
+			_ = ws.WriteFrame(client, ws.MaskFrameInPlace(ws.NewFrame(ws.OpContinuation, true, []byte("678910"))))
+		}()
+
+		b, err := c.ReadText()
+		require.NoError(t, err)
+		assert.Equal(t, "0123456789", string(b))
+		_, err = c.ReadText()
+		assert.Equal(t, ErrMessageTooBig, err)
+		assert.Equal(t, ws.StatusMessageTooBig, readCloseCode(t, client))
+	})
+
+	t.Run("compressed", func(t *testing.T) {
+		c, client := newPipe(Options{QueueSize: 10, Compression: true, MaxMessageSize: 1024})
+		defer c.Close()
+		defer client.Close()
+
+		// a few kilobytes on the wire inflating to megabytes
+		go writeCompressed(client, bytes.Repeat([]byte("a"), 10<<20))
+
+		_, err := c.ReadText()
+		assert.Equal(t, ErrMessageTooBig, err)
+		assert.Equal(t, ws.StatusMessageTooBig, readCloseCode(t, client))
+	})
+}
+
+func TestCompressedWithoutNegotiation(t *testing.T) {
+	c, client := newPipe(Options{QueueSize: 10})
+	defer c.Close()
+	defer client.Close()
+
+	go func() {
+		frame := ws.NewTextFrame([]byte("x"))
+		frame.Header.Rsv = ws.Rsv(true, false, false)
+		_ = ws.WriteFrame(client, ws.MaskFrameInPlace(frame))
+	}()
+
+	_, err := c.ReadText()
+	assert.Equal(t, ws.ErrProtocolNonZeroRsv, err)
+}
+
+func TestShutdown(t *testing.T) {
+	closed := make(chan struct{})
+	c, client := newPipe(Options{QueueSize: 10, OnClose: func() { close(closed) }})
+	defer client.Close()
+
+	require.NoError(t, c.SendText([]byte("queued")))
+	require.NoError(t, c.Shutdown(ws.StatusPolicyViolation, strings.Repeat("é", 100)))
+	assert.Equal(t, ErrClosed, c.SendText([]byte("rejected")))
+	assert.Equal(t, ErrClosed, c.Shutdown(ws.StatusNormalClosure, ""))
+
+	// the queued frames go before the close frame
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	b, err := wsutil.ReadServerText(client)
+	require.NoError(t, err)
+	assert.Equal(t, "queued", string(b))
+	frame, err := ws.ReadFrame(client)
+	require.NoError(t, err)
+	require.Equal(t, ws.OpClose, frame.Header.OpCode)
+	code, reason := ws.ParseCloseFrameData(frame.Payload)
+	assert.Equal(t, ws.StatusPolicyViolation, code)
+	// two bytes a rune, cut to fit the status code into the control frame
+	assert.Equal(t, strings.Repeat("é", 61), reason)
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("connection is not closed after the close frame")
+	}
+}
+
+func TestOnClose(t *testing.T) {
+	var calls int
+	c, client := newPipe(Options{QueueSize: 10, OnClose: func() { calls++ }})
+	defer client.Close()
+
+	require.NoError(t, c.Close())
+	assert.Equal(t, ErrClosed, c.Close())
+	assert.Equal(t, 1, calls)
+}
+
+func TestWriterStopsWhenIdle(t *testing.T) {
+	c, client := newPipe(Options{QueueSize: 10})
+	defer c.Close()
+	defer client.Close()
+
+	require.NoError(t, c.SendText([]byte("1")))
+	assert.Equal(t, []string{"1"}, readAll(t, client, 50*time.Millisecond))
+	c.mu.Lock()
+	assert.False(t, c.writing)
+	c.mu.Unlock()
+
+	// the writer is started again
+	require.NoError(t, c.SendText([]byte("2")))
+	assert.Equal(t, []string{"2"}, readAll(t, client, 50*time.Millisecond))
+}
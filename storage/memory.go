@@ -0,0 +1,784 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"smotri.me/model"
+	"smotri.me/pkg/ratelimit"
+	"smotri.me/pkg/utils"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryStorage is the implementation of Storage keeping everything in process memory,
+// suitable for single-node mode and tests
+type memoryStorage struct {
+	sync.RWMutex
+	rooms  map[string]*memoryRoom
+	visits map[string]int64
+	// nodes holds lease expiration time by node ID
+	nodes map[string]time.Time
+	now   func() time.Time
+	done  chan struct{}
+	once  sync.Once
+	// publisher delivers the room events, publishing is serialized by publishMu,
+	// so the events are published in the seq order
+	publisher Publisher
+	publishMu sync.Mutex
+}
+
+// Publisher delivers the room events of the memory storage, implemented by msgbroker.MessageBroker
+type Publisher interface {
+	Publish(msg []byte, channel string) error
+}
+
+type memoryRoom struct {
+	room    model.Room
+	members map[string]*model.User
+	roles   map[string]string
+	// nodes serving the members (user ID => node ID)
+	nodes    map[string]string
+	messages []*model.ChatMessage
+	lastSeq  int64
+	// events kept for resync in seq order and the last allocated event seq
+	events   []roomEvent
+	eventSeq int64
+	// sessions of the disconnected members by resume token
+	sessions map[string]memorySession
+	// bans by user ID and the members with muted chat
+	bans  map[string]*model.Ban
+	muted map[string]bool
+	// last chat messages of the members by user ID
+	lastMessages map[string]model.LastMessage
+	// rate limit token buckets by name
+	buckets   map[string]*ratelimit.Bucket
+	expiresAt time.Time
+}
+
+type memorySession struct {
+	session   model.Session
+	expiresAt time.Time
+}
+
+type roomEvent struct {
+	seq  int64
+	data []byte
+}
+
+// NewMemory returns an in-memory implementation of Storage publishing the room events with the publisher,
+// expired rooms are removed by a janitor every cleanupInterval
+func NewMemory(cleanupInterval time.Duration, publisher Publisher) Storage {
+	return newMemory(cleanupInterval, time.Now, publisher)
+}
+
+func newMemory(cleanupInterval time.Duration, now func() time.Time, publisher Publisher) *memoryStorage {
+	s := &memoryStorage{
+		rooms:     make(map[string]*memoryRoom),
+		visits:    make(map[string]int64),
+		nodes:     make(map[string]time.Time),
+		now:       now,
+		done:      make(chan struct{}),
+		publisher: publisher,
+	}
+	go s.janitor(cleanupInterval)
+	return s
+}
+
+// Periodically removes expired rooms
+func (s *memoryStorage) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.deleteExpired()
+		}
+	}
+}
+
+func (s *memoryStorage) deleteExpired() {
+	now := s.now()
+	s.Lock()
+	for ID, r := range s.rooms {
+		if r.expired(now) {
+			delete(s.rooms, ID)
+			continue
+		}
+		for token, session := range r.sessions {
+			if !now.Before(session.expiresAt) {
+				delete(r.sessions, token)
+			}
+		}
+	}
+	s.Unlock()
+}
+
+// Returns the room if it exists and is not expired yet, must be called under lock
+func (s *memoryStorage) room(roomID string) (*memoryRoom, error) {
+	r, exists := s.rooms[roomID]
+	if !exists || r.expired(s.now()) {
+		return nil, fmt.Errorf("room '%s' not found", roomID)
+	}
+	return r, nil
+}
+
+func (s *memoryStorage) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+	})
+	return nil
+}
+
+func (s *memoryStorage) TempRoomExist(roomID string) bool {
+	s.RLock()
+	defer s.RUnlock()
+	_, err := s.room(roomID)
+	return err == nil
+}
+
+func (s *memoryStorage) CreateTempRoom(room *model.Room, exp time.Duration) (string, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	var ID string
+	for i := 5; i <= 15; i++ {
+		newID := utils.RandString(i)
+		if _, err := s.room(newID); err != nil {
+			ID = newID
+			break
+		}
+	}
+
+	if ID == "" {
+		return "", errors.New("unable to generate an unique ID")
+	}
+
+	s.rooms[ID] = &memoryRoom{
+		room: model.Room{
+			ID:            ID,
+			Title:         room.Title,
+			VideoURL:      room.VideoURL,
+			Playback:      model.NewPlayback(),
+			Chat:          model.NewChatSettings(),
+			HostToken:     room.HostToken,
+			ControlPolicy: policyOrDefault(room.ControlPolicy),
+		},
+		members:      make(map[string]*model.User),
+		roles:        make(map[string]string),
+		nodes:        make(map[string]string),
+		sessions:     make(map[string]memorySession),
+		bans:         make(map[string]*model.Ban),
+		muted:        make(map[string]bool),
+		buckets:      make(map[string]*ratelimit.Bucket),
+		lastMessages: make(map[string]model.LastMessage),
+		expiresAt:    s.now().Add(exp),
+	}
+	return ID, nil
+}
+
+func (s *memoryStorage) GetTempRoom(roomID string) (*model.Room, error) {
+	s.RLock()
+	defer s.RUnlock()
+	r, err := s.room(roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	room := r.room
+	playback := *r.room.Playback
+	room.Playback = &playback
+	chat := *r.room.Chat
+	room.Chat = &chat
+	room.Members = make([]*model.User, 0, len(r.members))
+	for _, m := range r.members {
+		member := copyUser(m)
+		member.Role = roleOrDefault(r.roles[m.ID])
+		room.Members = append(room.Members, member)
+	}
+	sort.Slice(room.Members, func(i, j int) bool {
+		return room.Members[i].ID < room.Members[j].ID
+	})
+	return &room, nil
+}
+
+func (s *memoryStorage) UpdateTempRoom(room *model.Room) error {
+	if room.ID == "" {
+		return fmt.Errorf("invalid room id: %s", room.ID)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	r, err := s.room(room.ID)
+	if err != nil {
+		return err
+	}
+	r.room.Title = room.Title
+	r.room.VideoURL = room.VideoURL
+	return nil
+}
+
+func (s *memoryStorage) AddUserToRoom(roomID string, u *model.User) error {
+	s.Lock()
+	defer s.Unlock()
+	r, err := s.room(roomID)
+	if err != nil {
+		return err
+	}
+	if _, exists := r.members[u.ID]; exists {
+		return fmt.Errorf("member with ID:%s already exists", u.ID)
+	}
+	r.members[u.ID] = copyUser(u)
+	if u.Role != "" && u.Role != model.RoleMember {
+		r.roles[u.ID] = u.Role
+	}
+	if u.NodeID != "" {
+		r.nodes[u.ID] = u.NodeID
+	}
+	return nil
+}
+
+func (s *memoryStorage) UpdateRoomUser(roomID string, u *model.User) error {
+	s.Lock()
+	defer s.Unlock()
+	r, err := s.room(roomID)
+	if err != nil {
+		return err
+	}
+	if _, exists := r.members[u.ID]; !exists {
+		return fmt.Errorf("member with ID:%s not found", u.ID)
+	}
+	r.members[u.ID] = copyUser(u)
+	return nil
+}
+
+func (s *memoryStorage) RemoveUserFromRoom(roomID string, userID string) error {
+	s.Lock()
+	defer s.Unlock()
+	if r, err := s.room(roomID); err == nil {
+		delete(r.members, userID)
+		delete(r.roles, userID)
+		delete(r.nodes, userID)
+	}
+	return nil
+}
+
+func (s *memoryStorage) SetMemberRole(roomID string, userID string, role string) error {
+	s.Lock()
+	defer s.Unlock()
+	r, err := s.room(roomID)
+	if err != nil {
+		return err
+	}
+	if _, exists := r.members[userID]; !exists {
+		return fmt.Errorf("member with ID:%s not found", userID)
+	}
+	if role == "" || role == model.RoleMember {
+		delete(r.roles, userID)
+	} else {
+		r.roles[userID] = role
+	}
+	return nil
+}
+
+func (s *memoryStorage) GetMemberRole(roomID string, userID string) (string, error) {
+	s.RLock()
+	defer s.RUnlock()
+	r, exists := s.rooms[roomID]
+	if !exists {
+		return model.RoleMember, nil
+	}
+	return roleOrDefault(r.roles[userID]), nil
+}
+
+func (s *memoryStorage) GetControlPolicy(roomID string) (string, error) {
+	s.RLock()
+	defer s.RUnlock()
+	r, err := s.room(roomID)
+	if err != nil {
+		return "", err
+	}
+	return r.room.ControlPolicy, nil
+}
+
+func (s *memoryStorage) UpdateControlPolicy(roomID string, policy string) error {
+	s.Lock()
+	defer s.Unlock()
+	r, err := s.room(roomID)
+	if err != nil {
+		return err
+	}
+	r.room.ControlPolicy = policy
+	return nil
+}
+
+func (s *memoryStorage) GetPlayback(roomID string) (*model.Playback, error) {
+	s.RLock()
+	defer s.RUnlock()
+	r, err := s.room(roomID)
+	if err != nil {
+		return nil, err
+	}
+	p := *r.room.Playback
+	return &p, nil
+}
+
+func (s *memoryStorage) UpdatePlayback(roomID string, update *model.PlaybackUpdate) (*model.Playback, error) {
+	s.Lock()
+	defer s.Unlock()
+	r, err := s.room(roomID)
+	if err != nil {
+		return nil, err
+	}
+	r.room.Playback = r.room.Playback.Apply(update)
+	p := *r.room.Playback
+	return &p, nil
+}
+
+func (s *memoryStorage) GetChatSettings(roomID string) (*model.ChatSettings, error) {
+	s.RLock()
+	defer s.RUnlock()
+	r, err := s.room(roomID)
+	if err != nil {
+		return nil, err
+	}
+	settings := *r.room.Chat
+	return &settings, nil
+}
+
+func (s *memoryStorage) UpdateChatSettings(roomID string, settings *model.ChatSettings) error {
+	s.Lock()
+	defer s.Unlock()
+	r, err := s.room(roomID)
+	if err != nil {
+		return err
+	}
+	c := *settings
+	r.room.Chat = &c
+	return nil
+}
+
+func (s *memoryStorage) GetLastMessage(roomID, userID string) (*model.LastMessage, error) {
+	s.RLock()
+	defer s.RUnlock()
+	r, err := s.room(roomID)
+	if err != nil {
+		return nil, err
+	}
+	m, exists := r.lastMessages[userID]
+	if !exists {
+		return nil, nil
+	}
+	return &m, nil
+}
+
+func (s *memoryStorage) SaveLastMessage(roomID, userID string, m *model.LastMessage) error {
+	s.Lock()
+	defer s.Unlock()
+	r, err := s.room(roomID)
+	if err != nil {
+		return err
+	}
+	r.lastMessages[userID] = *m
+	return nil
+}
+
+func (s *memoryStorage) AddRoomMessage(roomID string, m *model.ChatMessage) error {
+	s.Lock()
+	defer s.Unlock()
+	r, err := s.room(roomID)
+	if err != nil {
+		return err
+	}
+	r.lastSeq++
+	m.Seq = r.lastSeq
+	c := *m
+	r.messages = append(r.messages, &c)
+	if excess := len(r.messages) - HistorySize; excess > 0 {
+		r.messages = append(r.messages[:0:0], r.messages[excess:]...)
+	}
+	return nil
+}
+
+func (s *memoryStorage) GetRoomMessages(roomID string, before int64, limit int) ([]*model.ChatMessage, error) {
+	s.RLock()
+	defer s.RUnlock()
+	r, err := s.room(roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	end := len(r.messages)
+	if before > 0 {
+		end = sort.Search(len(r.messages), func(i int) bool {
+			return r.messages[i].Seq >= before
+		})
+	}
+	start := end - limit
+	if start < 0 {
+		start = 0
+	}
+	messages := make([]*model.ChatMessage, 0, end-start)
+	for _, m := range r.messages[start:end] {
+		messages = append(messages, copyMessage(m))
+	}
+	return messages, nil
+}
+
+func (s *memoryStorage) GetRoomMessage(roomID, messageID string) (*model.ChatMessage, error) {
+	s.RLock()
+	defer s.RUnlock()
+	r, err := s.room(roomID)
+	if err != nil {
+		return nil, err
+	}
+	i := r.messageIndex(messageID)
+	if i < 0 {
+		return nil, ErrMessageNotFound
+	}
+	return copyMessage(r.messages[i]), nil
+}
+
+func (s *memoryStorage) EditRoomMessage(roomID, messageID, content string, editedAt int64) (*model.ChatMessage, error) {
+	s.Lock()
+	defer s.Unlock()
+	r, err := s.room(roomID)
+	if err != nil {
+		return nil, err
+	}
+	i := r.messageIndex(messageID)
+	if i < 0 {
+		return nil, ErrMessageNotFound
+	}
+	// messages returned earlier share nothing with the edited one
+	m := copyMessage(r.messages[i])
+	m.Edit(content, editedAt)
+	r.messages[i] = m
+	return copyMessage(m), nil
+}
+
+func (s *memoryStorage) RemoveRoomMessage(roomID, messageID string) error {
+	s.Lock()
+	defer s.Unlock()
+	r, err := s.room(roomID)
+	if err != nil {
+		return err
+	}
+	i := r.messageIndex(messageID)
+	if i < 0 {
+		return ErrMessageNotFound
+	}
+	r.messages = append(r.messages[:i:i], r.messages[i+1:]...)
+	return nil
+}
+
+// Returns the position of the message in the history, -1 if it is not there
+func (r *memoryRoom) messageIndex(messageID string) int {
+	for i, m := range r.messages {
+		if m.ID == messageID {
+			return i
+		}
+	}
+	return -1
+}
+
+// Returns the deep copy of the message
+func copyMessage(m *model.ChatMessage) *model.ChatMessage {
+	c := *m
+	c.Edits = make([]*model.MessageEdit, len(m.Edits))
+	for i, e := range m.Edits {
+		edit := *e
+		c.Edits[i] = &edit
+	}
+	if len(c.Edits) == 0 {
+		c.Edits = nil
+	}
+	return &c
+}
+
+func (s *memoryStorage) SaveRoomBan(roomID string, ban *model.Ban) error {
+	s.Lock()
+	defer s.Unlock()
+	r, err := s.room(roomID)
+	if err != nil {
+		return err
+	}
+	b := *ban
+	r.bans[ban.UserID] = &b
+	return nil
+}
+
+func (s *memoryStorage) GetRoomBans(roomID string) ([]*model.Ban, error) {
+	s.RLock()
+	defer s.RUnlock()
+	r, err := s.room(roomID)
+	if err != nil {
+		return nil, err
+	}
+	bans := make([]*model.Ban, 0, len(r.bans))
+	for _, ban := range r.bans {
+		b := *ban
+		bans = append(bans, &b)
+	}
+	sortBans(bans)
+	return bans, nil
+}
+
+func (s *memoryStorage) RemoveRoomBan(roomID, userID string) error {
+	s.Lock()
+	defer s.Unlock()
+	r, err := s.room(roomID)
+	if err != nil {
+		return err
+	}
+	if _, exists := r.bans[userID]; !exists {
+		return ErrBanNotFound
+	}
+	delete(r.bans, userID)
+	return nil
+}
+
+func (s *memoryStorage) SetMemberMuted(roomID, userID string, muted bool) error {
+	s.Lock()
+	defer s.Unlock()
+	r, err := s.room(roomID)
+	if err != nil {
+		return err
+	}
+	if muted {
+		r.muted[userID] = true
+	} else {
+		delete(r.muted, userID)
+	}
+	return nil
+}
+
+func (s *memoryStorage) IsMemberMuted(roomID, userID string) (bool, error) {
+	s.RLock()
+	defer s.RUnlock()
+	r, exists := s.rooms[roomID]
+	if !exists {
+		return false, nil
+	}
+	return r.muted[userID], nil
+}
+
+func (s *memoryStorage) TakeRoomToken(roomID, bucket string, limit ratelimit.Limit) (bool, error) {
+	if limit.Unlimited() {
+		return true, nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	r, err := s.room(roomID)
+	if err != nil {
+		return false, err
+	}
+	b, exists := r.buckets[bucket]
+	if !exists {
+		b = ratelimit.NewBucket(limit)
+		r.buckets[bucket] = b
+	}
+	return b.AllowAt(s.now()), nil
+}
+
+// The storage lock is not held while publishing, so the message handlers may use the storage
+func (s *memoryStorage) PublishRoomEvent(roomID, channel string, event []byte) (int64, error) {
+	if err := checkEvent(event); err != nil {
+		return 0, err
+	}
+	s.publishMu.Lock()
+	defer s.publishMu.Unlock()
+	seq, stamped, err := s.addRoomEvent(roomID, event)
+	if err != nil {
+		return 0, err
+	}
+	return seq, s.publisher.Publish(stamped, channel)
+}
+
+// Allocates the next seq of the room broadcasts and keeps the event stamped with it
+func (s *memoryStorage) addRoomEvent(roomID string, event []byte) (int64, []byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	r, err := s.room(roomID)
+	if err != nil {
+		return 0, nil, err
+	}
+	r.eventSeq++
+	stamped := stampEvent(event, r.eventSeq)
+	r.events = append(r.events, roomEvent{seq: r.eventSeq, data: stamped})
+	if excess := len(r.events) - EventRetention; excess > 0 {
+		r.events = append(r.events[:0:0], r.events[excess:]...)
+	}
+	return r.eventSeq, stamped, nil
+}
+
+func (s *memoryStorage) GetRoomEvents(roomID string, after int64) ([][]byte, int64, error) {
+	s.RLock()
+	defer s.RUnlock()
+	r, err := s.room(roomID)
+	if err != nil {
+		return nil, 0, err
+	}
+	if after > r.eventSeq {
+		return nil, r.eventSeq, ErrEventsExpired
+	}
+	if after == r.eventSeq {
+		return [][]byte{}, r.eventSeq, nil
+	}
+	if len(r.events) == 0 || r.events[0].seq > after+1 {
+		return nil, r.eventSeq, ErrEventsExpired
+	}
+	i := sort.Search(len(r.events), func(i int) bool {
+		return r.events[i].seq > after
+	})
+	events := make([][]byte, 0, len(r.events)-i)
+	for _, e := range r.events[i:] {
+		events = append(events, e.data)
+	}
+	return events, r.eventSeq, nil
+}
+
+func (s *memoryStorage) GetRoomSeq(roomID string) (int64, error) {
+	s.RLock()
+	defer s.RUnlock()
+	r, err := s.room(roomID)
+	if err != nil {
+		return 0, err
+	}
+	return r.eventSeq, nil
+}
+
+func (s *memoryStorage) SaveSession(roomID, token string, session *model.Session, exp time.Duration) error {
+	s.Lock()
+	defer s.Unlock()
+	r, err := s.room(roomID)
+	if err != nil {
+		return err
+	}
+	c := *session
+	c.User = copyUser(session.User)
+	r.sessions[token] = memorySession{session: c, expiresAt: s.now().Add(exp)}
+	return nil
+}
+
+func (s *memoryStorage) GetSession(roomID, token string) (*model.Session, error) {
+	s.RLock()
+	defer s.RUnlock()
+	r, err := s.room(roomID)
+	if err != nil {
+		return nil, err
+	}
+	session, exists := r.sessions[token]
+	if !exists || !s.now().Before(session.expiresAt) {
+		return nil, fmt.Errorf("session not found in room '%s'", roomID)
+	}
+	c := session.session
+	c.User = copyUser(session.session.User)
+	return &c, nil
+}
+
+func (s *memoryStorage) TakeSession(roomID, token string) (*model.Session, error) {
+	s.Lock()
+	defer s.Unlock()
+	r, err := s.room(roomID)
+	if err != nil {
+		return nil, err
+	}
+	session, exists := r.sessions[token]
+	delete(r.sessions, token)
+	if !exists || !s.now().Before(session.expiresAt) {
+		return nil, fmt.Errorf("session not found in room '%s'", roomID)
+	}
+	return &session.session, nil
+}
+
+func (s *memoryStorage) DeleteUserSession(roomID, userID string) (*model.Session, error) {
+	s.Lock()
+	defer s.Unlock()
+	r, err := s.room(roomID)
+	if err != nil {
+		return nil, err
+	}
+	for token, session := range r.sessions {
+		if session.session.User.ID != userID {
+			continue
+		}
+		delete(r.sessions, token)
+		if s.now().Before(session.expiresAt) {
+			return &session.session, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *memoryStorage) HeartbeatNode(nodeID string, lease time.Duration) error {
+	s.Lock()
+	defer s.Unlock()
+	s.nodes[nodeID] = s.now().Add(lease)
+	return nil
+}
+
+func (s *memoryStorage) ReapDeadNodes() ([]*model.User, error) {
+	now := s.now()
+	s.Lock()
+	defer s.Unlock()
+
+	dead := make(map[string]bool)
+	for nodeID, expiresAt := range s.nodes {
+		if !now.Before(expiresAt) {
+			dead[nodeID] = true
+			delete(s.nodes, nodeID)
+		}
+	}
+	if len(dead) == 0 {
+		return nil, nil
+	}
+
+	var users []*model.User
+	for roomID, r := range s.rooms {
+		if r.expired(now) {
+			continue
+		}
+		for userID, nodeID := range r.nodes {
+			if !dead[nodeID] {
+				continue
+			}
+			delete(r.members, userID)
+			delete(r.roles, userID)
+			delete(r.nodes, userID)
+			users = append(users, &model.User{ID: userID, RoomID: roomID, NodeID: nodeID})
+		}
+	}
+	return users, nil
+}
+
+func (s *memoryStorage) IncrVisits() (int64, error) {
+	key := s.now().Format("02.01.06")
+	s.Lock()
+	defer s.Unlock()
+	s.visits[key]++
+	return s.visits[key], nil
+}
+
+func (s *memoryStorage) GetVisitsByDate(date time.Time) (int64, error) {
+	s.RLock()
+	defer s.RUnlock()
+	visits, exists := s.visits[date.Format("02.01.06")]
+	if !exists {
+		return 0, fmt.Errorf("no visits at %s", date.Format("02.01.06"))
+	}
+	return visits, nil
+}
+
+func (r *memoryRoom) expired(now time.Time) bool {
+	return !now.Before(r.expiresAt)
+}
+
+// Returns a detached copy of the user, the connection is never stored
+func copyUser(u *model.User) *model.User {
+	c := *u
+	c.Conn = nil
+	return &c
+}
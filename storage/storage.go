@@ -6,7 +6,10 @@ import (
 	"fmt"
 	"github.com/go-redis/redis/v7"
 	"smotri.me/model"
+	"smotri.me/pkg/ratelimit"
 	"smotri.me/pkg/utils"
+	"sort"
+	"strconv"
 	"time"
 )
 
@@ -18,10 +21,368 @@ type Storage interface {
 	AddUserToRoom(roomID string, u *model.User) error
 	UpdateRoomUser(roomID string, u *model.User) error
 	RemoveUserFromRoom(roomID string, userID string) error
+	// SetMemberRole changes the role of the room member
+	SetMemberRole(roomID string, userID string, role string) error
+	// GetMemberRole returns the role of the room member, model.RoleMember if it has no special role
+	GetMemberRole(roomID string, userID string) (string, error)
+	GetControlPolicy(roomID string) (string, error)
+	UpdateControlPolicy(roomID string, policy string) error
+	// GetPlayback returns the stored room playback state, not extrapolated
+	GetPlayback(roomID string) (*model.Playback, error)
+	// UpdatePlayback applies the update to the room playback state in one step and returns the new state
+	UpdatePlayback(roomID string, update *model.PlaybackUpdate) (*model.Playback, error)
+	GetChatSettings(roomID string) (*model.ChatSettings, error)
+	UpdateChatSettings(roomID string, settings *model.ChatSettings) error
+	// GetLastMessage returns what is remembered of the last chat message of the member, nil if there is none
+	GetLastMessage(roomID, userID string) (*model.LastMessage, error)
+	// SaveLastMessage remembers the last chat message of the member for the room lifetime
+	SaveLastMessage(roomID, userID string, m *model.LastMessage) error
+	// AddRoomMessage appends the message to the room history and sets its Seq,
+	// only the latest HistorySize messages are kept
+	AddRoomMessage(roomID string, m *model.ChatMessage) error
+	// GetRoomMessages returns up to limit latest messages with Seq less than before (any if before <= 0),
+	// in chronological order
+	GetRoomMessages(roomID string, before int64, limit int) ([]*model.ChatMessage, error)
+	// GetRoomMessage returns the message of the room history, ErrMessageNotFound if it is not kept
+	GetRoomMessage(roomID, messageID string) (*model.ChatMessage, error)
+	// EditRoomMessage replaces the content of the message keeping the previous one in its edit history
+	// and returns the edited message, ErrMessageNotFound if it is not kept
+	EditRoomMessage(roomID, messageID, content string, editedAt int64) (*model.ChatMessage, error)
+	// RemoveRoomMessage removes the message from the room history, ErrMessageNotFound if it is not kept
+	RemoveRoomMessage(roomID, messageID string) error
+	// SaveRoomBan bans the member for the room lifetime, the ban replaces the previous one of the same user
+	SaveRoomBan(roomID string, ban *model.Ban) error
+	// GetRoomBans returns the bans of the room ordered by creation time
+	GetRoomBans(roomID string) ([]*model.Ban, error)
+	// RemoveRoomBan lifts the ban of the user, ErrBanNotFound if the user is not banned
+	RemoveRoomBan(roomID, userID string) error
+	// SetMemberMuted mutes or unmutes the chat of the user for the room lifetime
+	SetMemberMuted(roomID, userID string, muted bool) error
+	// IsMemberMuted reports whether the chat of the user is muted
+	IsMemberMuted(roomID, userID string) (bool, error)
+	// TakeRoomToken takes a token from the room bucket refilled at the limit, reports whether there was one.
+	// Buckets are shared by all the API instances
+	TakeRoomToken(roomID, bucket string, limit ratelimit.Limit) (bool, error)
+	// PublishRoomEvent stamps the encoded broadcast with the next room seq, keeps it for resync and publishes it
+	// to the channel in one atomic step, so the room broadcasts are published in the seq order.
+	// The broadcast is a JSON object without seq, only the latest EventRetention events are kept
+	PublishRoomEvent(roomID, channel string, event []byte) (int64, error)
+	// GetRoomEvents returns the kept events with seq greater than after in seq order and the last allocated seq,
+	// ErrEventsExpired is returned with the last seq if some of the events are not kept anymore
+	GetRoomEvents(roomID string, after int64) ([][]byte, int64, error)
+	// GetRoomSeq returns the seq of the last room broadcast
+	GetRoomSeq(roomID string) (int64, error)
+	// SaveSession keeps the session of the disconnected member for exp
+	SaveSession(roomID, token string, session *model.Session, exp time.Duration) error
+	// GetSession returns the session without removing it
+	GetSession(roomID, token string) (*model.Session, error)
+	// TakeSession returns and removes the session, so it can be resumed only once
+	TakeSession(roomID, token string) (*model.Session, error)
+	// DeleteUserSession removes the session of the disconnected member and returns it, nil if there is none
+	DeleteUserSession(roomID, userID string) (*model.Session, error)
+	// HeartbeatNode extends the lease of the API instance, members it serves are removed
+	// by ReapDeadNodes once the lease expires
+	HeartbeatNode(nodeID string, lease time.Duration) error
+	// ReapDeadNodes removes members served by the nodes with expired lease from their rooms
+	// and returns them, only ID, RoomID and NodeID of the users are set
+	ReapDeadNodes() ([]*model.User, error)
 	IncrVisits() (int64, error)
 	GetVisitsByDate(date time.Time) (int64, error)
+	Close() error
 }
 
+const (
+	// HistorySize is the max number of chat messages kept per room
+	HistorySize = 500
+	// EventRetention is the max number of room broadcasts kept for resync
+	EventRetention = 100
+)
+
+var (
+	// ErrEventsExpired is returned when the requested room events are not kept anymore
+	ErrEventsExpired = errors.New("room events expired")
+	// ErrMessageNotFound is returned when the chat message is not in the room history
+	ErrMessageNotFound = errors.New("message not found")
+	// ErrBanNotFound is returned when the user is not banned in the room
+	ErrBanNotFound = errors.New("ban not found")
+)
+
+// maxEditRetries is the max number of attempts to edit a message concurrently edited by others
+const maxEditRetries = 10
+
+var (
+	// Adds member only if the room exists and the member is not there yet, the member is indexed by its node,
+	// members, roles and nodes hashes inherit the room TTL
+	addMemberScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return redis.error_reply('room not found')
+end
+if redis.call('HSETNX', KEYS[2], ARGV[1], ARGV[2]) == 0 then
+	return redis.error_reply('member with ID:' .. ARGV[1] .. ' already exists')
+end
+if ARGV[3] ~= '' then
+	redis.call('HSET', KEYS[3], ARGV[1], ARGV[3])
+end
+if ARGV[4] ~= '' then
+	redis.call('HSET', KEYS[4], ARGV[1], ARGV[4])
+	redis.call('HSET', KEYS[5], ARGV[1], ARGV[5])
+end
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl > 0 then
+	redis.call('PEXPIRE', KEYS[2], ttl)
+	redis.call('PEXPIRE', KEYS[3], ttl)
+	redis.call('PEXPIRE', KEYS[4], ttl)
+end
+return 1
+`)
+
+	// Removes member and its node index entry, the node members key is built here
+	// the same way as nodeMembersKey does
+	removeMemberScript = redis.NewScript(`
+local node = redis.call('HGET', KEYS[3], ARGV[1])
+if node then
+	redis.call('HDEL', 'node:' .. node .. ':members', ARGV[1])
+end
+redis.call('HDEL', KEYS[1], ARGV[1])
+redis.call('HDEL', KEYS[2], ARGV[1])
+redis.call('HDEL', KEYS[3], ARGV[1])
+return 1
+`)
+
+	// Removes members of the node if its lease has expired, returns flat list of user ID and room ID pairs.
+	// Room keys are built here the same way as membersKey, rolesKey and roomNodesKey do
+	reapNodeScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return {}
+end
+local members = redis.call('HGETALL', KEYS[2])
+local result = {}
+for i = 1, #members, 2 do
+	local userID, room = members[i], 'room:' .. members[i + 1]
+	if redis.call('HDEL', room .. ':members', userID) == 1 then
+		table.insert(result, userID)
+		table.insert(result, members[i + 1])
+	end
+	redis.call('HDEL', room .. ':roles', userID)
+	redis.call('HDEL', room .. ':nodes', userID)
+end
+redis.call('DEL', KEYS[2])
+redis.call('SREM', KEYS[3], ARGV[1])
+return result
+`)
+
+	// Sets the role of an existing member, regular members are not kept in the roles hash
+	setRoleScript = redis.NewScript(`
+if redis.call('HEXISTS', KEYS[2], ARGV[1]) == 0 then
+	return redis.error_reply('member with ID:' .. ARGV[1] .. ' not found')
+end
+if ARGV[2] == '' then
+	redis.call('HDEL', KEYS[3], ARGV[1])
+	return 1
+end
+redis.call('HSET', KEYS[3], ARGV[1], ARGV[2])
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl > 0 then
+	redis.call('PEXPIRE', KEYS[3], ttl)
+end
+return 1
+`)
+
+	// Replaces member data only if the member is still in the room
+	updateMemberScript = redis.NewScript(`
+if redis.call('HEXISTS', KEYS[1], ARGV[1]) == 0 then
+	return redis.error_reply('member with ID:' .. ARGV[1] .. ' not found')
+end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+return 1
+`)
+
+	// Sets room fields given as ARGV name and value pairs only if the room exists,
+	// so an expired room is not recreated without TTL
+	setRoomFieldScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return redis.error_reply('room not found')
+end
+for i = 1, #ARGV, 2 do
+	redis.call('HSET', KEYS[1], ARGV[i], ARGV[i + 1])
+end
+return 1
+`)
+
+	// Applies the playback update to the stored state, the initial one if there is none: ARGV[1] is the position,
+	// ARGV[2] the rate, ARGV[3] the playing state ('1' or '0'), empty ones are left unchanged,
+	// and ARGV[4] the update time, which never goes back. Returns the new state
+	updatePlaybackScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return redis.error_reply('room not found')
+end
+local raw = redis.call('HGET', KEYS[1], 'playback')
+local p = {position = 0, playing = false, rate = 1, updated_at = 0}
+if raw then
+	p = cjson.decode(raw)
+end
+p.position = tonumber(ARGV[1])
+if ARGV[2] ~= '' then
+	p.rate = tonumber(ARGV[2])
+end
+if ARGV[3] ~= '' then
+	p.playing = ARGV[3] == '1'
+end
+local now = tonumber(ARGV[4])
+if now > p.updated_at then
+	p.updated_at = now
+end
+raw = cjson.encode(p)
+redis.call('HSET', KEYS[1], 'playback', raw)
+return raw
+`)
+
+	// Sets field of the room hash only if the room exists, the hash inherits the room TTL
+	setRoomHashFieldScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return redis.error_reply('room not found')
+end
+redis.call('HSET', KEYS[2], ARGV[1], ARGV[2])
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl > 0 then
+	redis.call('PEXPIRE', KEYS[2], ttl)
+end
+return 1
+`)
+
+	// Takes a token from the bucket refilled by ARGV[2] tokens per millisecond up to ARGV[1] tokens,
+	// the bucket inherits the room TTL. Returns 1 if there was a token
+	takeTokenScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return redis.error_reply('room not found')
+end
+local burst, rate, now = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local state = redis.call('HMGET', KEYS[2], 'tokens', 'updated_at')
+local tokens, updatedAt = tonumber(state[1]) or burst, tonumber(state[2]) or now
+if now > updatedAt then
+	tokens = math.min(burst, tokens + (now - updatedAt) * rate)
+	updatedAt = now
+end
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call('HSET', KEYS[2], 'tokens', tostring(tokens), 'updated_at', updatedAt)
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl > 0 then
+	redis.call('PEXPIRE', KEYS[2], ttl)
+end
+return allowed
+`)
+
+	// Appends message to the history (hash of messages by ID + index of IDs by seq) and trims it,
+	// all history keys inherit the room TTL
+	addMessageScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return redis.error_reply('room not found')
+end
+local seq = redis.call('INCR', KEYS[4])
+redis.call('HSET', KEYS[2], ARGV[1], ARGV[2])
+redis.call('ZADD', KEYS[3], seq, ARGV[1])
+local excess = redis.call('ZCARD', KEYS[3]) - tonumber(ARGV[3])
+if excess > 0 then
+	local old = redis.call('ZRANGE', KEYS[3], 0, excess - 1)
+	redis.call('HDEL', KEYS[2], unpack(old))
+	redis.call('ZREMRANGEBYRANK', KEYS[3], 0, excess - 1)
+end
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl > 0 then
+	redis.call('PEXPIRE', KEYS[2], ttl)
+	redis.call('PEXPIRE', KEYS[3], ttl)
+	redis.call('PEXPIRE', KEYS[4], ttl)
+end
+return seq
+`)
+
+	// Returns flat list of seq and message JSON pairs, newest first
+	getMessagesScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return redis.error_reply('room not found')
+end
+local index = redis.call('ZREVRANGEBYSCORE', KEYS[3], ARGV[1], '-inf', 'WITHSCORES', 'LIMIT', 0, ARGV[2])
+local result = {}
+for i = 1, #index, 2 do
+	local data = redis.call('HGET', KEYS[2], index[i])
+	if data then
+		table.insert(result, index[i + 1])
+		table.insert(result, data)
+	end
+end
+return result
+`)
+
+	// Increments the room broadcasts seq, stamps the event with it, adds the event scored by its seq,
+	// trims the oldest ones and publishes the event to the ARGV[3] channel.
+	// The seq and events inherit the room TTL
+	publishEventScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return redis.error_reply('room not found')
+end
+local seq = redis.call('INCR', KEYS[3])
+local event = '{"seq":' .. seq .. ',' .. string.sub(ARGV[1], 2)
+redis.call('ZADD', KEYS[2], seq, event)
+redis.call('ZREMRANGEBYRANK', KEYS[2], 0, -tonumber(ARGV[2]) - 1)
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl > 0 then
+	redis.call('PEXPIRE', KEYS[2], ttl)
+	redis.call('PEXPIRE', KEYS[3], ttl)
+end
+redis.call('PUBLISH', ARGV[3], event)
+return seq
+`)
+
+	// Saves the session of the room member for ARGV[2] milliseconds, the token ARGV[3] is kept by the user ID as long
+	saveSessionScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return redis.error_reply('room not found')
+end
+redis.call('SET', KEYS[2], ARGV[1], 'PX', ARGV[2])
+redis.call('SET', KEYS[3], ARGV[3], 'PX', ARGV[2])
+return 1
+`)
+
+	// Removes the session of the member by the token kept by the user ID, ARGV[1] is the session key prefix.
+	// Returns the removed session, nil if there is none
+	deleteUserSessionScript = redis.NewScript(`
+local token = redis.call('GET', KEYS[1])
+if not token then
+	return false
+end
+redis.call('DEL', KEYS[1])
+local key = ARGV[1] .. token
+local data = redis.call('GET', key)
+redis.call('DEL', key)
+return data
+`)
+
+	// Returns the last seq, 1 if the events after ARGV[1] are not kept anymore (0 otherwise) and the events
+	getEventsScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return redis.error_reply('room not found')
+end
+local last = tonumber(redis.call('GET', KEYS[3]) or '0')
+local after = tonumber(ARGV[1])
+if after >= last then
+	return {last, after > last and 1 or 0}
+end
+local first = redis.call('ZRANGE', KEYS[2], 0, 0, 'WITHSCORES')
+if #first == 0 or tonumber(first[2]) > after + 1 then
+	return {last, 1}
+end
+local result = {last, 0}
+for _, event in ipairs(redis.call('ZRANGEBYSCORE', KEYS[2], '(' .. after, '+inf')) do
+	table.insert(result, event)
+end
+return result
+`)
+)
+
 type storage struct {
 	rdb *redis.Client
 }
@@ -30,6 +391,11 @@ func New(rdb *redis.Client) Storage {
 	return &storage{rdb: rdb}
 }
 
+// Close does nothing, the redis client is owned by the caller
+func (s *storage) Close() error {
+	return nil
+}
+
 func (s *storage) CreateTempRoom(room *model.Room, exp time.Duration) (string, error) {
 	var ID string
 	for i := 5; i <= 15; i++ {
@@ -44,17 +410,23 @@ func (s *storage) CreateTempRoom(room *model.Room, exp time.Duration) (string, e
 		return "", errors.New("unable to generate an unique ID")
 	}
 
+	policy := room.ControlPolicy
+	if policy == "" {
+		policy = model.PolicyEveryone
+	}
 	data := map[string]interface{}{
-		"id":        ID,
-		"title":     room.Title,
-		"video_url": room.VideoURL,
+		"id":             ID,
+		"title":          room.Title,
+		"video_url":      room.VideoURL,
+		"host_token":     room.HostToken,
+		"control_policy": policy,
 	}
 
-	affectedFields := s.rdb.HSet("room:"+ID, data).Val()
-	if affectedFields != 3 {
+	affectedFields := s.rdb.HSet(roomKey(ID), data).Val()
+	if affectedFields != int64(len(data)) {
 		return "", fmt.Errorf("invalid affected fields num: %d", affectedFields)
 	}
-	ok := s.rdb.Expire("room:"+ID, exp).Val()
+	ok := s.rdb.Expire(roomKey(ID), exp).Val()
 	if !ok {
 		return "", fmt.Errorf("timeout was not set, key '%s' does not exist", ID)
 	}
@@ -63,24 +435,48 @@ func (s *storage) CreateTempRoom(room *model.Room, exp time.Duration) (string, e
 
 func (s *storage) GetTempRoom(roomID string) (*model.Room, error) {
 	var r model.Room
-	data := s.rdb.HGetAll("room:" + roomID).Val()
+	var roomCmd, membersCmd, rolesCmd *redis.StringStringMapCmd
+	_, err := s.rdb.TxPipelined(func(pipe redis.Pipeliner) error {
+		roomCmd = pipe.HGetAll(roomKey(roomID))
+		membersCmd = pipe.HGetAll(membersKey(roomID))
+		rolesCmd = pipe.HGetAll(rolesKey(roomID))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	data := roomCmd.Val()
 	if len(data) == 0 {
 		return nil, fmt.Errorf("room '%s' not found", roomID)
 	}
 
-	membersJSON, exists := data["members"]
-	if exists {
-		err := json.Unmarshal([]byte(membersJSON), &r.Members)
-		if err != nil {
+	r.Members = make([]*model.User, 0, len(membersCmd.Val()))
+	for _, memberJSON := range membersCmd.Val() {
+		var u model.User
+		if err = json.Unmarshal([]byte(memberJSON), &u); err != nil {
 			return nil, err
 		}
-	} else {
-		r.Members = []*model.User{}
+		u.Role = roleOrDefault(rolesCmd.Val()[u.ID])
+		r.Members = append(r.Members, &u)
 	}
+	sort.Slice(r.Members, func(i, j int) bool {
+		return r.Members[i].ID < r.Members[j].ID
+	})
 
 	r.ID = data["id"]
 	r.Title = data["title"]
 	r.VideoURL = data["video_url"]
+	r.HostToken = data["host_token"]
+	r.ControlPolicy = policyOrDefault(data["control_policy"])
+	r.Playback, err = decodePlayback(data["playback"])
+	if err != nil {
+		return nil, err
+	}
+	r.Chat, err = decodeChatSettings(data["chat_settings"])
+	if err != nil {
+		return nil, err
+	}
 	return &r, nil
 }
 
@@ -89,89 +485,525 @@ func (s *storage) UpdateTempRoom(room *model.Room) error {
 		return fmt.Errorf("invalid room id: %s", room.ID)
 	}
 
-	data := map[string]interface{}{
-		"title":     room.Title,
-		"video_url": room.VideoURL,
-	}
-
-	_ = s.rdb.HSet("room:"+room.ID, data).Val()
-	return nil
+	return setRoomFieldScript.Run(s.rdb, []string{roomKey(room.ID)}, "title", room.Title, "video_url", room.VideoURL).Err()
 }
 
 func (s *storage) AddUserToRoom(roomID string, u *model.User) error {
-	room, err := s.GetTempRoom(roomID)
+	memberJSON, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	role := ""
+	if u.Role != model.RoleMember {
+		role = u.Role
+	}
+	keys := []string{roomKey(roomID), membersKey(roomID), rolesKey(roomID), roomNodesKey(roomID), nodeMembersKey(u.NodeID)}
+	return addMemberScript.Run(s.rdb, keys, u.ID, memberJSON, role, u.NodeID, roomID).Err()
+}
+
+func (s *storage) UpdateRoomUser(roomID string, u *model.User) error {
+	memberJSON, err := json.Marshal(u)
 	if err != nil {
 		return err
 	}
-	for _, member := range room.Members {
-		if member.ID == u.ID {
-			return fmt.Errorf("member with ID:%s already exists", member.ID)
+	return updateMemberScript.Run(s.rdb, []string{membersKey(roomID)}, u.ID, memberJSON).Err()
+}
+
+func (s *storage) RemoveUserFromRoom(roomID string, userID string) error {
+	keys := []string{membersKey(roomID), rolesKey(roomID), roomNodesKey(roomID)}
+	return removeMemberScript.Run(s.rdb, keys, userID).Err()
+}
+
+func (s *storage) SetMemberRole(roomID string, userID string, role string) error {
+	if role == model.RoleMember {
+		role = ""
+	}
+	keys := []string{roomKey(roomID), membersKey(roomID), rolesKey(roomID)}
+	return setRoleScript.Run(s.rdb, keys, userID, role).Err()
+}
+
+func (s *storage) GetMemberRole(roomID string, userID string) (string, error) {
+	role, err := s.rdb.HGet(rolesKey(roomID), userID).Result()
+	if err == redis.Nil {
+		return model.RoleMember, nil
+	}
+	return role, err
+}
+
+func (s *storage) GetControlPolicy(roomID string) (string, error) {
+	data, err := s.rdb.HMGet(roomKey(roomID), "id", "control_policy").Result()
+	if err != nil {
+		return "", err
+	}
+	if data[0] == nil {
+		return "", fmt.Errorf("room '%s' not found", roomID)
+	}
+	policy, _ := data[1].(string)
+	return policyOrDefault(policy), nil
+}
+
+func (s *storage) UpdateControlPolicy(roomID string, policy string) error {
+	return setRoomFieldScript.Run(s.rdb, []string{roomKey(roomID)}, "control_policy", policy).Err()
+}
+
+func roleOrDefault(role string) string {
+	if role == "" {
+		return model.RoleMember
+	}
+	return role
+}
+
+func policyOrDefault(policy string) string {
+	if policy == "" {
+		return model.PolicyEveryone
+	}
+	return policy
+}
+
+func (s *storage) GetPlayback(roomID string) (*model.Playback, error) {
+	data, err := s.rdb.HMGet(roomKey(roomID), "id", "playback").Result()
+	if err != nil {
+		return nil, err
+	}
+	if data[0] == nil {
+		return nil, fmt.Errorf("room '%s' not found", roomID)
+	}
+	playbackJSON, _ := data[1].(string)
+	return decodePlayback(playbackJSON)
+}
+
+func (s *storage) UpdatePlayback(roomID string, update *model.PlaybackUpdate) (*model.Playback, error) {
+	var rate, playing string
+	if update.Rate != nil {
+		rate = strconv.FormatFloat(*update.Rate, 'f', -1, 64)
+	}
+	if update.Playing != nil {
+		playing = "0"
+		if *update.Playing {
+			playing = "1"
 		}
 	}
-	room.Members = append(room.Members, u)
-	membersJSON, err := json.Marshal(room.Members)
+	args := []interface{}{strconv.FormatFloat(update.Position, 'f', -1, 64), rate, playing, update.UpdatedAt}
+	playbackJSON, err := updatePlaybackScript.Run(s.rdb, []string{roomKey(roomID)}, args...).Text()
+	if err != nil {
+		return nil, err
+	}
+	return decodePlayback(playbackJSON)
+}
+
+// Returns the initial playback if the room has no playback yet
+func decodePlayback(playbackJSON string) (*model.Playback, error) {
+	if playbackJSON == "" {
+		return model.NewPlayback(), nil
+	}
+	var p model.Playback
+	if err := json.Unmarshal([]byte(playbackJSON), &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (s *storage) GetChatSettings(roomID string) (*model.ChatSettings, error) {
+	data, err := s.rdb.HMGet(roomKey(roomID), "id", "chat_settings").Result()
+	if err != nil {
+		return nil, err
+	}
+	if data[0] == nil {
+		return nil, fmt.Errorf("room '%s' not found", roomID)
+	}
+	settingsJSON, _ := data[1].(string)
+	return decodeChatSettings(settingsJSON)
+}
+
+func (s *storage) UpdateChatSettings(roomID string, settings *model.ChatSettings) error {
+	settingsJSON, err := json.Marshal(settings)
 	if err != nil {
 		return err
 	}
+	return setRoomFieldScript.Run(s.rdb, []string{roomKey(roomID)}, "chat_settings", settingsJSON).Err()
+}
 
-	data := map[string]interface{}{
-		"members": string(membersJSON),
+// Returns the initial chat settings if the room has none yet
+func decodeChatSettings(settingsJSON string) (*model.ChatSettings, error) {
+	if settingsJSON == "" {
+		return model.NewChatSettings(), nil
 	}
-	_ = s.rdb.HSet("room:"+room.ID, data).Val()
-	return nil
+	var settings model.ChatSettings
+	if err := json.Unmarshal([]byte(settingsJSON), &settings); err != nil {
+		return nil, err
+	}
+	return &settings, nil
 }
 
-func (s *storage) UpdateRoomUser(roomID string, u *model.User) error {
-	room, err := s.GetTempRoom(roomID)
+func (s *storage) GetLastMessage(roomID, userID string) (*model.LastMessage, error) {
+	data, err := s.rdb.HGet(lastMessagesKey(roomID), userID).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m model.LastMessage
+	if err = json.Unmarshal([]byte(data), &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (s *storage) SaveLastMessage(roomID, userID string, m *model.LastMessage) error {
+	data, err := json.Marshal(m)
 	if err != nil {
 		return err
 	}
-	for idx, member := range room.Members {
-		if member.ID == u.ID {
-			room.Members[idx] = u
-			break
+	return setRoomHashFieldScript.Run(s.rdb, []string{roomKey(roomID), lastMessagesKey(roomID)}, userID, data).Err()
+}
+
+func (s *storage) AddRoomMessage(roomID string, m *model.ChatMessage) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	keys := []string{roomKey(roomID), messagesKey(roomID), messagesIndexKey(roomID), messagesSeqKey(roomID)}
+	seq, err := addMessageScript.Run(s.rdb, keys, m.ID, data, HistorySize).Int64()
+	if err != nil {
+		return err
+	}
+	m.Seq = seq
+	return nil
+}
+
+func (s *storage) GetRoomMessages(roomID string, before int64, limit int) ([]*model.ChatMessage, error) {
+	max := "+inf"
+	if before > 0 {
+		max = "(" + strconv.FormatInt(before, 10)
+	}
+	keys := []string{roomKey(roomID), messagesKey(roomID), messagesIndexKey(roomID)}
+	res, err := getMessagesScript.Run(s.rdb, keys, max, limit).Result()
+	if err != nil {
+		return nil, err
+	}
+	values, _ := res.([]interface{})
+
+	messages := make([]*model.ChatMessage, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		var m model.ChatMessage
+		seq, _ := values[i].(string)
+		data, _ := values[i+1].(string)
+		if err = json.Unmarshal([]byte(data), &m); err != nil {
+			return nil, err
 		}
+		if m.Seq, err = strconv.ParseInt(seq, 10, 64); err != nil {
+			return nil, err
+		}
+		// newest first in redis, chronological order in result
+		messages[len(messages)-1-i/2] = &m
 	}
+	return messages, nil
+}
+
+func (s *storage) GetRoomMessage(roomID, messageID string) (*model.ChatMessage, error) {
+	return getMessage(s.rdb, roomID, messageID)
+}
 
-	membersJSON, err := json.Marshal(room.Members)
+// Reads the message and its seq, the cmdable is either the client or the transaction
+func getMessage(c redis.Cmdable, roomID, messageID string) (*model.ChatMessage, error) {
+	data, err := c.HGet(messagesKey(roomID), messageID).Result()
+	if err == redis.Nil {
+		return nil, ErrMessageNotFound
+	}
 	if err != nil {
+		return nil, err
+	}
+	var m model.ChatMessage
+	if err = json.Unmarshal([]byte(data), &m); err != nil {
+		return nil, err
+	}
+	seq, err := c.ZScore(messagesIndexKey(roomID), messageID).Result()
+	if err == redis.Nil {
+		return nil, ErrMessageNotFound
+	}
+	m.Seq = int64(seq)
+	return &m, err
+}
+
+// The message is edited optimistically, the edit is retried if the message changed in the meantime
+func (s *storage) EditRoomMessage(roomID, messageID, content string, editedAt int64) (*model.ChatMessage, error) {
+	var m *model.ChatMessage
+	edit := func(tx *redis.Tx) (err error) {
+		if m, err = getMessage(tx, roomID, messageID); err != nil {
+			return err
+		}
+		m.Edit(content, editedAt)
+		data, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(func(pipe redis.Pipeliner) error {
+			pipe.HSet(messagesKey(roomID), messageID, data)
+			return nil
+		})
 		return err
 	}
+	for i := 0; i < maxEditRetries; i++ {
+		err := s.rdb.Watch(edit, messagesKey(roomID))
+		if err != redis.TxFailedErr {
+			return m, err
+		}
+	}
+	return nil, fmt.Errorf("message '%s' is edited concurrently", messageID)
+}
 
-	data := map[string]interface{}{
-		"members": string(membersJSON),
+func (s *storage) RemoveRoomMessage(roomID, messageID string) error {
+	var delCmd *redis.IntCmd
+	_, err := s.rdb.TxPipelined(func(pipe redis.Pipeliner) error {
+		delCmd = pipe.HDel(messagesKey(roomID), messageID)
+		pipe.ZRem(messagesIndexKey(roomID), messageID)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if delCmd.Val() == 0 {
+		return ErrMessageNotFound
 	}
-	_ = s.rdb.HSet("room:"+room.ID, data).Val()
 	return nil
 }
 
-func (s *storage) RemoveUserFromRoom(roomID string, userID string) error {
-	room, err := s.GetTempRoom(roomID)
+func (s *storage) SaveRoomBan(roomID string, ban *model.Ban) error {
+	data, err := json.Marshal(ban)
 	if err != nil {
 		return err
 	}
-	for i, u := range room.Members {
-		if u.ID == userID {
-			lastElem := len(room.Members) - 1
-			room.Members[i] = room.Members[lastElem]
-			room.Members[lastElem] = nil
-			room.Members = room.Members[:lastElem]
-			break
+	return setRoomHashFieldScript.Run(s.rdb, []string{roomKey(roomID), bansKey(roomID)}, ban.UserID, data).Err()
+}
+
+func (s *storage) GetRoomBans(roomID string) ([]*model.Ban, error) {
+	var existsCmd *redis.IntCmd
+	var bansCmd *redis.StringSliceCmd
+	_, err := s.rdb.TxPipelined(func(pipe redis.Pipeliner) error {
+		existsCmd = pipe.Exists(roomKey(roomID))
+		bansCmd = pipe.HVals(bansKey(roomID))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if existsCmd.Val() == 0 {
+		return nil, fmt.Errorf("room '%s' not found", roomID)
+	}
+	bans := make([]*model.Ban, 0, len(bansCmd.Val()))
+	for _, data := range bansCmd.Val() {
+		var b model.Ban
+		if err = json.Unmarshal([]byte(data), &b); err != nil {
+			return nil, err
 		}
+		bans = append(bans, &b)
 	}
+	sortBans(bans)
+	return bans, nil
+}
 
-	membersJSON, err := json.Marshal(room.Members)
+func (s *storage) RemoveRoomBan(roomID, userID string) error {
+	removed, err := s.rdb.HDel(bansKey(roomID), userID).Result()
 	if err != nil {
 		return err
 	}
+	if removed == 0 {
+		return ErrBanNotFound
+	}
+	return nil
+}
 
-	data := map[string]interface{}{
-		"members": string(membersJSON),
+func (s *storage) SetMemberMuted(roomID, userID string, muted bool) error {
+	if !muted {
+		return s.rdb.HDel(mutedKey(roomID), userID).Err()
+	}
+	return setRoomHashFieldScript.Run(s.rdb, []string{roomKey(roomID), mutedKey(roomID)}, userID, 1).Err()
+}
+
+func (s *storage) IsMemberMuted(roomID, userID string) (bool, error) {
+	return s.rdb.HExists(mutedKey(roomID), userID).Result()
+}
+
+// Orders the bans by creation time, bans created at the same time by user ID
+func sortBans(bans []*model.Ban) {
+	sort.Slice(bans, func(i, j int) bool {
+		if bans[i].CreatedAt != bans[j].CreatedAt {
+			return bans[i].CreatedAt < bans[j].CreatedAt
+		}
+		return bans[i].UserID < bans[j].UserID
+	})
+}
+
+func (s *storage) TakeRoomToken(roomID, bucket string, limit ratelimit.Limit) (bool, error) {
+	if limit.Unlimited() {
+		return true, nil
+	}
+	keys := []string{roomKey(roomID), bucketKey(roomID, bucket)}
+	now := utils.UnixMilli(time.Now())
+	allowed, err := takeTokenScript.Run(s.rdb, keys, limit.Events, limit.Refill(time.Millisecond), now).Int()
+	return allowed == 1, err
+}
+
+// The event is published with redis, so the message broker must use the same redis
+func (s *storage) PublishRoomEvent(roomID, channel string, event []byte) (int64, error) {
+	if err := checkEvent(event); err != nil {
+		return 0, err
+	}
+	keys := []string{roomKey(roomID), eventsKey(roomID), eventsSeqKey(roomID)}
+	return publishEventScript.Run(s.rdb, keys, event, EventRetention, channel).Int64()
+}
+
+// Checks the event is a non-empty JSON object, so the seq can be prepended to its fields
+func checkEvent(event []byte) error {
+	if len(event) < 3 || event[0] != '{' || event[len(event)-1] != '}' {
+		return errors.New("event must be a non-empty JSON object")
 	}
-	_ = s.rdb.HSet("room:"+room.ID, data).Val()
 	return nil
 }
 
+// Returns the event with the seq as its first field
+func stampEvent(event []byte, seq int64) []byte {
+	stamped := make([]byte, 0, len(event)+24)
+	stamped = append(stamped, `{"seq":`...)
+	stamped = strconv.AppendInt(stamped, seq, 10)
+	stamped = append(stamped, ',')
+	return append(stamped, event[1:]...)
+}
+
+func (s *storage) GetRoomEvents(roomID string, after int64) ([][]byte, int64, error) {
+	keys := []string{roomKey(roomID), eventsKey(roomID), eventsSeqKey(roomID)}
+	res, err := getEventsScript.Run(s.rdb, keys, after).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	values, _ := res.([]interface{})
+	if len(values) < 2 {
+		return nil, 0, fmt.Errorf("unexpected events reply: %v", res)
+	}
+	last, _ := values[0].(int64)
+	if expired, _ := values[1].(int64); expired == 1 {
+		return nil, last, ErrEventsExpired
+	}
+	events := make([][]byte, 0, len(values)-2)
+	for _, v := range values[2:] {
+		data, _ := v.(string)
+		events = append(events, []byte(data))
+	}
+	return events, last, nil
+}
+
+func (s *storage) GetRoomSeq(roomID string) (int64, error) {
+	var existsCmd *redis.IntCmd
+	var seqCmd *redis.StringCmd
+	_, err := s.rdb.TxPipelined(func(pipe redis.Pipeliner) error {
+		existsCmd = pipe.Exists(roomKey(roomID))
+		seqCmd = pipe.Get(eventsSeqKey(roomID))
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return 0, err
+	}
+	if existsCmd.Val() == 0 {
+		return 0, fmt.Errorf("room '%s' not found", roomID)
+	}
+	if seqCmd.Err() == redis.Nil {
+		return 0, nil
+	}
+	return seqCmd.Int64()
+}
+
+func (s *storage) SaveSession(roomID, token string, session *model.Session, exp time.Duration) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	keys := []string{roomKey(roomID), sessionKey(roomID, token), userSessionKey(roomID, session.User.ID)}
+	return saveSessionScript.Run(s.rdb, keys, data, exp.Milliseconds(), token).Err()
+}
+
+func (s *storage) GetSession(roomID, token string) (*model.Session, error) {
+	data, err := s.rdb.Get(sessionKey(roomID, token)).Bytes()
+	if err == redis.Nil {
+		return nil, fmt.Errorf("session not found in room '%s'", roomID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var session model.Session
+	if err = json.Unmarshal(data, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (s *storage) TakeSession(roomID, token string) (*model.Session, error) {
+	var getCmd *redis.StringCmd
+	_, err := s.rdb.TxPipelined(func(pipe redis.Pipeliner) error {
+		getCmd = pipe.Get(sessionKey(roomID, token))
+		pipe.Del(sessionKey(roomID, token))
+		return nil
+	})
+	if err == redis.Nil {
+		return nil, fmt.Errorf("session not found in room '%s'", roomID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var session model.Session
+	if err = json.Unmarshal([]byte(getCmd.Val()), &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (s *storage) DeleteUserSession(roomID, userID string) (*model.Session, error) {
+	keys := []string{userSessionKey(roomID, userID)}
+	data, err := deleteUserSessionScript.Run(s.rdb, keys, sessionKey(roomID, "")).Text()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var session model.Session
+	if err = json.Unmarshal([]byte(data), &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (s *storage) HeartbeatNode(nodeID string, lease time.Duration) error {
+	_, err := s.rdb.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.SAdd(nodesKey(), nodeID)
+		pipe.Set(nodeKey(nodeID), 1, lease)
+		return nil
+	})
+	return err
+}
+
+func (s *storage) ReapDeadNodes() ([]*model.User, error) {
+	nodes, err := s.rdb.SMembers(nodesKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+	var users []*model.User
+	for _, nodeID := range nodes {
+		keys := []string{nodeKey(nodeID), nodeMembersKey(nodeID), nodesKey()}
+		res, err := reapNodeScript.Run(s.rdb, keys, nodeID).Result()
+		if err != nil {
+			return users, err
+		}
+		values, _ := res.([]interface{})
+		for i := 0; i+1 < len(values); i += 2 {
+			userID, _ := values[i].(string)
+			roomID, _ := values[i+1].(string)
+			users = append(users, &model.User{ID: userID, RoomID: roomID, NodeID: nodeID})
+		}
+	}
+	return users, nil
+}
+
 func (s *storage) IncrVisits() (int64, error) {
 	return s.rdb.Incr("visits:" + time.Now().Format("02.01.06")).Result()
 }
@@ -181,5 +1013,95 @@ func (s *storage) GetVisitsByDate(date time.Time) (int64, error) {
 }
 
 func (s *storage) TempRoomExist(roomID string) bool {
-	return s.rdb.Exists("room:"+roomID).Val() == 1
+	return s.rdb.Exists(roomKey(roomID)).Val() == 1
+}
+
+func roomKey(roomID string) string {
+	return "room:" + roomID
+}
+
+// Roles of the members having one (user ID => role)
+func rolesKey(roomID string) string {
+	return "room:" + roomID + ":roles"
+}
+
+// Chat messages by ID
+func messagesKey(roomID string) string {
+	return "room:" + roomID + ":messages"
+}
+
+// Chat message IDs scored by seq
+func messagesIndexKey(roomID string) string {
+	return "room:" + roomID + ":messages:index"
+}
+
+// Last chat message seq
+func messagesSeqKey(roomID string) string {
+	return "room:" + roomID + ":messages:seq"
+}
+
+// Room broadcasts scored by seq
+func eventsKey(roomID string) string {
+	return "room:" + roomID + ":events"
+}
+
+// Last room broadcast seq
+func eventsSeqKey(roomID string) string {
+	return "room:" + roomID + ":events:seq"
+}
+
+// Bans of the room (user ID => ban JSON)
+func bansKey(roomID string) string {
+	return "room:" + roomID + ":bans"
+}
+
+// Members with muted chat (user ID => 1)
+func mutedKey(roomID string) string {
+	return "room:" + roomID + ":muted"
+}
+
+// Last chat messages of the members (user ID => last message JSON)
+func lastMessagesKey(roomID string) string {
+	return "room:" + roomID + ":last_messages"
+}
+
+// Rate limit token bucket of the room
+func bucketKey(roomID, bucket string) string {
+	return "room:" + roomID + ":buckets:" + bucket
+}
+
+// Session of the disconnected member by resume token
+func sessionKey(roomID, token string) string {
+	return "room:" + roomID + ":sessions:" + token
+}
+
+// Resume token of the disconnected member session by user ID
+func userSessionKey(roomID, userID string) string {
+	return "room:" + roomID + ":user_sessions:" + userID
+}
+
+// Nodes serving the members (user ID => node ID)
+func roomNodesKey(roomID string) string {
+	return "room:" + roomID + ":nodes"
+}
+
+// IDs of the nodes having heartbeated
+func nodesKey() string {
+	return "nodes"
+}
+
+// Node lease, exists while the node is alive
+func nodeKey(nodeID string) string {
+	return "node:" + nodeID
+}
+
+// Members served by the node (user ID => room ID)
+func nodeMembersKey(nodeID string) string {
+	return "node:" + nodeID + ":members"
+}
+
+// Members are kept in their own hash (user ID => user JSON),
+// so every membership change touches a single field atomically
+func membersKey(roomID string) string {
+	return "room:" + roomID + ":members"
 }
@@ -0,0 +1,867 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v7"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"smotri.me/model"
+	"smotri.me/pkg/msgbroker"
+	"smotri.me/pkg/ratelimit"
+	"smotri.me/pkg/utils"
+	"sync"
+	"testing"
+	"time"
+)
+
+// backend starts a storage implementation for tests. It returns n storages sharing the same data,
+// as if they belonged to different API instances, a function moving the backend clock forward
+// and a function releasing resources
+type backend func(t *testing.T, n int) (storages []Storage, advance func(time.Duration), stop func())
+
+var backends = map[string]backend{
+	"redis":  redisBackend,
+	"memory": memoryBackend,
+}
+
+func redisBackend(t *testing.T, n int) ([]Storage, func(time.Duration), func()) {
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+
+	storages := make([]Storage, n)
+	clients := make([]*redis.Client, n)
+	for i := range storages {
+		clients[i] = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+		storages[i] = New(clients[i])
+	}
+	return storages, mr.FastForward, func() {
+		for _, c := range clients {
+			_ = c.Close()
+		}
+		mr.Close()
+	}
+}
+
+func memoryBackend(_ *testing.T, n int) ([]Storage, func(time.Duration), func()) {
+	c := &clock{now: time.Now()}
+	s := newMemory(time.Hour, c.Now, discardPublisher{})
+
+	storages := make([]Storage, n)
+	for i := range storages {
+		storages[i] = s
+	}
+	return storages, c.Advance, func() { _ = s.Close() }
+}
+
+// discardPublisher drops the events published by the memory storage
+type discardPublisher struct{}
+
+func (discardPublisher) Publish([]byte, string) error {
+	return nil
+}
+
+// clock is a manually driven time source for the memory storage
+type clock struct {
+	sync.Mutex
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *clock) Advance(d time.Duration) {
+	c.Lock()
+	c.now = c.now.Add(d)
+	c.Unlock()
+}
+
+// Runs the test against every storage implementation
+func forEachBackend(t *testing.T, n int, test func(t *testing.T, storages []Storage, advance func(time.Duration))) {
+	for name, b := range backends {
+		t.Run(name, func(t *testing.T) {
+			storages, advance, stop := b(t, n)
+			defer stop()
+			test(t, storages, advance)
+		})
+	}
+}
+
+func createRoom(t *testing.T, s Storage) string {
+	ID, err := s.CreateTempRoom(&model.Room{Title: "test", VideoURL: "https://youtube.com"}, time.Hour)
+	require.NoError(t, err)
+	return ID
+}
+
+func TestTempRoom(t *testing.T) {
+	forEachBackend(t, 1, func(t *testing.T, storages []Storage, advance func(time.Duration)) {
+		s := storages[0]
+		roomID := createRoom(t, s)
+		assert.True(t, s.TempRoomExist(roomID))
+		assert.False(t, s.TempRoomExist("unknown"))
+
+		require.NoError(t, s.UpdateTempRoom(&model.Room{ID: roomID, Title: "updated", VideoURL: "https://vk.com"}))
+		room, err := s.GetTempRoom(roomID)
+		require.NoError(t, err)
+		assert.Equal(t, roomID, room.ID)
+		assert.Equal(t, "updated", room.Title)
+		assert.Equal(t, "https://vk.com", room.VideoURL)
+		assert.Empty(t, room.Members)
+
+		_, err = s.GetTempRoom("unknown")
+		assert.Error(t, err)
+	})
+}
+
+func TestUpdateExpiredRoom(t *testing.T) {
+	forEachBackend(t, 1, func(t *testing.T, storages []Storage, advance func(time.Duration)) {
+		s := storages[0]
+		roomID := createRoom(t, s)
+		advance(time.Hour + time.Second)
+
+		// the update racing the expiry does not bring the room back
+		assert.Error(t, s.UpdateTempRoom(&model.Room{ID: roomID, Title: "updated", VideoURL: "https://vk.com"}))
+		assert.False(t, s.TempRoomExist(roomID))
+		_, err := s.GetTempRoom(roomID)
+		assert.Error(t, err)
+	})
+}
+
+func TestAddUserToRoom(t *testing.T) {
+	forEachBackend(t, 1, func(t *testing.T, storages []Storage, advance func(time.Duration)) {
+		s := storages[0]
+		roomID := createRoom(t, s)
+
+		u := &model.User{ID: "user", Name: "Cheburek", RoomID: roomID, Color: "red"}
+		assert.NoError(t, s.AddUserToRoom(roomID, u))
+		assert.Error(t, s.AddUserToRoom(roomID, u))
+		assert.Error(t, s.AddUserToRoom("unknown", u))
+
+		room, err := s.GetTempRoom(roomID)
+		require.NoError(t, err)
+		require.Len(t, room.Members, 1)
+		assert.Equal(t, u.Name, room.Members[0].Name)
+		assert.Equal(t, u.Color, room.Members[0].Color)
+
+		u.Name = "Orehek"
+		assert.NoError(t, s.UpdateRoomUser(roomID, u))
+		assert.Error(t, s.UpdateRoomUser(roomID, &model.User{ID: "unknown"}))
+		room, err = s.GetTempRoom(roomID)
+		require.NoError(t, err)
+		assert.Equal(t, "Orehek", room.Members[0].Name)
+
+		assert.NoError(t, s.RemoveUserFromRoom(roomID, u.ID))
+		room, err = s.GetTempRoom(roomID)
+		require.NoError(t, err)
+		assert.Empty(t, room.Members)
+	})
+}
+
+func TestRoomExpiration(t *testing.T) {
+	forEachBackend(t, 1, func(t *testing.T, storages []Storage, advance func(time.Duration)) {
+		s := storages[0]
+		roomID := createRoom(t, s)
+		require.NoError(t, s.AddUserToRoom(roomID, &model.User{ID: "user"}))
+
+		advance(time.Hour - time.Second)
+		assert.True(t, s.TempRoomExist(roomID))
+
+		advance(time.Second)
+		assert.False(t, s.TempRoomExist(roomID))
+		_, err := s.GetTempRoom(roomID)
+		assert.Error(t, err)
+		assert.Error(t, s.AddUserToRoom(roomID, &model.User{ID: "late"}))
+	})
+}
+
+func TestRoomKeysExpireWithRoom(t *testing.T) {
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+	defer mr.Close()
+	s := New(redis.NewClient(&redis.Options{Addr: mr.Addr()}))
+	roomID := createRoom(t, s)
+
+	require.NoError(t, s.AddUserToRoom(roomID, &model.User{ID: "user", Role: model.RoleHost, NodeID: "node"}))
+	require.NoError(t, s.AddRoomMessage(roomID, &model.ChatMessage{ID: "msg"}))
+	_, err = s.PublishRoomEvent(roomID, "events:"+roomID, []byte(`{"n":1}`))
+	require.NoError(t, err)
+	require.NoError(t, s.SaveSession(roomID, "token", &model.Session{User: &model.User{ID: "user"}}, time.Hour))
+	require.NoError(t, s.SaveRoomBan(roomID, &model.Ban{UserID: "banned"}))
+	require.NoError(t, s.SetMemberMuted(roomID, "user", true))
+	_, err = s.TakeRoomToken(roomID, "chat", ratelimit.Limit{Events: 1, Per: time.Second})
+	require.NoError(t, err)
+	require.NoError(t, s.SaveLastMessage(roomID, "user", &model.LastMessage{Digest: "digest"}))
+	mr.FastForward(time.Hour + time.Second)
+
+	for _, key := range []string{roomKey(roomID), membersKey(roomID), rolesKey(roomID), roomNodesKey(roomID), messagesKey(roomID), messagesIndexKey(roomID), messagesSeqKey(roomID), eventsKey(roomID), eventsSeqKey(roomID), sessionKey(roomID, "token"), userSessionKey(roomID, "user"), bansKey(roomID), mutedKey(roomID), bucketKey(roomID, "chat"), lastMessagesKey(roomID)} {
+		assert.False(t, mr.Exists(key), key)
+	}
+}
+
+func TestMemoryJanitor(t *testing.T) {
+	s := newMemory(time.Millisecond, time.Now, discardPublisher{})
+	defer s.Close()
+	_, err := s.CreateTempRoom(&model.Room{}, time.Millisecond)
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		s.RLock()
+		defer s.RUnlock()
+		return len(s.rooms) == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestVisits(t *testing.T) {
+	forEachBackend(t, 1, func(t *testing.T, storages []Storage, advance func(time.Duration)) {
+		s := storages[0]
+		_, err := s.GetVisitsByDate(time.Now().AddDate(0, 0, -1))
+		assert.Error(t, err)
+
+		for i := int64(1); i <= 3; i++ {
+			visits, err := s.IncrVisits()
+			require.NoError(t, err)
+			assert.Equal(t, i, visits)
+		}
+		visits, err := s.GetVisitsByDate(time.Now())
+		require.NoError(t, err)
+		assert.Equal(t, int64(3), visits)
+	})
+}
+
+func TestConcurrentMembership(t *testing.T) {
+	const instances, usersPerInstance = 10, 50
+	forEachBackend(t, instances, func(t *testing.T, storages []Storage, advance func(time.Duration)) {
+		roomID := createRoom(t, storages[0])
+
+		var wg sync.WaitGroup
+		for i, s := range storages {
+			wg.Add(1)
+			go func(i int, s Storage) {
+				defer wg.Done()
+				for j := 0; j < usersPerInstance; j++ {
+					u := &model.User{ID: fmt.Sprintf("user-%d-%d", i, j), Name: "Cheburek", RoomID: roomID}
+					assert.NoError(t, s.AddUserToRoom(roomID, u))
+				}
+			}(i, s)
+		}
+		wg.Wait()
+
+		room, err := storages[0].GetTempRoom(roomID)
+		require.NoError(t, err)
+		assert.Len(t, room.Members, instances*usersPerInstance)
+
+		// half of the members leave while the rest are renamed
+		for i, s := range storages {
+			wg.Add(1)
+			go func(i int, s Storage) {
+				defer wg.Done()
+				for j := 0; j < usersPerInstance; j++ {
+					ID := fmt.Sprintf("user-%d-%d", i, j)
+					if j%2 == 0 {
+						assert.NoError(t, s.RemoveUserFromRoom(roomID, ID))
+					} else {
+						assert.NoError(t, s.UpdateRoomUser(roomID, &model.User{ID: ID, Name: "Renamed", RoomID: roomID}))
+					}
+				}
+			}(i, s)
+		}
+		wg.Wait()
+
+		room, err = storages[0].GetTempRoom(roomID)
+		require.NoError(t, err)
+		assert.Len(t, room.Members, instances*usersPerInstance/2)
+		for _, m := range room.Members {
+			assert.Equal(t, "Renamed", m.Name)
+		}
+	})
+}
+
+func TestRoomMessages(t *testing.T) {
+	forEachBackend(t, 1, func(t *testing.T, storages []Storage, advance func(time.Duration)) {
+		s := storages[0]
+		roomID := createRoom(t, s)
+		assert.Error(t, s.AddRoomMessage("unknown", &model.ChatMessage{ID: "msg"}))
+		_, err := s.GetRoomMessages("unknown", 0, 10)
+		assert.Error(t, err)
+
+		messages, err := s.GetRoomMessages(roomID, 0, 10)
+		require.NoError(t, err)
+		assert.Empty(t, messages)
+
+		for i := 1; i <= HistorySize+10; i++ {
+			m := &model.ChatMessage{ID: fmt.Sprintf("msg-%d", i), UserID: "user", Content: fmt.Sprint(i)}
+			require.NoError(t, s.AddRoomMessage(roomID, m))
+			assert.Equal(t, int64(i), m.Seq)
+		}
+
+		// latest page
+		messages, err = s.GetRoomMessages(roomID, 0, 3)
+		require.NoError(t, err)
+		require.Len(t, messages, 3)
+		for i, m := range messages {
+			seq := int64(HistorySize + 8 + i)
+			assert.Equal(t, seq, m.Seq)
+			assert.Equal(t, fmt.Sprintf("msg-%d", seq), m.ID)
+			assert.Equal(t, fmt.Sprint(seq), m.Content)
+		}
+
+		// previous page
+		messages, err = s.GetRoomMessages(roomID, messages[0].Seq, 2)
+		require.NoError(t, err)
+		require.Len(t, messages, 2)
+		assert.Equal(t, int64(HistorySize+6), messages[0].Seq)
+		assert.Equal(t, int64(HistorySize+7), messages[1].Seq)
+
+		// the oldest messages are trimmed
+		messages, err = s.GetRoomMessages(roomID, 20, 100)
+		require.NoError(t, err)
+		require.Len(t, messages, 9)
+		assert.Equal(t, int64(11), messages[0].Seq)
+
+		// history expires with the room
+		advance(time.Hour)
+		_, err = s.GetRoomMessages(roomID, 0, 10)
+		assert.Error(t, err)
+	})
+}
+
+func TestEditRemoveMessages(t *testing.T) {
+	forEachBackend(t, 1, func(t *testing.T, storages []Storage, advance func(time.Duration)) {
+		s := storages[0]
+		roomID := createRoom(t, s)
+		for i := 1; i <= 3; i++ {
+			require.NoError(t, s.AddRoomMessage(roomID, &model.ChatMessage{ID: fmt.Sprintf("msg-%d", i), UserID: "author", Content: "v0", CreatedAt: 1}))
+		}
+
+		m, err := s.GetRoomMessage(roomID, "msg-2")
+		require.NoError(t, err)
+		assert.Equal(t, "author", m.UserID)
+		assert.Equal(t, int64(2), m.Seq)
+		_, err = s.GetRoomMessage(roomID, "unknown")
+		assert.Equal(t, ErrMessageNotFound, err)
+
+		m, err = s.EditRoomMessage(roomID, "msg-2", "v1", 10)
+		require.NoError(t, err)
+		assert.Equal(t, "v1", m.Content)
+		_, err = s.EditRoomMessage(roomID, "msg-2", "v2", 20)
+		require.NoError(t, err)
+		_, err = s.EditRoomMessage(roomID, "unknown", "v1", 10)
+		assert.Equal(t, ErrMessageNotFound, err)
+
+		// edits are kept in the history, the seq is not changed
+		messages, err := s.GetRoomMessages(roomID, 0, 10)
+		require.NoError(t, err)
+		require.Len(t, messages, 3)
+		edited := messages[1]
+		assert.Equal(t, int64(2), edited.Seq)
+		assert.Equal(t, "v2", edited.Content)
+		assert.Equal(t, int64(20), edited.EditedAt)
+		assert.Equal(t, []*model.MessageEdit{{Content: "v0", EditedAt: 10}, {Content: "v1", EditedAt: 20}}, edited.Edits)
+		assert.Empty(t, messages[0].Edits)
+
+		require.NoError(t, s.RemoveRoomMessage(roomID, "msg-2"))
+		assert.Equal(t, ErrMessageNotFound, s.RemoveRoomMessage(roomID, "msg-2"))
+		_, err = s.GetRoomMessage(roomID, "msg-2")
+		assert.Equal(t, ErrMessageNotFound, err)
+		messages, err = s.GetRoomMessages(roomID, 0, 10)
+		require.NoError(t, err)
+		require.Len(t, messages, 2)
+		assert.Equal(t, "msg-1", messages[0].ID)
+		assert.Equal(t, "msg-3", messages[1].ID)
+
+		advance(time.Hour)
+		_, err = s.EditRoomMessage(roomID, "msg-1", "late", 30)
+		assert.Error(t, err)
+		assert.Error(t, s.RemoveRoomMessage(roomID, "msg-1"))
+	})
+}
+
+func TestRoomEvents(t *testing.T) {
+	forEachBackend(t, 1, func(t *testing.T, storages []Storage, advance func(time.Duration)) {
+		s := storages[0]
+		roomID := createRoom(t, s)
+		_, err := s.PublishRoomEvent("unknown", "events:unknown", []byte(`{"n":1}`))
+		assert.Error(t, err)
+		_, _, err = s.GetRoomEvents("unknown", 0)
+		assert.Error(t, err)
+		for _, event := range []string{"", "{}", "[1]", "event"} {
+			_, err = s.PublishRoomEvent(roomID, "events:"+roomID, []byte(event))
+			assert.Error(t, err, event)
+		}
+
+		events, last, err := s.GetRoomEvents(roomID, 0)
+		require.NoError(t, err)
+		assert.Empty(t, events)
+		assert.Zero(t, last)
+
+		const count = EventRetention + 10
+		event := func(seq int64) []byte {
+			return []byte(fmt.Sprintf(`{"seq":%d,"n":%d}`, seq, seq))
+		}
+		for i := int64(1); i <= count; i++ {
+			seq, err := s.PublishRoomEvent(roomID, "events:"+roomID, []byte(fmt.Sprintf(`{"n":%d}`, i)))
+			require.NoError(t, err)
+			assert.Equal(t, i, seq)
+		}
+
+		events, last, err = s.GetRoomEvents(roomID, count-3)
+		require.NoError(t, err)
+		assert.Equal(t, int64(count), last)
+		assert.Equal(t, [][]byte{event(count - 2), event(count - 1), event(count)}, events)
+
+		// the oldest kept event is the next one
+		events, _, err = s.GetRoomEvents(roomID, count-EventRetention)
+		require.NoError(t, err)
+		assert.Len(t, events, EventRetention)
+
+		events, _, err = s.GetRoomEvents(roomID, count)
+		require.NoError(t, err)
+		assert.Empty(t, events)
+
+		// trimmed events and seq from the future can not be replayed
+		for _, after := range []int64{0, count - EventRetention - 1, count + 1} {
+			_, last, err = s.GetRoomEvents(roomID, after)
+			assert.Equal(t, ErrEventsExpired, err, after)
+			assert.Equal(t, int64(count), last)
+		}
+	})
+}
+
+func TestPublishRoomEvent(t *testing.T) {
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+	defer mr.Close()
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	redisBroker := msgbroker.NewRedisBroker(rdb)
+	defer redisBroker.Close()
+	memoryBroker := msgbroker.NewMemoryBroker()
+	defer memoryBroker.Close()
+	memory := NewMemory(time.Hour, memoryBroker)
+	defer memory.Close()
+
+	// the redis storage publishes with redis itself, the memory one with the broker
+	cases := map[string]struct {
+		storage Storage
+		broker  msgbroker.MessageBroker
+	}{
+		"redis":  {storage: New(rdb), broker: redisBroker},
+		"memory": {storage: memory, broker: memoryBroker},
+	}
+	for name, c := range cases {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			roomID := createRoom(t, c.storage)
+			received := make(chan []byte, 1000)
+			require.NoError(t, c.broker.Subscribe("events:*", func(msg *msgbroker.Message) {
+				received <- msg.Data
+			}))
+			defer c.broker.Unsubscribe("events:*")
+			if name == "redis" {
+				require.Eventually(t, func() bool { return mr.PubSubNumPat() > 0 }, time.Second, time.Millisecond)
+			}
+
+			// racing publishers
+			const publishers, count = 10, 20
+			var wg sync.WaitGroup
+			for i := 0; i < publishers; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					for j := 0; j < count; j++ {
+						_, err := c.storage.PublishRoomEvent(roomID, "events:"+roomID, []byte(fmt.Sprintf(`{"publisher":%d}`, i)))
+						assert.NoError(t, err)
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			// the events are published in the seq order and kept as published
+			events, _, err := c.storage.GetRoomEvents(roomID, publishers*count-EventRetention)
+			require.NoError(t, err)
+			for seq := int64(1); seq <= publishers*count; seq++ {
+				var data []byte
+				select {
+				case data = <-received:
+				case <-time.After(time.Second):
+					t.Fatalf("event %d is not published", seq)
+				}
+				var event struct {
+					Seq       int64 `json:"seq"`
+					Publisher *int  `json:"publisher"`
+				}
+				require.NoError(t, json.Unmarshal(data, &event))
+				require.Equal(t, seq, event.Seq)
+				require.NotNil(t, event.Publisher)
+				if i := seq - 1 - (publishers*count - EventRetention); i >= 0 {
+					assert.Equal(t, events[i], data)
+				}
+			}
+		})
+	}
+}
+
+func TestSessions(t *testing.T) {
+	forEachBackend(t, 1, func(t *testing.T, storages []Storage, advance func(time.Duration)) {
+		s := storages[0]
+		roomID := createRoom(t, s)
+		otherRoomID := createRoom(t, s)
+
+		seq, err := s.GetRoomSeq(roomID)
+		require.NoError(t, err)
+		assert.Zero(t, seq)
+		_, err = s.PublishRoomEvent(roomID, "events:"+roomID, []byte(`{"n":1}`))
+		require.NoError(t, err)
+		seq, err = s.GetRoomSeq(roomID)
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), seq)
+		_, err = s.GetRoomSeq("unknown")
+		assert.Error(t, err)
+
+		user := &model.User{ID: "user", Name: "Viewer", RoomID: roomID, Color: "red", Time: 42, Role: model.RoleCohost}
+		require.NoError(t, s.SaveSession(roomID, "token", &model.Session{User: user, Seq: 1}, time.Minute))
+		assert.Error(t, s.SaveSession("unknown", "token", &model.Session{User: user}, time.Minute))
+
+		// sessions are bound to the room
+		_, err = s.TakeSession(otherRoomID, "token")
+		assert.Error(t, err)
+		_, err = s.GetSession(otherRoomID, "token")
+		assert.Error(t, err)
+
+		// looking the session up keeps it
+		session, err := s.GetSession(roomID, "token")
+		require.NoError(t, err)
+		assert.Equal(t, user, session.User)
+		session, err = s.TakeSession(roomID, "token")
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), session.Seq)
+		assert.Equal(t, user, session.User)
+
+		// single-use
+		_, err = s.TakeSession(roomID, "token")
+		assert.Error(t, err)
+		_, err = s.GetSession(roomID, "token")
+		assert.Error(t, err)
+
+		require.NoError(t, s.SaveSession(roomID, "expiring", &model.Session{User: user}, time.Minute))
+		advance(time.Minute + time.Second)
+		_, err = s.GetSession(roomID, "expiring")
+		assert.Error(t, err)
+		_, err = s.TakeSession(roomID, "expiring")
+		assert.Error(t, err)
+	})
+}
+
+func TestDeleteUserSession(t *testing.T) {
+	forEachBackend(t, 1, func(t *testing.T, storages []Storage, advance func(time.Duration)) {
+		s := storages[0]
+		roomID := createRoom(t, s)
+
+		user := &model.User{ID: "user", Name: "Viewer", RoomID: roomID}
+		require.NoError(t, s.SaveSession(roomID, "token", &model.Session{User: user, Seq: 3, IP: "1.2.3.4"}, time.Minute))
+		require.NoError(t, s.SaveSession(roomID, "other", &model.Session{User: &model.User{ID: "other"}}, time.Minute))
+		session, err := s.DeleteUserSession(roomID, "user")
+		require.NoError(t, err)
+		require.NotNil(t, session)
+		assert.Equal(t, "Viewer", session.User.Name)
+		assert.Equal(t, int64(3), session.Seq)
+		assert.Equal(t, "1.2.3.4", session.IP)
+		_, err = s.TakeSession(roomID, "token")
+		assert.Error(t, err, "the deleted session can not be resumed")
+		session, err = s.DeleteUserSession(roomID, "user")
+		require.NoError(t, err)
+		assert.Nil(t, session)
+		_, err = s.GetSession(roomID, "other")
+		assert.NoError(t, err, "the sessions of the other members stay")
+
+		// the resumed session is gone as well
+		require.NoError(t, s.SaveSession(roomID, "resumed", &model.Session{User: user}, time.Minute))
+		_, err = s.TakeSession(roomID, "resumed")
+		require.NoError(t, err)
+		session, err = s.DeleteUserSession(roomID, "user")
+		require.NoError(t, err)
+		assert.Nil(t, session)
+
+		require.NoError(t, s.SaveSession(roomID, "expiring", &model.Session{User: user}, time.Minute))
+		advance(time.Minute + time.Second)
+		session, err = s.DeleteUserSession(roomID, "user")
+		require.NoError(t, err)
+		assert.Nil(t, session)
+	})
+}
+
+func TestPlayback(t *testing.T) {
+	forEachBackend(t, 1, func(t *testing.T, storages []Storage, advance func(time.Duration)) {
+		s := storages[0]
+		roomID := createRoom(t, s)
+
+		p, err := s.GetPlayback(roomID)
+		require.NoError(t, err)
+		assert.False(t, p.Playing)
+		assert.Equal(t, float64(0), p.Position)
+		assert.Equal(t, float64(1), p.Rate)
+
+		playing, rate := true, 1.5
+		now := utils.UnixMilli(time.Now())
+		updated := &model.Playback{Position: 42.5, Playing: true, Rate: 1.5, UpdatedAt: now}
+		p, err = s.UpdatePlayback(roomID, &model.PlaybackUpdate{Position: 42.5, Playing: &playing, Rate: &rate, UpdatedAt: now})
+		require.NoError(t, err)
+		assert.Equal(t, updated, p)
+		p, err = s.GetPlayback(roomID)
+		require.NoError(t, err)
+		assert.Equal(t, updated, p)
+
+		room, err := s.GetTempRoom(roomID)
+		require.NoError(t, err)
+		assert.Equal(t, updated, room.Playback)
+
+		// omitted fields are kept and the update time never goes back
+		p, err = s.UpdatePlayback(roomID, &model.PlaybackUpdate{Position: 10, UpdatedAt: now - 1000})
+		require.NoError(t, err)
+		assert.Equal(t, &model.Playback{Position: 10, Playing: true, Rate: 1.5, UpdatedAt: now}, p)
+
+		_, err = s.GetPlayback("unknown")
+		assert.Error(t, err)
+		_, err = s.UpdatePlayback("unknown", &model.PlaybackUpdate{})
+		assert.Error(t, err)
+		assert.False(t, s.TempRoomExist("unknown"))
+	})
+}
+
+func TestConcurrentPlaybackUpdates(t *testing.T) {
+	forEachBackend(t, 2, func(t *testing.T, storages []Storage, advance func(time.Duration)) {
+		roomID := createRoom(t, storages[0])
+
+		// updates of different fields from several instances must not overwrite each other
+		playing, rate := true, 2.0
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			update := &model.PlaybackUpdate{Position: 1, Rate: &rate}
+			if i%2 == 0 {
+				update = &model.PlaybackUpdate{Position: 1, Playing: &playing}
+			}
+			wg.Add(1)
+			go func(s Storage) {
+				defer wg.Done()
+				_, err := s.UpdatePlayback(roomID, update)
+				assert.NoError(t, err)
+			}(storages[i%len(storages)])
+		}
+		wg.Wait()
+
+		p, err := storages[0].GetPlayback(roomID)
+		require.NoError(t, err)
+		assert.True(t, p.Playing)
+		assert.Equal(t, rate, p.Rate)
+	})
+}
+
+func TestMemberRoles(t *testing.T) {
+	forEachBackend(t, 1, func(t *testing.T, storages []Storage, advance func(time.Duration)) {
+		s := storages[0]
+		roomID, err := s.CreateTempRoom(&model.Room{Title: "test", VideoURL: "https://youtube.com", HostToken: "token"}, time.Hour)
+		require.NoError(t, err)
+
+		room, err := s.GetTempRoom(roomID)
+		require.NoError(t, err)
+		assert.Equal(t, "token", room.HostToken)
+		assert.Equal(t, model.PolicyEveryone, room.ControlPolicy)
+
+		require.NoError(t, s.AddUserToRoom(roomID, &model.User{ID: "host", Role: model.RoleHost}))
+		require.NoError(t, s.AddUserToRoom(roomID, &model.User{ID: "user", Role: model.RoleMember}))
+		role, err := s.GetMemberRole(roomID, "host")
+		require.NoError(t, err)
+		assert.Equal(t, model.RoleHost, role)
+
+		require.NoError(t, s.SetMemberRole(roomID, "user", model.RoleCohost))
+		assert.Error(t, s.SetMemberRole(roomID, "unknown", model.RoleCohost))
+		// renaming does not reset the role
+		require.NoError(t, s.UpdateRoomUser(roomID, &model.User{ID: "user", Name: "Renamed", Role: model.RoleMember}))
+		room, err = s.GetTempRoom(roomID)
+		require.NoError(t, err)
+		require.Len(t, room.Members, 2)
+		assert.Equal(t, model.RoleHost, room.Members[0].Role)
+		assert.Equal(t, model.RoleCohost, room.Members[1].Role)
+		assert.Equal(t, "Renamed", room.Members[1].Name)
+
+		require.NoError(t, s.SetMemberRole(roomID, "user", model.RoleMember))
+		role, err = s.GetMemberRole(roomID, "user")
+		require.NoError(t, err)
+		assert.Equal(t, model.RoleMember, role)
+
+		// role is dropped with the member
+		require.NoError(t, s.RemoveUserFromRoom(roomID, "host"))
+		role, err = s.GetMemberRole(roomID, "host")
+		require.NoError(t, err)
+		assert.Equal(t, model.RoleMember, role)
+
+		require.NoError(t, s.UpdateControlPolicy(roomID, model.PolicyHost))
+		policy, err := s.GetControlPolicy(roomID)
+		require.NoError(t, err)
+		assert.Equal(t, model.PolicyHost, policy)
+		_, err = s.GetControlPolicy("unknown")
+		assert.Error(t, err)
+		assert.Error(t, s.UpdateControlPolicy("unknown", model.PolicyHost))
+	})
+}
+
+// Simulates two API instances, one of them stops heartbeating
+func TestModeration(t *testing.T) {
+	forEachBackend(t, 2, func(t *testing.T, storages []Storage, advance func(time.Duration)) {
+		s, other := storages[0], storages[1]
+		roomID := createRoom(t, s)
+
+		require.NoError(t, s.SaveRoomBan(roomID, &model.Ban{UserID: "user2", Name: "Bob", CreatedAt: 2}))
+		require.NoError(t, s.SaveRoomBan(roomID, &model.Ban{UserID: "user1", Name: "Alice", CreatedAt: 1}))
+		// identities learned later replace the ban
+		require.NoError(t, other.SaveRoomBan(roomID, &model.Ban{UserID: "user2", Name: "Bob", IP: "10.0.0.1", CreatedAt: 2}))
+		assert.Error(t, s.SaveRoomBan("unknown", &model.Ban{UserID: "user"}))
+
+		bans, err := other.GetRoomBans(roomID)
+		require.NoError(t, err)
+		require.Len(t, bans, 2)
+		assert.Equal(t, "user1", bans[0].UserID)
+		assert.Equal(t, &model.Ban{UserID: "user2", Name: "Bob", IP: "10.0.0.1", CreatedAt: 2}, bans[1])
+		_, err = s.GetRoomBans("unknown")
+		assert.Error(t, err)
+
+		require.NoError(t, s.RemoveRoomBan(roomID, "user1"))
+		assert.Equal(t, ErrBanNotFound, other.RemoveRoomBan(roomID, "user1"))
+		bans, err = s.GetRoomBans(roomID)
+		require.NoError(t, err)
+		assert.Len(t, bans, 1)
+
+		require.NoError(t, s.SetMemberMuted(roomID, "user", true))
+		muted, err := other.IsMemberMuted(roomID, "user")
+		require.NoError(t, err)
+		assert.True(t, muted)
+		// the mute survives leaving the room
+		require.NoError(t, s.RemoveUserFromRoom(roomID, "user"))
+		muted, err = other.IsMemberMuted(roomID, "user")
+		require.NoError(t, err)
+		assert.True(t, muted)
+
+		require.NoError(t, other.SetMemberMuted(roomID, "user", false))
+		muted, err = s.IsMemberMuted(roomID, "user")
+		require.NoError(t, err)
+		assert.False(t, muted)
+		assert.Error(t, s.SetMemberMuted("unknown", "user", true))
+	})
+}
+
+func TestTakeRoomToken(t *testing.T) {
+	forEachBackend(t, 2, func(t *testing.T, storages []Storage, advance func(time.Duration)) {
+		s, other := storages[0], storages[1]
+		roomID := createRoom(t, s)
+		limit := ratelimit.Limit{Events: 2, Per: 100 * time.Millisecond}
+
+		// the bucket is shared by the instances
+		for i, s := range []Storage{s, other, s} {
+			allowed, err := s.TakeRoomToken(roomID, "chat", limit)
+			require.NoError(t, err)
+			assert.Equal(t, i < 2, allowed, i)
+		}
+		// buckets are independent
+		allowed, err := other.TakeRoomToken(roomID, "control", limit)
+		require.NoError(t, err)
+		assert.True(t, allowed)
+
+		// the redis bucket is refilled by the wall clock, the memory one by the storage clock
+		advance(time.Second)
+		time.Sleep(60 * time.Millisecond)
+		allowed, err = other.TakeRoomToken(roomID, "chat", limit)
+		require.NoError(t, err)
+		assert.True(t, allowed)
+
+		allowed, err = s.TakeRoomToken(roomID, "chat", ratelimit.Limit{})
+		require.NoError(t, err)
+		assert.True(t, allowed)
+		_, err = s.TakeRoomToken("unknown", "chat", limit)
+		assert.Error(t, err)
+	})
+}
+
+func TestChatSettings(t *testing.T) {
+	forEachBackend(t, 2, func(t *testing.T, storages []Storage, advance func(time.Duration)) {
+		s, other := storages[0], storages[1]
+		roomID := createRoom(t, s)
+
+		settings, err := s.GetChatSettings(roomID)
+		require.NoError(t, err)
+		assert.Equal(t, model.NewChatSettings(), settings)
+
+		require.NoError(t, s.UpdateChatSettings(roomID, &model.ChatSettings{SlowMode: 10, LinkPolicy: model.PolicyHost}))
+		settings, err = other.GetChatSettings(roomID)
+		require.NoError(t, err)
+		assert.Equal(t, &model.ChatSettings{SlowMode: 10, LinkPolicy: model.PolicyHost}, settings)
+		room, err := other.GetTempRoom(roomID)
+		require.NoError(t, err)
+		assert.Equal(t, settings, room.Chat)
+		_, err = s.GetChatSettings("unknown")
+		assert.Error(t, err)
+		assert.Error(t, s.UpdateChatSettings("unknown", settings))
+
+		last, err := s.GetLastMessage(roomID, "user")
+		require.NoError(t, err)
+		assert.Nil(t, last)
+		require.NoError(t, s.SaveLastMessage(roomID, "user", &model.LastMessage{Digest: "digest", CreatedAt: 1}))
+		last, err = other.GetLastMessage(roomID, "user")
+		require.NoError(t, err)
+		assert.Equal(t, &model.LastMessage{Digest: "digest", CreatedAt: 1}, last)
+		assert.Error(t, s.SaveLastMessage("unknown", "user", last))
+	})
+}
+
+func TestReapDeadNodes(t *testing.T) {
+	forEachBackend(t, 2, func(t *testing.T, storages []Storage, advance func(time.Duration)) {
+		alive, crashed := storages[0], storages[1]
+		const lease = 10 * time.Second
+		require.NoError(t, alive.HeartbeatNode("alive", lease))
+		require.NoError(t, crashed.HeartbeatNode("crashed", lease))
+
+		room1, room2 := createRoom(t, alive), createRoom(t, alive)
+		require.NoError(t, alive.AddUserToRoom(room1, &model.User{ID: "a1", NodeID: "alive"}))
+		require.NoError(t, crashed.AddUserToRoom(room1, &model.User{ID: "c1", NodeID: "crashed", Role: model.RoleHost}))
+		require.NoError(t, crashed.AddUserToRoom(room2, &model.User{ID: "c2", NodeID: "crashed"}))
+		// disconnected before the crash
+		require.NoError(t, crashed.AddUserToRoom(room2, &model.User{ID: "c3", NodeID: "crashed"}))
+		require.NoError(t, crashed.RemoveUserFromRoom(room2, "c3"))
+
+		advance(lease / 2)
+		require.NoError(t, alive.HeartbeatNode("alive", lease))
+		users, err := alive.ReapDeadNodes()
+		require.NoError(t, err)
+		assert.Empty(t, users)
+
+		advance(lease / 2)
+		require.NoError(t, alive.HeartbeatNode("alive", lease))
+		users, err = alive.ReapDeadNodes()
+		require.NoError(t, err)
+		var reaped []string
+		for _, u := range users {
+			assert.Equal(t, "crashed", u.NodeID)
+			reaped = append(reaped, u.RoomID+"/"+u.ID)
+		}
+		assert.ElementsMatch(t, []string{room1 + "/c1", room2 + "/c2"}, reaped)
+
+		room, err := alive.GetTempRoom(room1)
+		require.NoError(t, err)
+		require.Len(t, room.Members, 1)
+		assert.Equal(t, "a1", room.Members[0].ID)
+		role, err := alive.GetMemberRole(room1, "c1")
+		require.NoError(t, err)
+		assert.Equal(t, model.RoleMember, role)
+		room, err = alive.GetTempRoom(room2)
+		require.NoError(t, err)
+		assert.Empty(t, room.Members)
+
+		// reaped only once
+		users, err = alive.ReapDeadNodes()
+		require.NoError(t, err)
+		assert.Empty(t, users)
+	})
+}